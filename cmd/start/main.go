@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gmencz/mycelium/pkg/config"
 	"github.com/gmencz/mycelium/pkg/server"
 	logger "github.com/sirupsen/logrus"
 )
 
 func main() {
-	server := server.NewServer()
-	logger.Fatal(server.Start())
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	server := server.NewServer(cfg)
+	if err := server.Start(ctx); err != nil {
+		logger.Fatal(err)
+	}
 }
@@ -65,6 +65,7 @@ interface ErrorMessage {
   s?: number;
   t: MessageTypes;
   r: string;
+  c?: 'rate_limited';
 }
 
 interface KeyAuthentication {
@@ -0,0 +1,91 @@
+package broker
+
+import "sync"
+
+// AppChannels keeps a subscription to the channels of every app in a set that changes over time, so servers only get
+// the messages published on the channels of the apps that need them.
+type AppChannels struct {
+	subscribe func(subject string) (Subscription, error)
+
+	// Held while the apps are loaded too, so a refresh can't undo a newer one.
+	mu            sync.Mutex
+	subscriptions map[string]Subscription
+	closed        bool
+}
+
+// NewAppChannels returns an AppChannels subscribing to the subject of the channels of an app with subscribe.
+func NewAppChannels(subscribe func(subject string) (Subscription, error)) *AppChannels {
+	return &AppChannels{subscribe: subscribe, subscriptions: make(map[string]Subscription)}
+}
+
+// Refresh subscribes to the channels of the apps returned by load and unsubscribes from those of any other app.
+func (a *AppChannels) Refresh(load func() ([]string, error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	appIDs, err := load()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(appIDs))
+	for _, appID := range appIDs {
+		wanted[appID] = true
+		if err := a.set(appID, true); err != nil {
+			return err
+		}
+	}
+
+	for appID := range a.subscriptions {
+		if !wanted[appID] {
+			a.set(appID, false)
+		}
+	}
+
+	return nil
+}
+
+// RefreshApp subscribes to the channels of the app or unsubscribes from them depending on what load returns.
+func (a *AppChannels) RefreshApp(appID string, load func() (bool, error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	subscribed, err := load()
+	if err != nil {
+		return err
+	}
+
+	return a.set(appID, subscribed)
+}
+
+// Close unsubscribes from the channels of every app, refreshing it afterwards doesn't subscribe again.
+func (a *AppChannels) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	for appID := range a.subscriptions {
+		a.set(appID, false)
+	}
+}
+
+// Must be called with the lock held.
+func (a *AppChannels) set(appID string, subscribed bool) error {
+	subscription, ok := a.subscriptions[appID]
+	if subscribed == ok || (subscribed && a.closed) {
+		return nil
+	}
+
+	if !subscribed {
+		delete(a.subscriptions, appID)
+		return subscription.Unsubscribe()
+	}
+
+	subscription, err := a.subscribe(ChannelSubject(appID, "*"))
+	if err != nil {
+		return err
+	}
+
+	a.subscriptions[appID] = subscription
+	return nil
+}
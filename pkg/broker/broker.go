@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subjects used by the servers to talk to each other.
+const (
+	SubjectSituationChange = "situation_change"
+	SubjectPresenceChange  = "presence_change"
+	SubjectOccupancy       = "occupancy"
+
+	// Prefix of the subjects messages published on channels are sent to, see ChannelSubject.
+	SubjectChannelsPrefix = "mycelium"
+)
+
+// ChannelSubject returns the subject messages published on the channel of the app are sent to, so servers only get
+// the messages of channels they have subscribers on. App IDs and channel names can't contain dots or wildcards.
+func ChannelSubject(appID string, channel string) string {
+	return SubjectChannelsPrefix + "." + appID + "." + channel
+}
+
+// Broker delivers messages published by any server to the subscribers of their subject on every server.
+//
+// Subjects are dot separated tokens like NATS subjects, subscriptions can use "*" to match a single token and ">" at
+// the end to match one or more tokens.
+type Broker interface {
+	// Publish publishes the data on the subject.
+	Publish(subject string, data []byte) error
+
+	// Subscribe calls the handler with the data of every message published on the subject. Messages of a subscription
+	// are handled one at a time, in the order they were published.
+	Subscribe(subject string, handler func(data []byte)) (Subscription, error)
+
+	// QueueSubscribe is like Subscribe but every message is only handled by one of the subscriptions of the queue
+	// across every server.
+	QueueSubscribe(subject string, queue string, handler func(data []byte)) (Subscription, error)
+
+	// Close stops delivering messages and releases the resources of the broker.
+	Close()
+}
+
+// Subscription to a subject of a Broker.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// PublishJSON publishes v encoded as JSON on the subject.
+func PublishJSON(b Broker, subject string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.Publish(subject, data)
+}
+
+// SubscribeJSON subscribes to the subject decoding every message as JSON into a T, messages that can't be decoded are
+// dropped.
+func SubscribeJSON[T any](b Broker, subject string, handler func(data *T)) (Subscription, error) {
+	return b.Subscribe(subject, decodeJSON(subject, handler))
+}
+
+// QueueSubscribeJSON is like SubscribeJSON but with QueueSubscribe.
+func QueueSubscribeJSON[T any](b Broker, subject string, queue string, handler func(data *T)) (Subscription, error) {
+	return b.QueueSubscribe(subject, queue, decodeJSON(subject, handler))
+}
+
+func decodeJSON[T any](subject string, handler func(data *T)) func(data []byte) {
+	return func(data []byte) {
+		v := new(T)
+		if err := json.Unmarshal(data, v); err != nil {
+			logrus.Error("failed to decode message published on ", subject)
+			return
+		}
+
+		handler(v)
+	}
+}
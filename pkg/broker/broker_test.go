@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	N int `json:"n"`
+}
+
+func TestMemoryBrokerDeliversInOrder(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	const messages = 100
+	var wg sync.WaitGroup
+	wg.Add(messages)
+
+	received := make([]int, 0, messages)
+	SubscribeJSON(b, "mycelium.app.*", func(data *testMessage) {
+		received = append(received, data.N)
+		wg.Done()
+	})
+
+	for i := 0; i < messages; i++ {
+		PublishJSON(b, "mycelium.app.lobby", &testMessage{N: i})
+	}
+
+	wg.Wait()
+	for i, n := range received {
+		if n != i {
+			t.Fatalf("expected message %d, but got %d", i, n)
+		}
+	}
+}
+
+func TestMemoryBrokerQueueGroups(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	const messages = 10
+	var handled int64
+	done := make(chan struct{}, 3*messages)
+	for i := 0; i < 3; i++ {
+		b.QueueSubscribe("events", "workers", func(data []byte) {
+			atomic.AddInt64(&handled, 1)
+			done <- struct{}{}
+		})
+	}
+
+	for i := 0; i < messages; i++ {
+		b.Publish("events", []byte("{}"))
+	}
+
+	deadline := time.After(time.Second)
+	for i := 0; i < messages; i++ {
+		select {
+		case <-done:
+		case <-deadline:
+			t.Fatalf("expected %d messages to be handled, but got %d", messages, atomic.LoadInt64(&handled))
+		}
+	}
+
+	// Nothing is handled more than once.
+	select {
+	case <-done:
+		t.Fatalf("expected %d messages to be handled once, but got %d", messages, atomic.LoadInt64(&handled))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEmbeddedBroker(t *testing.T) {
+	// Brokers of different processes on the same host run side by side, each with its own JetStream state.
+	other, err := NewEmbeddedBroker()
+	if err != nil {
+		t.Fatalf("expected the embedded broker to start, but got %s", err)
+	}
+	defer other.Close()
+
+	b, err := NewEmbeddedBroker()
+	if err != nil {
+		t.Fatalf("expected the embedded broker to start, but got %s", err)
+	}
+	defer b.Close()
+
+	received := make(chan int, 1)
+	SubscribeJSON(b, "mycelium.app.*", func(data *testMessage) {
+		received <- data.N
+	})
+
+	PublishJSON(b, "mycelium.app.lobby", &testMessage{N: 1})
+
+	select {
+	case n := <-received:
+		if n != 1 {
+			t.Fatalf("expected message %d, but got %d", 1, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected message %d, but got nothing", 1)
+	}
+}
+
+func TestAppChannels(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	received := make(chan string, 10)
+	apps := NewAppChannels(func(subject string) (Subscription, error) {
+		return b.Subscribe(subject, func(data []byte) { received <- string(data) })
+	})
+
+	subscribed := func(expected ...string) {
+		t.Helper()
+		apps.mu.Lock()
+		defer apps.mu.Unlock()
+
+		if len(apps.subscriptions) != len(expected) {
+			t.Fatalf("expected to be subscribed to the channels of %v, but got %v", expected, apps.subscriptions)
+		}
+
+		for _, appID := range expected {
+			if _, ok := apps.subscriptions[appID]; !ok {
+				t.Fatalf("expected to be subscribed to the channels of %v, but got %v", expected, apps.subscriptions)
+			}
+		}
+	}
+
+	apps.Refresh(func() ([]string, error) { return []string{"a", "b"}, nil })
+	subscribed("a", "b")
+
+	b.Publish(ChannelSubject("a", "lobby"), []byte("a"))
+	select {
+	case data := <-received:
+		if data != "a" {
+			t.Fatalf("expected the message of app a, but got %q", data)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message of app a")
+	}
+
+	apps.RefreshApp("b", func() (bool, error) { return false, nil })
+	apps.RefreshApp("c", func() (bool, error) { return true, nil })
+	subscribed("a", "c")
+
+	apps.Refresh(func() ([]string, error) { return []string{"c"}, nil })
+	subscribed("c")
+
+	apps.Close()
+	apps.RefreshApp("a", func() (bool, error) { return true, nil })
+	subscribed()
+}
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		matches bool
+	}{
+		{"situation_change", "situation_change", true},
+		{"situation_change", "presence_change", false},
+		{"mycelium.*.lobby", "mycelium.app.lobby", true},
+		{"mycelium.*", "mycelium.app.lobby", false},
+		{"mycelium.>", "mycelium.app.lobby", true},
+		{"mycelium.>", "mycelium", false},
+	}
+
+	for _, test := range tests {
+		if MatchSubject(test.pattern, test.subject) != test.matches {
+			t.Errorf("expected MatchSubject(%q, %q) to be %v", test.pattern, test.subject, test.matches)
+		}
+	}
+}
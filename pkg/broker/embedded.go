@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// How long the embedded server has to start accepting connections.
+const embeddedStartTimeout = 10 * time.Second
+
+// NewEmbeddedBroker starts a NATS server (with JetStream) inside the process, listening on a random local port, and
+// returns a Broker connected to it. JetStream keeps its state in a directory of its own, so processes on the same host
+// don't share it. The server is shut down and the directory removed when the broker is closed.
+func NewEmbeddedBroker() (*NatsBroker, error) {
+	storeDir, err := os.MkdirTemp("", "mycelium-nats-")
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  storeDir,
+	})
+
+	if err != nil {
+		os.RemoveAll(storeDir)
+		return nil, err
+	}
+
+	shutdown := func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+		os.RemoveAll(storeDir)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(embeddedStartTimeout) {
+		shutdown()
+		return nil, errors.New("embedded NATS server didn't start in time")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		shutdown()
+		return nil, err
+	}
+
+	return &NatsBroker{nc: nc, onClose: shutdown}, nil
+}
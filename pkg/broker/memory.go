@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// MemoryBroker is a Broker that only delivers messages within the process, it's meant for running a single server
+// without NATS and for tests.
+type MemoryBroker struct {
+	mu            sync.Mutex
+	subscriptions map[*memorySubscription]bool
+
+	// Next subscription of every queue group to get a message, so they're spread evenly.
+	queueNext map[string]int
+	closed    bool
+}
+
+// NewMemoryBroker returns a MemoryBroker without subscriptions.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscriptions: make(map[*memorySubscription]bool),
+		queueNext:     make(map[string]int),
+	}
+}
+
+type memorySubscription struct {
+	broker  *MemoryBroker
+	subject string
+	queue   string
+	handler func(data []byte)
+
+	// Messages waiting to be handled, in the order they were published.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	done    bool
+}
+
+func (s *memorySubscription) run() {
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.done {
+			s.cond.Wait()
+		}
+
+		if s.done {
+			s.mu.Unlock()
+			return
+		}
+
+		data := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		s.handler(data)
+	}
+}
+
+func (s *memorySubscription) deliver(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, data)
+	s.cond.Signal()
+}
+
+func (s *memorySubscription) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.cond.Signal()
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.broker.mu.Lock()
+	delete(s.broker.subscriptions, s)
+	s.broker.mu.Unlock()
+
+	s.stop()
+	return nil
+}
+
+func (b *MemoryBroker) Publish(subject string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errors.New("broker closed")
+	}
+
+	queues := make(map[string][]*memorySubscription)
+	for s := range b.subscriptions {
+		if !MatchSubject(s.subject, subject) {
+			continue
+		}
+
+		if s.queue == "" {
+			s.deliver(data)
+		} else {
+			queues[s.queue] = append(queues[s.queue], s)
+		}
+	}
+
+	for queue, members := range queues {
+		next := b.queueNext[queue] % len(members)
+		b.queueNext[queue] = next + 1
+		members[next].deliver(data)
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(subject string, handler func(data []byte)) (Subscription, error) {
+	return b.subscribe(subject, "", handler)
+}
+
+func (b *MemoryBroker) QueueSubscribe(subject string, queue string, handler func(data []byte)) (Subscription, error) {
+	return b.subscribe(subject, queue, handler)
+}
+
+func (b *MemoryBroker) subscribe(subject string, queue string, handler func(data []byte)) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, errors.New("broker closed")
+	}
+
+	s := &memorySubscription{broker: b, subject: subject, queue: queue, handler: handler}
+	s.cond = sync.NewCond(&s.mu)
+	b.subscriptions[s] = true
+	go s.run()
+
+	return s, nil
+}
+
+func (b *MemoryBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subscriptions {
+		s.stop()
+	}
+
+	b.subscriptions = make(map[*memorySubscription]bool)
+}
+
+// MatchSubject reports whether the subject matches the pattern of a subscription, which can use "*" to match a single
+// token and ">" at the end to match one or more tokens.
+func MatchSubject(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" && i == len(patternTokens)-1 {
+			return len(subjectTokens) > i
+		}
+
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// NatsBroker is a Broker backed by a NATS server.
+type NatsBroker struct {
+	nc *nats.Conn
+
+	// Called after closing the connection, e.g. to shut down an embedded server.
+	onClose func()
+}
+
+// NewNatsBroker connects to the NATS server at url.
+func NewNatsBroker(url string) (*NatsBroker, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NatsBroker{nc: nc}, nil
+}
+
+// Conn returns the connection to the NATS server, for features only NATS has like JetStream.
+func (b *NatsBroker) Conn() *nats.Conn {
+	return b.nc
+}
+
+func (b *NatsBroker) Publish(subject string, data []byte) error {
+	return b.nc.Publish(subject, data)
+}
+
+func (b *NatsBroker) Subscribe(subject string, handler func(data []byte)) (Subscription, error) {
+	return b.nc.Subscribe(subject, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+}
+
+func (b *NatsBroker) QueueSubscribe(subject string, queue string, handler func(data []byte)) (Subscription, error) {
+	return b.nc.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+}
+
+func (b *NatsBroker) Close() {
+	b.nc.Close()
+	if b.onClose != nil {
+		b.onClose()
+	}
+}
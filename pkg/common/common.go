@@ -69,3 +69,22 @@ func ValidateString(s string) bool {
 
 	return false
 }
+
+// MatchChannelPattern reports whether the channel matches the pattern, which is either a channel name or a prefix
+// followed by "*".
+func MatchChannelPattern(pattern string, channel string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(channel, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == channel
+}
+
+// ValidateChannelPattern validates a channel name or a channel prefix followed by "*".
+func ValidateChannelPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	return ValidateString(strings.TrimSuffix(pattern, "*"))
+}
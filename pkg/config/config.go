@@ -0,0 +1,560 @@
+// Package config loads the configuration of a server from defaults, a YAML or TOML file, environment variables and
+// command line flags, in that order of precedence (flags win).
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/ulule/limiter/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config of a server.
+type Config struct {
+	// Port the server listens on.
+	Port int `yaml:"port" toml:"port"`
+
+	TLS       TLS       `yaml:"tls" toml:"tls"`
+	MQTT      MQTT      `yaml:"mqtt" toml:"mqtt"`
+	HTTP      HTTP      `yaml:"http" toml:"http"`
+	Database  Database  `yaml:"database" toml:"database"`
+	Redis     Redis     `yaml:"redis" toml:"redis"`
+	Nats      Nats      `yaml:"nats" toml:"nats"`
+	WebSocket WebSocket `yaml:"websocket" toml:"websocket"`
+	CORS      CORS      `yaml:"cors" toml:"cors"`
+	RateLimit RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+	Shutdown  Shutdown  `yaml:"shutdown" toml:"shutdown"`
+
+	// Time allowed for each database, channel store and broker operation.
+	OperationTimeout Duration `yaml:"operation_timeout" toml:"operation_timeout"`
+
+	// Where the state of channels is kept: "redis" or "memory" to run a single server without redis.
+	ChannelStore string `yaml:"channel_store" toml:"channel_store"`
+
+	// How servers talk to each other: "nats" to connect to Nats.Host, "embedded" to run a NATS server inside the
+	// process or "memory" to run a single server without NATS.
+	Broker string `yaml:"broker" toml:"broker"`
+
+	// ID of the Fly instance of the server, set by Fly in FLY_ALLOC_ID. Long-polling sessions only live on the
+	// server that started them, so their requests reaching another instance are replayed on theirs. Without it
+	// long-polling requires the load balancer to route the requests of a client to the same server.
+	Instance string `yaml:"instance" toml:"instance"`
+}
+
+// TLS the server is served with, it's served without TLS when there's no certificate.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+
+	// CAs of the client certificates required by the REST API, realtime connections don't need one. Client
+	// certificates aren't required when it's empty.
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+
+	// How often the files are checked for changes, they're reloaded without restarting the server.
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval"`
+
+	// Port of a plaintext listener redirecting to the server, there's none when it's 0.
+	RedirectPort int `yaml:"redirect_port" toml:"redirect_port"`
+}
+
+// Enabled reports whether the server is served with TLS.
+func (t *TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// MQTT listener for clients speaking MQTT 3.1.1 or 5 instead of the realtime protocol, it's served with TLS when the
+// server is.
+type MQTT struct {
+	// Port the MQTT listener listens on, there's none when it's 0.
+	Port int `yaml:"port" toml:"port"`
+}
+
+// HTTP timeouts of the server, realtime connections aren't bound by them once upgraded.
+type HTTP struct {
+	// Time allowed to read the headers of a request.
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+
+	// Time allowed to read a request, including its body.
+	ReadTimeout Duration `yaml:"read_timeout" toml:"read_timeout"`
+
+	// Time allowed to write a response, from the end of reading the request headers.
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout"`
+
+	// Time to keep idle connections open waiting for the next request.
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+
+	// Time allowed to handle a request of the REST API.
+	RequestTimeout Duration `yaml:"request_timeout" toml:"request_timeout"`
+}
+
+type Database struct {
+	URL string `yaml:"url" toml:"url"`
+}
+
+type Redis struct {
+	Address  string `yaml:"address" toml:"address"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+type Nats struct {
+	Host string `yaml:"host" toml:"host"`
+
+	// Checked by the health endpoint, it's skipped when empty.
+	HealthcheckEndpoint string `yaml:"healthcheck_endpoint" toml:"healthcheck_endpoint"`
+}
+
+// WebSocket timeouts and limits of the realtime connections.
+type WebSocket struct {
+	// Time allowed to read the next pong message from the client.
+	PongWait Duration `yaml:"pong_wait" toml:"pong_wait"`
+
+	// Time allowed to write a message to the client.
+	WriteWait Duration `yaml:"write_wait" toml:"write_wait"`
+
+	// Time to wait for the client to close the connection after sending a close message before force closing it.
+	CloseGracePeriod Duration `yaml:"close_grace_period" toml:"close_grace_period"`
+
+	// Maximum size in bytes of the messages sent by clients.
+	MaxMessageSize int64 `yaml:"max_message_size" toml:"max_message_size"`
+
+	// Maximum channels a client can subscribe to.
+	MaxChannels int `yaml:"max_channels" toml:"max_channels"`
+
+	// Messages a client can send per second on average, bursts of up to MessageBurst messages are allowed. The
+	// messages over the limit are rejected and clients that keep sending them are disconnected.
+	MaxMessagesPerSecond int `yaml:"max_messages_per_second" toml:"max_messages_per_second"`
+	MessageBurst         int `yaml:"message_burst" toml:"message_burst"`
+
+	// Messages that can be published per second on a channel and by an app across every server, 0 means no limit.
+	ChannelMessagesPerSecond int `yaml:"channel_messages_per_second" toml:"channel_messages_per_second"`
+	AppMessagesPerSecond     int `yaml:"app_messages_per_second" toml:"app_messages_per_second"`
+
+	// Maximum connections to the server, 0 means no limit.
+	MaxConnections int `yaml:"max_connections" toml:"max_connections"`
+
+	// Maximum connections to an app across every server unless the app sets its own, 0 means no limit.
+	MaxConnectionsPerApp int `yaml:"max_connections_per_app" toml:"max_connections_per_app"`
+
+	// Maximum connections to the server from an IP, 0 means no limit.
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip" toml:"max_connections_per_ip"`
+
+	// Level of the permessage-deflate compression negotiated with clients, from 1 (fastest) to 9 (smallest) as in
+	// compress/flate, -1 is the default level of compress/flate and 0 disables compression.
+	CompressionLevel int `yaml:"compression_level" toml:"compression_level"`
+
+	// Messages smaller than this many bytes are sent uncompressed, compressing them costs more than it saves.
+	CompressionThreshold int `yaml:"compression_threshold" toml:"compression_threshold"`
+
+	// Subscribers receiving the messages of a channel as deltas get the whole data every this many messages, so
+	// they recover from a delta they failed to apply.
+	DeltaKeyframeInterval int `yaml:"delta_keyframe_interval" toml:"delta_keyframe_interval"`
+}
+
+type CORS struct {
+	// Origins allowed to make requests, "*" allows any origin.
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+}
+
+// RateLimit of the REST API, requests are counted per key once they're authenticated. Rates are in the format of
+// github.com/ulule/limiter, e.g. "15000-H", and health checks aren't limited.
+type RateLimit struct {
+	// Requests allowed per key by the routes without their own rate.
+	REST string `yaml:"rest" toml:"rest"`
+
+	// Messages published per key through the REST API, empty uses the rest rate. They're counted separately so
+	// reading channels doesn't use up the budget for publishing.
+	Publish string `yaml:"publish" toml:"publish"`
+
+	// Requests allowed per key by the admin routes, e.g. channel rules and webhooks, empty uses the rest rate.
+	Admin string `yaml:"admin" toml:"admin"`
+
+	// Requests failing authentication allowed per IP, empty doesn't limit them. They're counted before the key is
+	// looked up so keys can't be guessed without a limit.
+	FailedAuth string `yaml:"failed_auth" toml:"failed_auth"`
+}
+
+// Shutdown of the server, clients are asked to reconnect to another server and their connections are drained.
+type Shutdown struct {
+	// Time allowed to shut down before exiting anyway.
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+
+	// Maximum connections being closed at once.
+	DrainConcurrency int `yaml:"drain_concurrency" toml:"drain_concurrency"`
+
+	// Time clients are asked to wait before reconnecting, plus a random part of the jitter.
+	ReconnectDelay  Duration `yaml:"reconnect_delay" toml:"reconnect_delay"`
+	ReconnectJitter Duration `yaml:"reconnect_jitter" toml:"reconnect_jitter"`
+}
+
+// Duration is a time.Duration read from strings like "10s" in files, environment variables and flags.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Port: 9001,
+		TLS: TLS{
+			ReloadInterval: Duration{time.Minute},
+		},
+		HTTP: HTTP{
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			ReadTimeout:       Duration{30 * time.Second},
+			WriteTimeout:      Duration{30 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			RequestTimeout:    Duration{20 * time.Second},
+		},
+		Nats: Nats{
+			Host: "localhost:4222",
+		},
+		Redis: Redis{
+			Address: "localhost:6379",
+		},
+		WebSocket: WebSocket{
+			PongWait:              Duration{60 * time.Second},
+			WriteWait:             Duration{10 * time.Second},
+			CloseGracePeriod:      Duration{10 * time.Second},
+			MaxMessageSize:        1048576,
+			MaxChannels:           500,
+			MaxMessagesPerSecond:  10,
+			MessageBurst:          20,
+			MaxConnections:        2000,
+			CompressionLevel:      1,
+			CompressionThreshold:  512,
+			DeltaKeyframeInterval: 20,
+		},
+		CORS: CORS{
+			AllowedOrigins: []string{"*"},
+		},
+		RateLimit: RateLimit{
+			REST:       "15000-H",
+			Admin:      "1000-H",
+			FailedAuth: "100-M",
+		},
+		Shutdown: Shutdown{
+			Timeout:          Duration{time.Minute},
+			DrainConcurrency: 100,
+			ReconnectDelay:   Duration{time.Second},
+			ReconnectJitter:  Duration{5 * time.Second},
+		},
+		OperationTimeout: Duration{5 * time.Second},
+		ChannelStore:     "redis",
+		Broker:           "nats",
+	}
+}
+
+// A setting that can be set with an environment variable and a flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"PORT", "port", "port to listen on", func(c *Config) interface{} { return &c.Port }},
+	{"TLS_CERT_FILE", "tls-cert-file", "certificate to serve TLS with", func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{"TLS_KEY_FILE", "tls-key-file", "private key of the TLS certificate", func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{"HTTP_READ_HEADER_TIMEOUT", "http-read-header-timeout", "time allowed to read the headers of a request", func(c *Config) interface{} { return &c.HTTP.ReadHeaderTimeout }},
+	{"HTTP_READ_TIMEOUT", "http-read-timeout", "time allowed to read a request", func(c *Config) interface{} { return &c.HTTP.ReadTimeout }},
+	{"HTTP_WRITE_TIMEOUT", "http-write-timeout", "time allowed to write a response", func(c *Config) interface{} { return &c.HTTP.WriteTimeout }},
+	{"HTTP_IDLE_TIMEOUT", "http-idle-timeout", "time to keep idle connections open", func(c *Config) interface{} { return &c.HTTP.IdleTimeout }},
+	{"HTTP_REQUEST_TIMEOUT", "http-request-timeout", "time allowed to handle a REST request", func(c *Config) interface{} { return &c.HTTP.RequestTimeout }},
+	{"TLS_CLIENT_CA_FILE", "tls-client-ca-file", "CAs of the client certificates required by the REST API", func(c *Config) interface{} { return &c.TLS.ClientCAFile }},
+	{"TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often the TLS files are checked for changes", func(c *Config) interface{} { return &c.TLS.ReloadInterval }},
+	{"TLS_REDIRECT_PORT", "tls-redirect-port", "port of a plaintext listener redirecting to TLS", func(c *Config) interface{} { return &c.TLS.RedirectPort }},
+	{"MQTT_PORT", "mqtt-port", "port of the MQTT listener, 0 disables it", func(c *Config) interface{} { return &c.MQTT.Port }},
+	{"DATABASE_URL", "database-url", "URL of the postgres database", func(c *Config) interface{} { return &c.Database.URL }},
+	{"REDIS_ADDRESS", "redis-address", "address of redis", func(c *Config) interface{} { return &c.Redis.Address }},
+	{"REDIS_PASSWORD", "redis-password", "password of redis", func(c *Config) interface{} { return &c.Redis.Password }},
+	{"NATS_HOST", "nats-host", "address of NATS", func(c *Config) interface{} { return &c.Nats.Host }},
+	{"NATS_HEALTHCHECK_ENDPOINT", "nats-healthcheck-endpoint", "NATS endpoint checked by /health", func(c *Config) interface{} { return &c.Nats.HealthcheckEndpoint }},
+	{"PONG_WAIT", "pong-wait", "time allowed to read the next pong from clients", func(c *Config) interface{} { return &c.WebSocket.PongWait }},
+	{"WRITE_WAIT", "write-wait", "time allowed to write a message to clients", func(c *Config) interface{} { return &c.WebSocket.WriteWait }},
+	{"CLOSE_GRACE_PERIOD", "close-grace-period", "time to wait before force closing connections", func(c *Config) interface{} { return &c.WebSocket.CloseGracePeriod }},
+	{"MAX_MESSAGE_SIZE", "max-message-size", "maximum size in bytes of client messages", func(c *Config) interface{} { return &c.WebSocket.MaxMessageSize }},
+	{"MAX_CHANNELS", "max-channels", "maximum channels a client can subscribe to", func(c *Config) interface{} { return &c.WebSocket.MaxChannels }},
+	{"MAX_MESSAGES_PER_SECOND", "max-messages-per-second", "messages a client can send per second on average", func(c *Config) interface{} { return &c.WebSocket.MaxMessagesPerSecond }},
+	{"MESSAGE_BURST", "message-burst", "messages a client can send at once", func(c *Config) interface{} { return &c.WebSocket.MessageBurst }},
+	{"CHANNEL_MESSAGES_PER_SECOND", "channel-messages-per-second", "messages that can be published per second on a channel, 0 means no limit", func(c *Config) interface{} { return &c.WebSocket.ChannelMessagesPerSecond }},
+	{"APP_MESSAGES_PER_SECOND", "app-messages-per-second", "messages that can be published per second by an app, 0 means no limit", func(c *Config) interface{} { return &c.WebSocket.AppMessagesPerSecond }},
+	{"MAX_CONNECTIONS", "max-connections", "maximum connections to the server, 0 means no limit", func(c *Config) interface{} { return &c.WebSocket.MaxConnections }},
+	{"MAX_CONNECTIONS_PER_APP", "max-connections-per-app", "maximum connections to an app across every server, 0 means no limit", func(c *Config) interface{} { return &c.WebSocket.MaxConnectionsPerApp }},
+	{"MAX_CONNECTIONS_PER_IP", "max-connections-per-ip", "maximum connections to the server from an IP, 0 means no limit", func(c *Config) interface{} { return &c.WebSocket.MaxConnectionsPerIP }},
+	{"COMPRESSION_LEVEL", "compression-level", "permessage-deflate level from 1 to 9, 0 disables compression", func(c *Config) interface{} { return &c.WebSocket.CompressionLevel }},
+	{"COMPRESSION_THRESHOLD", "compression-threshold", "size in bytes below which messages aren't compressed", func(c *Config) interface{} { return &c.WebSocket.CompressionThreshold }},
+	{"DELTA_KEYFRAME_INTERVAL", "delta-keyframe-interval", "messages between the whole data sent to subscribers receiving deltas", func(c *Config) interface{} { return &c.WebSocket.DeltaKeyframeInterval }},
+	{"CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma separated origins allowed to make requests", func(c *Config) interface{} { return &c.CORS.AllowedOrigins }},
+	{"RATE_LIMIT_REST", "rate-limit-rest", "rate of REST requests allowed per key, e.g. 15000-H", func(c *Config) interface{} { return &c.RateLimit.REST }},
+	{"RATE_LIMIT_PUBLISH", "rate-limit-publish", "rate of REST publishes allowed per key, empty uses the rest rate", func(c *Config) interface{} { return &c.RateLimit.Publish }},
+	{"RATE_LIMIT_ADMIN", "rate-limit-admin", "rate of admin requests allowed per key, empty uses the rest rate", func(c *Config) interface{} { return &c.RateLimit.Admin }},
+	{"RATE_LIMIT_FAILED_AUTH", "rate-limit-failed-auth", "rate of requests failing authentication allowed per IP, empty doesn't limit them", func(c *Config) interface{} { return &c.RateLimit.FailedAuth }},
+	{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "time allowed to shut down before exiting anyway", func(c *Config) interface{} { return &c.Shutdown.Timeout }},
+	{"DRAIN_CONCURRENCY", "drain-concurrency", "maximum connections closed at once when shutting down", func(c *Config) interface{} { return &c.Shutdown.DrainConcurrency }},
+	{"RECONNECT_DELAY", "reconnect-delay", "time clients wait before reconnecting when shutting down", func(c *Config) interface{} { return &c.Shutdown.ReconnectDelay }},
+	{"RECONNECT_JITTER", "reconnect-jitter", "random time clients add to the reconnect delay", func(c *Config) interface{} { return &c.Shutdown.ReconnectJitter }},
+	{"OPERATION_TIMEOUT", "operation-timeout", "time allowed for each database, channel store and broker operation", func(c *Config) interface{} { return &c.OperationTimeout }},
+	{"CHANNEL_STORE", "channel-store", "where the state of channels is kept: redis or memory", func(c *Config) interface{} { return &c.ChannelStore }},
+	{"BROKER", "broker", "how servers talk to each other: nats, embedded or memory", func(c *Config) interface{} { return &c.Broker }},
+	{"FLY_ALLOC_ID", "instance", "ID of the Fly instance of the server, long-polling requests are replayed on the instance of their session", func(c *Config) interface{} { return &c.Instance }},
+}
+
+// Load returns the configuration of the defaults, the file given with the -config flag or CONFIG_FILE environment
+// variable, the environment variables and the flags in args, validated.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(key string) (string, bool)) (*Config, error) {
+	// Flags are applied last, but the file to read has to be known first.
+	flags := flag.NewFlagSet("mycelium", flag.ContinueOnError)
+	file := flags.String("config", "", "YAML or TOML file to read the configuration from")
+
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		name := s.flag
+		flags.Func(name, s.usage, func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file == "" {
+		*file, _ = lookupEnv("CONFIG_FILE")
+	}
+
+	c := Default()
+	if *file != "" {
+		if err := c.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok && value != "" {
+			if err := set(s.value(c), value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := set(s.value(c), value); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+
+	default:
+		return fmt.Errorf("invalid config file %s, must be .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Sets the value pointed to by target from its string representation.
+func set(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		*target = n
+
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		*target = n
+
+	case *Duration:
+		return target.UnmarshalText([]byte(value))
+
+	case *[]string:
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unsupported type %T", target)
+	}
+
+	return nil
+}
+
+// Validate returns an error describing the first invalid setting of the configuration.
+func (c *Config) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.New("invalid port, must be between 0 and 65535")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("invalid tls, both cert_file and key_file must be set")
+	}
+
+	if !c.TLS.Enabled() && (c.TLS.ClientCAFile != "" || c.TLS.RedirectPort != 0) {
+		return errors.New("invalid tls, client_ca_file and redirect_port require cert_file and key_file")
+	}
+
+	if c.TLS.RedirectPort < 0 || c.TLS.RedirectPort > 65535 || (c.TLS.RedirectPort != 0 && c.TLS.RedirectPort == c.Port) {
+		return errors.New("invalid tls, redirect_port must be between 0 and 65535 and differ from port")
+	}
+
+	if c.MQTT.Port < 0 || c.MQTT.Port > 65535 || (c.MQTT.Port != 0 && (c.MQTT.Port == c.Port || c.MQTT.Port == c.TLS.RedirectPort)) {
+		return errors.New("invalid mqtt, port must be between 0 and 65535 and differ from the other ports")
+	}
+
+	if c.TLS.ReloadInterval.Duration <= 0 {
+		return errors.New("invalid tls, reload_interval must be positive")
+	}
+
+	if c.HTTP.ReadHeaderTimeout.Duration <= 0 || c.HTTP.ReadTimeout.Duration <= 0 || c.HTTP.WriteTimeout.Duration <= 0 || c.HTTP.IdleTimeout.Duration <= 0 || c.HTTP.RequestTimeout.Duration <= 0 {
+		return errors.New("invalid http, read_header_timeout, read_timeout, write_timeout, idle_timeout and request_timeout must be positive")
+	}
+
+	if c.OperationTimeout.Duration <= 0 {
+		return errors.New("invalid operation_timeout, must be positive")
+	}
+
+	if c.WebSocket.PongWait.Duration <= 0 || c.WebSocket.WriteWait.Duration <= 0 {
+		return errors.New("invalid websocket, pong_wait and write_wait must be positive")
+	}
+
+	if c.WebSocket.CloseGracePeriod.Duration < 0 {
+		return errors.New("invalid websocket, close_grace_period can't be negative")
+	}
+
+	if c.WebSocket.MaxMessageSize <= 0 || c.WebSocket.MaxChannels <= 0 || c.WebSocket.MaxMessagesPerSecond <= 0 || c.WebSocket.MessageBurst <= 0 {
+		return errors.New("invalid websocket, max_message_size, max_channels, max_messages_per_second and message_burst must be positive")
+	}
+
+	if c.WebSocket.ChannelMessagesPerSecond < 0 || c.WebSocket.AppMessagesPerSecond < 0 {
+		return errors.New("invalid websocket, channel_messages_per_second and app_messages_per_second can't be negative")
+	}
+
+	if c.WebSocket.MaxConnections < 0 || c.WebSocket.MaxConnectionsPerApp < 0 || c.WebSocket.MaxConnectionsPerIP < 0 {
+		return errors.New("invalid websocket, max_connections, max_connections_per_app and max_connections_per_ip can't be negative")
+	}
+
+	if c.WebSocket.CompressionLevel < -1 || c.WebSocket.CompressionLevel > 9 {
+		return errors.New("invalid websocket, compression_level must be between -1 and 9")
+	}
+
+	if c.WebSocket.CompressionThreshold < 0 {
+		return errors.New("invalid websocket, compression_threshold can't be negative")
+	}
+
+	if c.WebSocket.DeltaKeyframeInterval <= 0 {
+		return errors.New("invalid websocket, delta_keyframe_interval must be positive")
+	}
+
+	if c.Shutdown.Timeout.Duration <= c.WebSocket.CloseGracePeriod.Duration {
+		return errors.New("invalid shutdown, timeout must be greater than websocket close_grace_period")
+	}
+
+	if c.Shutdown.DrainConcurrency <= 0 {
+		return errors.New("invalid shutdown, drain_concurrency must be positive")
+	}
+
+	if c.Shutdown.ReconnectDelay.Duration < 0 || c.Shutdown.ReconnectJitter.Duration < 0 {
+		return errors.New("invalid shutdown, reconnect_delay and reconnect_jitter can't be negative")
+	}
+
+	if _, err := limiter.NewRateFromFormatted(c.RateLimit.REST); err != nil {
+		return fmt.Errorf("invalid rate_limit, rest: %w", err)
+	}
+
+	for name, rate := range map[string]string{"publish": c.RateLimit.Publish, "admin": c.RateLimit.Admin, "failed_auth": c.RateLimit.FailedAuth} {
+		if _, err := limiter.NewRateFromFormatted(rate); rate != "" && err != nil {
+			return fmt.Errorf("invalid rate_limit, %s: %w", name, err)
+		}
+	}
+
+	switch c.ChannelStore {
+	case "redis":
+		if c.Redis.Address == "" {
+			return errors.New("invalid redis, address must be set to use the redis channel store")
+		}
+
+	case "memory":
+
+	default:
+		return errors.New("invalid channel_store, must be redis or memory")
+	}
+
+	switch c.Broker {
+	case "nats":
+		if c.Nats.Host == "" {
+			return errors.New("invalid nats, host must be set to use the nats broker")
+		}
+
+	case "embedded", "memory":
+
+	default:
+		return errors.New("invalid broker, must be nats, embedded or memory")
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func lookupIn(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := load(nil, lookupIn(nil))
+	if err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	if c.Port != 9001 || c.WebSocket.PongWait.Duration != time.Minute || c.ChannelStore != "redis" {
+		t.Fatalf("expected the defaults, but got %+v", c)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+port: 1000
+websocket:
+  pong_wait: 30s
+  max_channels: 10
+cors:
+  allowed_origins: ["https://a.com"]
+`)
+
+	env := map[string]string{
+		"CONFIG_FILE":  file,
+		"PORT":         "2000",
+		"MAX_CHANNELS": "20",
+	}
+
+	c, err := load([]string{"-port", "3000", "-cors-allowed-origins", "https://b.com, https://c.com"}, lookupIn(env))
+	if err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	if c.Port != 3000 {
+		t.Fatalf("expected the flag to win with port %d, but got %d", 3000, c.Port)
+	}
+
+	if c.WebSocket.MaxChannels != 20 {
+		t.Fatalf("expected the environment to win with max channels %d, but got %d", 20, c.WebSocket.MaxChannels)
+	}
+
+	if c.WebSocket.PongWait.Duration != 30*time.Second {
+		t.Fatalf("expected the file to win with pong wait %s, but got %s", 30*time.Second, c.WebSocket.PongWait)
+	}
+
+	if len(c.CORS.AllowedOrigins) != 2 || c.CORS.AllowedOrigins[1] != "https://c.com" {
+		t.Fatalf("expected 2 allowed origins, but got %v", c.CORS.AllowedOrigins)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	file := writeFile(t, "config.toml", `
+broker = "memory"
+
+[websocket]
+write_wait = "5s"
+`)
+
+	c, err := load([]string{"-config", file}, lookupIn(nil))
+	if err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	if c.Broker != "memory" || c.WebSocket.WriteWait.Duration != 5*time.Second {
+		t.Fatalf("expected the file to be read, but got %+v", c)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"port out of range", []string{"-port", "70000"}, nil},
+		{"port not a number", nil, map[string]string{"PORT": "abc"}},
+		{"invalid duration", []string{"-pong-wait", "soon"}, nil},
+		{"zero operation timeout", []string{"-operation-timeout", "0s"}, nil},
+		{"zero limit", []string{"-max-messages-per-second", "0"}, nil},
+		{"certificate without key", []string{"-tls-cert-file", "cert.pem"}, nil},
+		{"redirect without certificate", []string{"-tls-redirect-port", "80"}, nil},
+		{"compression level out of range", []string{"-compression-level", "10"}, nil},
+		{"invalid rate", []string{"-rate-limit-rest", "lots"}, nil},
+		{"invalid route rate", nil, map[string]string{"RATE_LIMIT_ADMIN": "lots"}},
+		{"unknown broker", []string{"-broker", "kafka"}, nil},
+		{"unknown file format", []string{"-config", "config.json"}, nil},
+		{"unknown flag", []string{"-unknown"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := load(test.args, lookupIn(test.env)); err == nil {
+				t.Fatalf("expected an error, but got nil")
+			}
+		})
+	}
+}
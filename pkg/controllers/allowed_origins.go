@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/google/uuid"
+)
+
+type allowedOriginBody struct {
+	Origin string `json:"origin"`
+}
+
+func (c *Controller) GetAllowedOrigins(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var allowedOrigins []models.AllowedOrigin
+	if result := c.Db.WithContext(ctx.Request.Context()).Find(&allowedOrigins, "app_id = ?", apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"allowed_origins": allowedOrigins,
+	})
+}
+
+func (c *Controller) CreateAllowedOrigin(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var body allowedOriginBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	origin, err := origins.Normalize(body.Origin)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var count int64
+	if result := c.Db.WithContext(ctx.Request.Context()).Model(&models.AllowedOrigin{}).Where("app_id = ? AND origin = ?", apiKey.AppID, origin).Count(&count); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if count > 0 {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message": "origin already allowed",
+		})
+		return
+	}
+
+	allowedOrigin := models.AllowedOrigin{ID: uuid.NewString(), AppID: apiKey.AppID, Origin: origin}
+	if result := c.Db.WithContext(ctx.Request.Context()).Create(&allowedOrigin); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Origins.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusCreated, allowedOrigin)
+}
+
+func (c *Controller) DeleteAllowedOrigin(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	result := c.Db.WithContext(ctx.Request.Context()).Delete(&models.AllowedOrigin{}, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID)
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "allowed origin not found",
+		})
+		return
+	}
+
+	c.Origins.Invalidate(apiKey.AppID)
+	ctx.Status(http.StatusNoContent)
+}
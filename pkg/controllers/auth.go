@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/middlewares"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// authenticate authenticates the request with either a key (query param "key") or a token (authorization header),
+// responding with 401 and returning false if it fails.
+func (c *Controller) authenticate(ctx *gin.Context) (*models.ApiKey, bool) {
+	if ctx.Query("key") != "" {
+		return c.authenticateKey(ctx)
+	}
+
+	if !c.allowAuthentication(ctx) {
+		return nil, false
+	}
+
+	if ctx.Request.Header.Get("authorization") == "" {
+		c.unauthorized(ctx, "unauthorized")
+		return nil, false
+	}
+
+	auth, authErr := common.ParseAuthorizationHeader(ctx.Request.Header.Get("authorization"))
+	if authErr != nil {
+		c.unauthorized(ctx, authErr.Error())
+		return nil, false
+	}
+
+	var apiKey models.ApiKey
+	_, jwtErr := jwt.Parse(auth, func(token *jwt.Token) (interface{}, error) {
+		// Don't forget to validate the alg is what you expect:
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("invalid token, unexpected signing method")
+		}
+
+		kid := token.Header["kid"]
+		if kid == nil {
+			return nil, errors.New("invalid token, missing kid header")
+		}
+
+		if result := c.Db.WithContext(ctx.Request.Context()).First(&apiKey, "id = ?", kid); result.Error != nil {
+			return nil, errors.New("invalid token kid header")
+		}
+
+		return []byte(apiKey.Secret), nil
+	})
+
+	if jwtErr != nil {
+		c.unauthorized(ctx, jwtErr.Error())
+		return nil, false
+	}
+
+	if !c.allowOrigin(ctx, &apiKey) || !c.rateLimit(ctx, &apiKey) {
+		return nil, false
+	}
+
+	return &apiKey, true
+}
+
+// authenticateKey only accepts keys (query param "key"), it's used by the routes that should only be reachable
+// from trusted environments like the admin API.
+func (c *Controller) authenticateKey(ctx *gin.Context) (*models.ApiKey, bool) {
+	if !c.allowAuthentication(ctx) {
+		return nil, false
+	}
+
+	// Key format: <api-key-id:api-key-secret>. This authentication method should only be used in trusted environments like in
+	// server side.
+	keyParts := strings.Split(ctx.Query("key"), ":")
+	if len(keyParts) != 2 {
+		c.unauthorized(ctx, "invalid key")
+		return nil, false
+	}
+
+	apiKeyID := keyParts[0]
+	apiKeySecret := keyParts[1]
+
+	var apiKey models.ApiKey
+	if result := c.Db.WithContext(ctx.Request.Context()).First(&apiKey, "id = ?", apiKeyID); result.Error != nil {
+		c.unauthorized(ctx, "invalid key")
+		return nil, false
+	}
+
+	if apiKey.Secret != apiKeySecret {
+		c.unauthorized(ctx, "invalid key")
+		return nil, false
+	}
+
+	if !c.allowOrigin(ctx, &apiKey) || !c.rateLimit(ctx, &apiKey) {
+		return nil, false
+	}
+
+	return &apiKey, true
+}
+
+// authenticateAdmin is like authenticateKey but also requires the "admin" capability on every channel ("*"),
+// responding with 403 and returning false if the key doesn't have it. It's used by the admin API.
+func (c *Controller) authenticateAdmin(ctx *gin.Context) (*models.ApiKey, bool) {
+	apiKey, ok := c.authenticateKey(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	var capabilities map[string]string
+	if err := json.Unmarshal([]byte(apiKey.Capabilities), &capabilities); err != nil || !websocket.HasCapability("admin", "*", capabilities) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "the key doesn't have the admin capability",
+		})
+		return nil, false
+	}
+
+	return apiKey, true
+}
+
+// allowAuthentication checks the budget of requests failing authentication of the IP of the request before the key is
+// looked up, responding with 429 and returning false if it's used up. Only the requests that fail count against it, see
+// unauthorized.
+func (c *Controller) allowAuthentication(ctx *gin.Context) bool {
+	if c.FailedAuth == nil {
+		return true
+	}
+
+	limit, err := c.FailedAuth.Limiter.Peek(ctx.Request.Context(), c.FailedAuth.Name+":"+ctx.ClientIP())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return false
+	}
+
+	if limit.Remaining <= 0 {
+		reset := int64(math.Ceil(time.Until(time.Unix(limit.Reset, 0)).Seconds()))
+		if reset < 0 {
+			reset = 0
+		}
+
+		ctx.Header("Retry-After", strconv.FormatInt(reset, 10))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"message": "too many failed authentication attempts",
+		})
+		return false
+	}
+
+	return true
+}
+
+// unauthorized responds with 401 and the message, counting the request against the budget of requests failing
+// authentication of its IP.
+func (c *Controller) unauthorized(ctx *gin.Context, message string) {
+	if c.FailedAuth != nil {
+		c.FailedAuth.Limiter.Increment(ctx.Request.Context(), c.FailedAuth.Name+":"+ctx.ClientIP(), 1)
+	}
+
+	ctx.JSON(http.StatusUnauthorized, gin.H{
+		"message": message,
+	})
+}
+
+// allowOrigin checks the origin of the request against the origins allowed by the app of the key, responding with
+// 403 and returning false if it's not allowed. Apps with allowed origins let them read the response.
+func (c *Controller) allowOrigin(ctx *gin.Context, apiKey *models.ApiKey) bool {
+	allowedOrigins, err := c.Origins.ForApp(ctx.Request.Context(), apiKey.AppID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return false
+	}
+
+	origin := ctx.Request.Header.Get("Origin")
+	if !origins.Allowed(allowedOrigins, origin) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "origin not allowed",
+		})
+		return false
+	}
+
+	if origin != "" && len(allowedOrigins) > 0 {
+		ctx.Header("Access-Control-Allow-Origin", origin)
+		ctx.Header("Vary", "Origin")
+	}
+
+	return true
+}
+
+// rateLimit counts the request against the budget of the route for the key, responding with 429 and returning false
+// if it's used up. The budget is described by the RateLimit headers.
+func (c *Controller) rateLimit(ctx *gin.Context, apiKey *models.ApiKey) bool {
+	value, ok := ctx.Get(middlewares.RateLimiterKey)
+	if !ok {
+		return true
+	}
+
+	rateLimiter := value.(*middlewares.RateLimiter)
+	limit, err := rateLimiter.Limiter.Get(ctx.Request.Context(), rateLimiter.Name+":"+apiKey.ID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return false
+	}
+
+	reset := int64(math.Ceil(time.Until(time.Unix(limit.Reset, 0)).Seconds()))
+	if reset < 0 {
+		reset = 0
+	}
+
+	ctx.Header("RateLimit-Limit", strconv.FormatInt(limit.Limit, 10))
+	ctx.Header("RateLimit-Remaining", strconv.FormatInt(limit.Remaining, 10))
+	ctx.Header("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	ctx.Header("RateLimit-Policy", strconv.FormatInt(limit.Limit, 10)+";w="+strconv.FormatInt(int64(rateLimiter.Limiter.Rate.Period.Seconds()), 10))
+
+	if limit.Reached {
+		ctx.Header("Retry-After", strconv.FormatInt(reset, 10))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"message": "too many requests",
+		})
+		return false
+	}
+
+	return true
+}
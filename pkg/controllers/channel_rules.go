@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/google/uuid"
+)
+
+type channelRuleBody struct {
+	Pattern        string `json:"pattern"`
+	PersistHistory bool   `json:"persist_history"`
+	HistoryTTL     int64  `json:"history_ttl"`
+	MaxPayloadSize int    `json:"max_payload_size"`
+	AllowedEvents  string `json:"allowed_events"`
+	ClientPublish  *bool  `json:"client_publish"`
+	EchoPublisher  bool   `json:"echo_publisher"`
+}
+
+// apply validates the body and copies it into the rule, returning a message describing the problem if it's invalid.
+func (b *channelRuleBody) apply(rule *models.ChannelRule) string {
+	if !common.ValidateChannelPattern(b.Pattern) {
+		return "invalid pattern, must be a channel name optionally followed by *"
+	}
+
+	if b.HistoryTTL < 0 {
+		return "invalid history_ttl, can't be negative"
+	}
+
+	if b.MaxPayloadSize < 0 {
+		return "invalid max_payload_size, can't be negative"
+	}
+
+	rule.Pattern = b.Pattern
+	rule.PersistHistory = b.PersistHistory
+	rule.HistoryTTL = b.HistoryTTL
+	rule.MaxPayloadSize = b.MaxPayloadSize
+	rule.AllowedEvents = b.AllowedEvents
+	rule.ClientPublish = b.ClientPublish == nil || *b.ClientPublish
+	rule.EchoPublisher = b.EchoPublisher
+	return ""
+}
+
+func (c *Controller) GetChannelRules(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var rules []models.ChannelRule
+	if result := c.Db.WithContext(ctx.Request.Context()).Find(&rules, "app_id = ?", apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"channel_rules": rules,
+	})
+}
+
+func (c *Controller) CreateChannelRule(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var body channelRuleBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	rule := models.ChannelRule{ID: uuid.NewString(), AppID: apiKey.AppID}
+	if message := body.apply(&rule); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	var existing int64
+	if result := c.Db.WithContext(ctx.Request.Context()).Model(&models.ChannelRule{}).Where("app_id = ? AND pattern = ?", apiKey.AppID, rule.Pattern).Count(&existing); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if existing > 0 {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message": "a rule with this pattern already exists",
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Create(&rule); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Rules.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusCreated, rule)
+}
+
+func (c *Controller) UpdateChannelRule(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var rule models.ChannelRule
+	if result := c.Db.WithContext(ctx.Request.Context()).First(&rule, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "channel rule not found",
+		})
+		return
+	}
+
+	var body channelRuleBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	if message := body.apply(&rule); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Save(&rule); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Rules.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusOK, rule)
+}
+
+func (c *Controller) DeleteChannelRule(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	result := c.Db.WithContext(ctx.Request.Context()).Delete(&models.ChannelRule{}, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID)
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "channel rule not found",
+		})
+		return
+	}
+
+	c.Rules.Invalidate(apiKey.AppID)
+	ctx.Status(http.StatusNoContent)
+}
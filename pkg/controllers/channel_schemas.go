@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/google/uuid"
+)
+
+type channelSchemaBody struct {
+	Pattern string          `json:"pattern"`
+	Event   string          `json:"event"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// apply validates the body and copies it into the channel schema, returning a message describing the problem if it's
+// invalid.
+func (b *channelSchemaBody) apply(channelSchema *models.ChannelSchema) string {
+	if !common.ValidateChannelPattern(b.Pattern) {
+		return "invalid pattern, must be a channel name optionally followed by *"
+	}
+
+	if b.Event != "" && !common.ValidateString(b.Event) {
+		return "invalid event"
+	}
+
+	if len(b.Schema) == 0 {
+		return "missing schema"
+	}
+
+	if _, err := schemas.Compile(string(b.Schema)); err != nil {
+		return "invalid schema: " + err.Error()
+	}
+
+	channelSchema.Pattern = b.Pattern
+	channelSchema.Event = b.Event
+	channelSchema.Schema = string(b.Schema)
+	return ""
+}
+
+func (c *Controller) GetChannelSchemas(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var channelSchemas []models.ChannelSchema
+	if result := c.Db.WithContext(ctx.Request.Context()).Find(&channelSchemas, "app_id = ?", apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"channel_schemas": channelSchemas,
+	})
+}
+
+func (c *Controller) CreateChannelSchema(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var body channelSchemaBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	channelSchema := models.ChannelSchema{ID: uuid.NewString(), AppID: apiKey.AppID}
+	if message := body.apply(&channelSchema); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	var existing int64
+	if result := c.Db.WithContext(ctx.Request.Context()).Model(&models.ChannelSchema{}).Where("app_id = ? AND pattern = ? AND event = ?", apiKey.AppID, channelSchema.Pattern, channelSchema.Event).Count(&existing); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if existing > 0 {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message": "a schema with this pattern and event already exists",
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Create(&channelSchema); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Schemas.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusCreated, channelSchema)
+}
+
+func (c *Controller) UpdateChannelSchema(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var channelSchema models.ChannelSchema
+	if result := c.Db.WithContext(ctx.Request.Context()).First(&channelSchema, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "channel schema not found",
+		})
+		return
+	}
+
+	var body channelSchemaBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	if message := body.apply(&channelSchema); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Save(&channelSchema); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Schemas.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusOK, channelSchema)
+}
+
+func (c *Controller) DeleteChannelSchema(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	result := c.Db.WithContext(ctx.Request.Context()).Delete(&models.ChannelSchema{}, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID)
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "channel schema not found",
+		})
+		return
+	}
+
+	c.Schemas.Invalidate(apiKey.AppID)
+	ctx.Status(http.StatusNoContent)
+}
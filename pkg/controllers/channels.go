@@ -1,138 +1,189 @@
 package controllers
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gmencz/mycelium/pkg/common"
-	"github.com/gmencz/mycelium/pkg/models"
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/websocket"
 )
 
 func (c *Controller) GetChannels(ctx *gin.Context) {
-	key := ctx.Query("key")
+	apiKey, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
 
-	var apiKey models.ApiKey
+	filterByPrefix := ctx.Request.URL.Query().Get("filter_by_prefix")
+	cursor := 0
 
-	if key != "" {
-		// Key format: <api-key-id:api-key-secret>. This authentication method should only be used in trusted environments like in
-		// server side.
-		keyParts := strings.Split(key, ":")
-		if len(keyParts) != 2 {
+	if ctx.Request.URL.Query().Has("cursor") {
+		cursorInt, cursorErr := strconv.Atoi(ctx.Request.URL.Query().Get("cursor"))
+		if cursorErr != nil {
 			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": "invalid key",
+				"message": "invalid cursor, must be a number",
 			})
 			return
 		}
 
-		apiKeyID := keyParts[0]
-		apiKeySecret := keyParts[1]
+		cursor = cursorInt
+	}
 
-		if result := c.Db.First(&apiKey, "id = ?", apiKeyID); result.Error != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": "invalid key",
-			})
-			return
-		}
+	channels, resultCursor, err := c.Channels.Channels(ctx.Request.Context(), apiKey.AppID, filterByPrefix, uint64(cursor))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
 
-		if apiKey.Secret != apiKeySecret {
-			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": "invalid key",
-			})
-			return
-		}
-	} else if ctx.Request.Header.Get("authorization") != "" {
-		auth, authErr := common.ParseAuthorizationHeader(ctx.Request.Header.Get("authorization"))
-		if authErr != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": authErr.Error(),
-			})
-			return
-		}
+	if resultCursor != 0 {
+		ctx.JSON(http.StatusOK, gin.H{
+			"channels": channels,
+			"cursor":   resultCursor,
+		})
 
-		_, jwtErr := jwt.Parse(auth, func(token *jwt.Token) (interface{}, error) {
-			// Don't forget to validate the alg is what you expect:
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("invalid token, unexpected signing method")
-			}
+		return
+	}
 
-			kid := token.Header["kid"]
-			if kid == nil {
-				return nil, errors.New("invalid token, missing kid header")
-			}
+	ctx.JSON(http.StatusOK, gin.H{
+		"channels": channels,
+	})
+}
 
-			if result := c.Db.First(&apiKey, "id = ?", kid); result.Error != nil {
-				return nil, errors.New("invalid token kid header")
-			}
+// GetChannel returns the occupancy of a channel.
+func (c *Controller) GetChannel(ctx *gin.Context) {
+	apiKey, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
 
-			return []byte(apiKey.Secret), nil
+	channel := ctx.Param("channel")
+	if !common.ValidateString(channel) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid channel",
 		})
+		return
+	}
 
-		if jwtErr != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": jwtErr.Error(),
-			})
-			return
-		}
-	} else {
-		ctx.JSON(http.StatusUnauthorized, gin.H{
-			"message": "unauthorized",
+	occupancy, err := c.Channels.Occupancy(ctx.Request.Context(), apiKey.AppID+":"+channel)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
 		})
 		return
 	}
 
-	filterByPrefix := ctx.Request.URL.Query().Get("filter_by_prefix")
-	cursor := 0
+	ctx.JSON(http.StatusOK, gin.H{
+		"channel":   channel,
+		"occupancy": occupancy,
+	})
+}
 
-	if ctx.Request.URL.Query().Has("cursor") {
-		cursorInt, cursorErr := strconv.Atoi(ctx.Request.URL.Query().Get("cursor"))
-		if cursorErr != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{
-				"message": "invalid cursor, must be a number",
-			})
-			return
-		}
+type publishBody struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
 
-		cursor = cursorInt
+// Publish publishes a message on a channel, the rule of the channel and its schemas are enforced the same way as for
+// messages published by WebSocket clients. Requests authenticated with a key come from the server side, so
+// client_publish only applies to the ones authenticated with a token.
+func (c *Controller) Publish(ctx *gin.Context) {
+	fromClient := ctx.Query("key") == ""
+	apiKey, ok := c.authenticate(ctx)
+	if !ok {
+		return
 	}
 
-	var match string
-	if filterByPrefix != "" {
-		match = "subscribers:" + apiKey.AppID + ":" + filterByPrefix + "*"
-	} else {
-		match = "subscribers:" + apiKey.AppID + ":*"
+	channel := ctx.Param("channel")
+	if !common.ValidateString(channel) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid channel",
+		})
+		return
 	}
 
-	scanCmd := c.Rdb.Scan(ctx, uint64(cursor), match, 100)
-	if scanCmd.Err() != nil {
+	var capabilities map[string]string
+	if err := json.Unmarshal([]byte(apiKey.Capabilities), &capabilities); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid key capabilities",
+		})
+		return
+	}
+
+	if !websocket.HasCapability(protocol.MessageTypePublish, channel, capabilities) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": fmt.Sprintf("you're not allowed to publish messages on the channel %s", channel),
+		})
+		return
+	}
+
+	var body publishBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	rule, ruleErr := c.Rules.ForChannel(ctx.Request.Context(), apiKey.AppID, channel)
+	if ruleErr != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": "internal server error",
 		})
 		return
 	}
 
-	channelsResult, resultCursor, _ := scanCmd.Result()
+	if fromClient && rule != nil && !rule.ClientPublish {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": fmt.Sprintf("clients can't publish messages on the channel %s", channel),
+		})
+		return
+	}
 
-	uniqueChannels := common.RemoveDuplicateStrings(channelsResult)
+	message := &protocol.PublishMessageData{Channel: channel, Event: body.Event, Data: body.Data}
+	reason, checkErr := websocket.CheckPublish(ctx.Request.Context(), rule, c.Schemas, apiKey.AppID, message)
+	if checkErr != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
 
-	channels := common.Map(uniqueChannels, func(channel string) string {
-		channelParts := strings.Split(channel, "subscribers:"+apiKey.AppID+":")
-		return channelParts[1]
-	})
+	if reason != "" {
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{
+			"message": reason,
+		})
+		return
+	}
 
-	if resultCursor != 0 {
-		ctx.JSON(http.StatusOK, gin.H{
-			"channels": channels,
-			"cursor":   resultCursor,
+	allowed, allowErr := websocket.AllowPublish(ctx.Request.Context(), c.Channels, c.PublishLimits, apiKey.AppID, apiKey.AppID+":"+channel)
+	if allowErr != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
 		})
+		return
+	}
 
+	if !allowed {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"message": "too many messages published on the channel or by the app",
+		})
+		return
+	}
+
+	if publishErr := websocket.Publish(ctx.Request.Context(), c.Channels, c.Broker, rule, apiKey.AppID, message, ""); publishErr != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error publishing message",
+		})
 		return
 	}
 
 	ctx.JSON(http.StatusOK, gin.H{
-		"channels": channels,
+		"ok": true,
 	})
 }
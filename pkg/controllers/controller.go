@@ -1,11 +1,36 @@
 package controllers
 
 import (
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/integrations"
+	"github.com/gmencz/mycelium/pkg/middlewares"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/webhooks"
+	"github.com/gmencz/mycelium/pkg/websocket"
 	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
 )
 
 type Controller struct {
-	Rdb *redis.Client
-	Db  *gorm.DB
+	Rdb          *redis.Client
+	Channels     store.ChannelStore
+	Db           *gorm.DB
+	Broker       broker.Broker
+	Rules        *rules.Store
+	Schemas      *schemas.Store
+	Webhooks     *webhooks.Dispatcher
+	Integrations *integrations.Forwarder
+	Origins      *origins.Store
+
+	// Limits of the messages published on every channel and by every app.
+	PublishLimits websocket.PublishLimits
+
+	// Budget of the requests failing authentication per IP, they aren't limited when it's nil.
+	FailedAuth *middlewares.RateLimiter
+
+	// NATS endpoint checked by Health, it's skipped when empty.
+	NatsHealthcheckEndpoint string
 }
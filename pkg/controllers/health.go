@@ -2,15 +2,10 @@ package controllers
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/gin-gonic/gin"
 )
 
-var (
-	NatsHealthcheckEndpoint = os.Getenv("NATS_HEALTHCHECK_ENDPOINT")
-)
-
 func (c *Controller) Health(ctx *gin.Context) {
 	var host string
 	xForwardedHostHeader := ctx.Request.Header.Get("X-Forwarded-Host")
@@ -20,8 +15,13 @@ func (c *Controller) Health(ctx *gin.Context) {
 		host = ctx.Request.Header.Get("Host")
 	}
 
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+
 	// If we can make a HEAD request to ourselves, then we're good in terms of HTTP requests.
-	if _, err := http.Head("http://" + host + "/health/live"); err != nil {
+	if err := request(ctx, http.MethodHead, scheme+"://"+host+"/health/live"); err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": "HEAD request to self failed",
 		})
@@ -29,23 +29,31 @@ func (c *Controller) Health(ctx *gin.Context) {
 	}
 
 	// If we can make a simple database query, then our database is fine.
-	if tx := c.Db.Exec("SELECT 1"); tx.Error != nil {
+	if tx := c.Db.WithContext(ctx.Request.Context()).Exec("SELECT 1"); tx.Error != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": "database query failed",
 		})
 		return
 	}
 
-	// If we can send a redis PING and there's no error, redis is fine.
-	if r := c.Rdb.Ping(ctx); r.Err() != nil {
+	// If we can ping the channel store and there's no error, it's fine.
+	if err := c.Channels.Ping(ctx.Request.Context()); err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": "redis PING failed",
+			"message": "channel store ping failed",
+		})
+		return
+	}
+
+	// If we can make a request to the NATS healthcheck endpoint, nats is good. There's no endpoint when NATS is
+	// embedded or not used.
+	if c.NatsHealthcheckEndpoint == "" {
+		ctx.JSON(http.StatusOK, gin.H{
+			"ok": true,
 		})
 		return
 	}
 
-	// If we can make a request to the NATS healthcheck endpoint, nats is good.
-	if _, err := http.Get(NatsHealthcheckEndpoint); err != nil {
+	if err := request(ctx, http.MethodGet, c.NatsHealthcheckEndpoint); err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": "NATS request failed",
 		})
@@ -62,3 +70,18 @@ func (c *Controller) HealthLive(ctx *gin.Context) {
 		"ok": true,
 	})
 }
+
+// request sends a request bound to the context of the request being handled.
+func request(ctx *gin.Context, method string, url string) error {
+	request, err := http.NewRequestWithContext(ctx.Request.Context(), method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/integrations"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/google/uuid"
+)
+
+type integrationBody struct {
+	Kind    string   `json:"kind"`
+	Target  string   `json:"target"`
+	Secret  string   `json:"secret"`
+	Pattern string   `json:"pattern"`
+	Events  []string `json:"events"`
+}
+
+// apply validates the body and copies it into the integration, returning a message describing the problem if it's
+// invalid.
+func (b *integrationBody) apply(ctx context.Context, integration *models.Integration) string {
+	if err := integrations.ValidateTarget(ctx, b.Kind, b.Target); err != nil {
+		return err.Error()
+	}
+
+	if b.Pattern == "" {
+		b.Pattern = "*"
+	}
+
+	if !common.ValidateChannelPattern(b.Pattern) {
+		return "invalid pattern, must be a channel name optionally followed by *"
+	}
+
+	for _, event := range b.Events {
+		if !common.ValidateString(event) {
+			return "invalid event " + event
+		}
+	}
+
+	integration.Kind = b.Kind
+	integration.Target = b.Target
+	integration.Secret = b.Secret
+	integration.Pattern = b.Pattern
+	integration.Events = strings.Join(common.RemoveDuplicateStrings(b.Events), ",")
+	return ""
+}
+
+func (c *Controller) GetIntegrations(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var appIntegrations []models.Integration
+	if result := c.Db.WithContext(ctx.Request.Context()).Find(&appIntegrations, "app_id = ?", apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"integrations": appIntegrations,
+	})
+}
+
+func (c *Controller) CreateIntegration(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var body integrationBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	integration := models.Integration{ID: uuid.NewString(), AppID: apiKey.AppID}
+	if message := body.apply(ctx.Request.Context(), &integration); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Create(&integration); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Integrations.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusCreated, integration)
+}
+
+func (c *Controller) UpdateIntegration(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var integration models.Integration
+	if result := c.Db.WithContext(ctx.Request.Context()).First(&integration, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "integration not found",
+		})
+		return
+	}
+
+	var body integrationBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	if message := body.apply(ctx.Request.Context(), &integration); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Save(&integration); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Integrations.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusOK, integration)
+}
+
+func (c *Controller) DeleteIntegration(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	result := c.Db.WithContext(ctx.Request.Context()).Delete(&models.Integration{}, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID)
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "integration not found",
+		})
+		return
+	}
+
+	c.Integrations.Invalidate(apiKey.AppID)
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"gorm.io/gorm"
+)
+
+// CreatePollSession starts a long-polling session for clients that can use neither websockets nor SSE and replies
+// with its ID. It's authenticated like /realtime, the messages of the session are then polled with its ID.
+func (c *Controller) CreatePollSession(ctx *gin.Context, db *gorm.DB, cs store.ChannelStore, b broker.Broker, hub *websocket.Hub) {
+	release, closeMessage := hub.Admit(ctx.ClientIP())
+	if closeMessage != nil {
+		status, reason := websocket.HTTPError(closeMessage)
+		ctx.JSON(status, gin.H{
+			"message": reason,
+		})
+		return
+	}
+
+	client, closeMessage := websocket.NewPollClient(ctx.Request, db, c.Rules, c.Schemas, c.Origins, hub)
+	if closeMessage != nil {
+		release()
+		status, reason := websocket.HTTPError(closeMessage)
+		ctx.JSON(status, gin.H{
+			"message": reason,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"id": client.StartPolling(cs, b, release),
+	})
+}
+
+// Poll replies with the messages sent to the client of the session since its last poll, waiting for some if there
+// are none.
+func (c *Controller) Poll(ctx *gin.Context, hub *websocket.Hub) {
+	client := pollClient(ctx, hub)
+	if client == nil {
+		return
+	}
+
+	messages, ok := client.Poll(ctx.Request.Context())
+	if !ok {
+		pollSessionNotFound(ctx)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, messages)
+}
+
+// SendPollMessages handles the messages in the body, an array of messages like the ones sent over /realtime, as
+// sent by the client of the session. Their replies are polled.
+func (c *Controller) SendPollMessages(ctx *gin.Context, hub *websocket.Hub) {
+	client := pollClient(ctx, hub)
+	if client == nil {
+		return
+	}
+
+	// A request can't be bigger than a message over /realtime.
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, hub.Options.MaxMessageSize)
+
+	var messages []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&messages); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "the body must be an array of messages",
+		})
+		return
+	}
+
+	if !client.Deliver(ctx.Request.Context(), messages) {
+		pollSessionNotFound(ctx)
+		return
+	}
+
+	ctx.Status(http.StatusAccepted)
+}
+
+// DeletePollSession ends the session, the messages that weren't polled are discarded.
+func (c *Controller) DeletePollSession(ctx *gin.Context, hub *websocket.Hub) {
+	client := pollClient(ctx, hub)
+	if client == nil {
+		return
+	}
+
+	client.EndPolling(ctx.Param("id"))
+	ctx.Status(http.StatusNoContent)
+}
+
+// pollClient returns the long-polling client of the session in the path. If there's no such session it responds with
+// 404, unless the session was started by another instance of the server, in which case Fly is asked to replay the
+// request on it. It returns nil when it responds.
+func pollClient(ctx *gin.Context, hub *websocket.Hub) *websocket.Client {
+	id := ctx.Param("id")
+	if client := hub.PollClient(id); client != nil {
+		return client
+	}
+
+	if instance := websocket.PollSessionInstance(id); instance != "" && instance != hub.Options.Instance {
+		ctx.Header("Fly-Replay", "instance="+instance)
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message": "poll session of another instance",
+		})
+		return nil
+	}
+
+	pollSessionNotFound(ctx)
+	return nil
+}
+
+func pollSessionNotFound(ctx *gin.Context) {
+	ctx.JSON(http.StatusNotFound, gin.H{
+		"message": "poll session not found",
+	})
+}
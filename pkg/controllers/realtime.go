@@ -1,41 +1,39 @@
 package controllers
 
 import (
-	"net/http"
-
 	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/store"
 	"github.com/gmencz/mycelium/pkg/websocket"
-	"github.com/go-redis/redis/v8"
-	wsLib "github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-var upgrader = wsLib.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(*http.Request) bool {
-		// Allow all origins.
-		return true
-	},
-}
-
-func (c *Controller) Realtime(ctx *gin.Context, db *gorm.DB, rdb *redis.Client, nc *nats.EncodedConn, hub *websocket.Hub) {
-	ws, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+func (c *Controller) Realtime(ctx *gin.Context, db *gorm.DB, cs store.ChannelStore, b broker.Broker, hub *websocket.Hub) {
+	ws, err := websocket.Upgrade(ctx.Writer, ctx.Request, &hub.Options)
 	if err != nil {
 		logrus.Println(err)
 		return
 	}
 
-	client, closeMessage := websocket.NewClient(ctx.Request, ws, db, hub)
+	release, closeMessage := hub.Admit(ctx.ClientIP())
+	if closeMessage != nil {
+		websocket.CloseWithMessage(ws, closeMessage, &hub.Options)
+		return
+	}
+
+	defer release()
+
+	client, closeMessage := websocket.NewClient(ctx.Request, ws, db, c.Rules, c.Schemas, c.Origins, hub)
 	if closeMessage != nil {
-		websocket.CloseWithMessage(ws, closeMessage)
+		websocket.CloseWithMessage(ws, closeMessage, &hub.Options)
 		return
 	}
 
-	client.StartSession(rdb)
+	if !client.StartSession(cs) {
+		return
+	}
 
-	go client.Ping()
-	client.ReadMessages(rdb, nc)
+	go client.Keepalive()
+	client.ReadMessages(cs, b)
 }
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"gorm.io/gorm"
+)
+
+// SSE streams the messages published on the channels (query param "channels") and the situation changes of the
+// channels with the prefixes (query param "situations") as Server-Sent Events, for clients that can't use
+// websockets. It's authenticated like /realtime.
+func (c *Controller) SSE(ctx *gin.Context, db *gorm.DB, cs store.ChannelStore, b broker.Broker, hub *websocket.Hub) {
+	release, closeMessage := hub.Admit(ctx.ClientIP())
+	if closeMessage != nil {
+		status, reason := websocket.HTTPError(closeMessage)
+		ctx.JSON(status, gin.H{
+			"message": reason,
+		})
+		return
+	}
+
+	defer release()
+
+	client, closeMessage := websocket.NewSSEClient(ctx.Request, ctx.Writer, db, c.Rules, c.Schemas, c.Origins, hub)
+	if closeMessage != nil {
+		status, reason := websocket.HTTPError(closeMessage)
+		ctx.JSON(status, gin.H{
+			"message": reason,
+		})
+		return
+	}
+
+	client.Stream(cs, b, splitList(ctx.Query("channels")), splitList(ctx.Query("situations")))
+}
+
+// splitList splits a comma separated list, an empty list has no elements.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+
+	return strings.Split(list, ",")
+}
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/webhooks"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+)
+
+type webhookBody struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Pattern string   `json:"pattern"`
+}
+
+// apply validates the body and copies it into the webhook, returning a message describing the problem if it's invalid.
+// The URL has to point to a public address so webhooks can't reach the network of the server.
+func (b *webhookBody) apply(ctx context.Context, webhook *models.Webhook) string {
+	if err := webhooks.ValidateURL(ctx, b.URL); err != nil {
+		return err.Error()
+	}
+
+	if len(b.Events) == 0 {
+		return "missing events"
+	}
+
+	for _, event := range b.Events {
+		if !slices.Contains(webhooks.Events, event) {
+			return "invalid event " + event + ", must be one of " + strings.Join(webhooks.Events, ", ")
+		}
+	}
+
+	if b.Pattern == "" {
+		b.Pattern = "*"
+	}
+
+	if !common.ValidateChannelPattern(b.Pattern) {
+		return "invalid pattern, must be a channel name optionally followed by *"
+	}
+
+	webhook.URL = b.URL
+	webhook.Events = strings.Join(common.RemoveDuplicateStrings(b.Events), ",")
+	webhook.Pattern = b.Pattern
+	return ""
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+func (c *Controller) GetWebhooks(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var appWebhooks []models.Webhook
+	if result := c.Db.WithContext(ctx.Request.Context()).Find(&appWebhooks, "app_id = ?", apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"webhooks": appWebhooks,
+	})
+}
+
+func (c *Controller) CreateWebhook(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var body webhookBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	secret, secretErr := newWebhookSecret()
+	if secretErr != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	webhook := models.Webhook{ID: uuid.NewString(), AppID: apiKey.AppID, Secret: secret}
+	if message := body.apply(ctx.Request.Context(), &webhook); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Create(&webhook); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Webhooks.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusCreated, webhook)
+}
+
+func (c *Controller) UpdateWebhook(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	var webhook models.Webhook
+	if result := c.Db.WithContext(ctx.Request.Context()).First(&webhook, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID); result.Error != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "webhook not found",
+		})
+		return
+	}
+
+	var body webhookBody
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid body",
+		})
+		return
+	}
+
+	if message := body.apply(ctx.Request.Context(), &webhook); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": message,
+		})
+		return
+	}
+
+	if result := c.Db.WithContext(ctx.Request.Context()).Save(&webhook); result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	c.Webhooks.Invalidate(apiKey.AppID)
+	ctx.JSON(http.StatusOK, webhook)
+}
+
+func (c *Controller) DeleteWebhook(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	result := c.Db.WithContext(ctx.Request.Context()).Delete(&models.Webhook{}, "id = ? AND app_id = ?", ctx.Param("id"), apiKey.AppID)
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "webhook not found",
+		})
+		return
+	}
+
+	c.Webhooks.Invalidate(apiKey.AppID)
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeadLetters returns the most recent deliveries that failed every attempt, newest first.
+func (c *Controller) GetWebhookDeadLetters(ctx *gin.Context) {
+	apiKey, ok := c.authenticateAdmin(ctx)
+	if !ok {
+		return
+	}
+
+	// Without redis (single server) dead letters aren't kept.
+	if c.Rdb == nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"dead_letters": []webhooks.DeadLetter{},
+		})
+		return
+	}
+
+	entries, err := c.Rdb.LRange(ctx.Request.Context(), webhooks.DeadLettersKey(apiKey.AppID), 0, 99).Result()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "internal server error",
+		})
+		return
+	}
+
+	deadLetters := make([]webhooks.DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		var deadLetter webhooks.DeadLetter
+		if err := json.Unmarshal([]byte(entry), &deadLetter); err == nil {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"dead_letters": deadLetters,
+	})
+}
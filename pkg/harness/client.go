@@ -0,0 +1,259 @@
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// How long Expect waits for a message.
+const expectTimeout = 5 * time.Second
+
+// Message received by a Client, either a protocol.Message or a protocol.ErrorMessage.
+type Message struct {
+	Type           string          `json:"t"`
+	Data           json.RawMessage `json:"d"`
+	SequenceNumber int64           `json:"s"`
+	Reason         string          `json:"r"`
+	Code           string          `json:"c"`
+
+	t testing.TB
+}
+
+// Decode decodes the data of the message into v.
+func (m *Message) Decode(v interface{}) {
+	m.t.Helper()
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		m.t.Fatalf("failed to decode data of message %s: %s", m.Type, err)
+	}
+}
+
+// Client is a WebSocket client of a Harness.
+type Client struct {
+	t  testing.TB
+	ws *websocket.Conn
+
+	// Session ID received in the hello message.
+	SessionID string
+
+	// Messages read from the connection, closed with the error that ended it.
+	messages chan *Message
+	err      error
+
+	sequenceNumber int64
+}
+
+func newClient(t testing.TB, ws *websocket.Conn) *Client {
+	c := &Client{t: t, ws: ws, messages: make(chan *Message, 256)}
+	t.Cleanup(func() { ws.Close() })
+
+	// Reading in the background lets Expect time out without breaking the connection.
+	go func() {
+		defer close(c.messages)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+
+			message := &Message{t: t}
+			if err := json.Unmarshal(data, message); err == nil {
+				c.messages <- message
+			}
+		}
+	}()
+
+	return c
+}
+
+// Send sends a message of the type with the data.
+func (c *Client) Send(messageType string, data interface{}) {
+	c.t.Helper()
+	if err := c.ws.WriteJSON(&protocol.Message{Type: messageType, Data: data}); err != nil {
+		c.t.Fatalf("failed to send message %s: %s", messageType, err)
+	}
+}
+
+// Expect waits for the next message and fails the test unless it's of the type.
+func (c *Client) Expect(messageType string) *Message {
+	c.t.Helper()
+
+	select {
+	case message, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("expected message %s, but the connection closed: %v", messageType, c.err)
+		}
+
+		if message.Type != messageType {
+			c.t.Fatalf("expected message %s, but got %s (%s%s)", messageType, message.Type, message.Data, message.Reason)
+		}
+
+		return message
+
+	case <-time.After(expectTimeout):
+		c.t.Fatalf("expected message %s, but got nothing", messageType)
+	}
+
+	return nil
+}
+
+// ExpectAll waits for the next messages and fails the test unless they're of the types, in any order.
+func (c *Client) ExpectAll(messageTypes ...string) map[string]*Message {
+	c.t.Helper()
+
+	received := make(map[string]*Message)
+	for range messageTypes {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("expected messages %v, but the connection closed: %v", messageTypes, c.err)
+			}
+
+			received[message.Type] = message
+
+		case <-time.After(expectTimeout):
+			c.t.Fatalf("expected messages %v, but got nothing", messageTypes)
+		}
+	}
+
+	for _, messageType := range messageTypes {
+		if received[messageType] == nil {
+			c.t.Fatalf("expected messages %v, but got %v", messageTypes, received)
+		}
+	}
+
+	return received
+}
+
+// ExpectNothing fails the test if a message arrives within d.
+func (c *Client) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+
+	select {
+	case message, ok := <-c.messages:
+		if ok {
+			c.t.Fatalf("expected no messages, but got %s (%s%s)", message.Type, message.Data, message.Reason)
+		}
+
+	case <-time.After(d):
+	}
+}
+
+// ExpectClose waits for the connection to be closed with the code, skipping any message sent before.
+func (c *Client) ExpectClose(code int) {
+	c.t.Helper()
+
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if ok {
+				continue
+			}
+
+			var closeErr *websocket.CloseError
+			if !errors.As(c.err, &closeErr) {
+				c.t.Fatalf("expected close code %d, but the connection ended with %v", code, c.err)
+			}
+
+			if closeErr.Code != code {
+				c.t.Fatalf("expected close code %d, but got %d (%s)", code, closeErr.Code, closeErr.Text)
+			}
+
+			return
+
+		case <-timeout:
+			c.t.Fatalf("expected close code %d, but the connection is still open", code)
+		}
+	}
+}
+
+func (c *Client) nextSequenceNumber() int64 {
+	c.sequenceNumber++
+	return c.sequenceNumber
+}
+
+// Subscribe subscribes to the channel and waits for the confirmation.
+func (c *Client) Subscribe(channel string) {
+	c.t.Helper()
+	c.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: c.nextSequenceNumber(), Channel: channel})
+	c.Expect(protocol.MessageTypeSubscribeSuccess)
+}
+
+// SubscribeDelta subscribes to the channel receiving its messages as deltas and waits for the confirmation.
+func (c *Client) SubscribeDelta(channel string) {
+	c.t.Helper()
+	c.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: c.nextSequenceNumber(), Channel: channel, Delta: true})
+	c.Expect(protocol.MessageTypeSubscribeSuccess)
+}
+
+// Unsubscribe unsubscribes from the channel and waits for the confirmation.
+func (c *Client) Unsubscribe(channel string) {
+	c.t.Helper()
+	c.Send(protocol.MessageTypeUnsubscribe, &protocol.UnsubscribeMessageData{SequenceNumber: c.nextSequenceNumber(), Channel: channel})
+	c.Expect(protocol.MessageTypeUnsubscribeSuccess)
+}
+
+// Publish publishes the event on the channel and waits for the confirmation, includePublisher can be nil to use the
+// rule of the channel. If the publisher gets its own message use SendPublish, it can arrive before the confirmation.
+func (c *Client) Publish(channel string, event string, data interface{}, includePublisher *bool) {
+	c.t.Helper()
+	c.SendPublish(channel, event, data, includePublisher)
+	c.Expect(protocol.MessageTypePublishSuccess)
+}
+
+// SendPublish publishes the event on the channel without waiting for the confirmation.
+func (c *Client) SendPublish(channel string, event string, data interface{}, includePublisher *bool) {
+	c.t.Helper()
+	c.Send(protocol.MessageTypePublish, &protocol.PublishMessageDataData{
+		SequenceNumber:   c.nextSequenceNumber(),
+		IncludePublisher: includePublisher,
+		Channel:          channel,
+		Event:            event,
+		Data:             data,
+	})
+}
+
+// SituationListen listens to the situation of the channels with the prefix and waits for the confirmation.
+func (c *Client) SituationListen(channelPrefix string) {
+	c.t.Helper()
+	c.Send(protocol.MessageTypeSituationListen, &protocol.SituationListenMessageData{SequenceNumber: c.nextSequenceNumber(), ChannelPrefix: channelPrefix})
+	c.Expect(protocol.MessageTypeSituationListenSuccess)
+}
+
+// Close closes the connection.
+func (c *Client) Close() {
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.ws.Close()
+}
+
+func newRequest(method string, url string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return request, nil
+}
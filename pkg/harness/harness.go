@@ -0,0 +1,232 @@
+// Package harness runs a Mycelium server in-process for end-to-end tests, with an in-memory channel store and broker
+// and a SQLite database seeded with an app, and provides a WebSocket client to talk to it.
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/config"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/server"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The servers of earlier tests may still be reading the mode.
+var setGinMode sync.Once
+
+// Harness is a server running in-process.
+type Harness struct {
+	t testing.TB
+
+	// Base URL of the server, e.g. http://127.0.0.1:1234.
+	URL string
+
+	// Address of the MQTT listener of the server, e.g. 127.0.0.1:1235.
+	MQTTAddr string
+
+	// ID of the app seeded in the database.
+	AppID string
+
+	Server   *server.Server
+	DB       *gorm.DB
+	Channels *store.MemoryStore
+	Broker   *broker.MemoryBroker
+
+	listener net.Listener
+	closed   bool
+}
+
+// Start starts a server on a random local port with the default config, it's closed when the test finishes.
+func Start(t testing.TB) *Harness {
+	t.Helper()
+	return StartWithConfig(t, Config())
+}
+
+// Config returns the default config of a harness, the ports and the backends in it are ignored.
+func Config() *config.Config {
+	cfg := config.Default()
+	cfg.ChannelStore = "memory"
+	cfg.Broker = "memory"
+
+	// Clients of the tests don't take long to close the connection.
+	cfg.WebSocket.CloseGracePeriod.Duration = 100 * time.Millisecond
+
+	return cfg
+}
+
+// StartWithConfig is like Start with the config.
+func StartWithConfig(t testing.TB, cfg *config.Config) *Harness {
+	t.Helper()
+	setGinMode.Do(func() { gin.SetMode(gin.TestMode) })
+
+	// Every harness gets its own database, shared by the connections of the pool.
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.NewString())
+	database, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	// SQLite doesn't like concurrent writers.
+	sqlDB.SetMaxOpenConns(1)
+
+	err = database.AutoMigrate(&models.App{}, &models.ApiKey{}, &models.ChannelRule{}, &models.ChannelSchema{}, &models.Webhook{}, &models.Integration{}, &models.AllowedOrigin{})
+	if err != nil {
+		t.Fatalf("failed to migrate database: %s", err)
+	}
+
+	app := models.App{ID: uuid.NewString(), Name: "test"}
+	if result := database.Create(&app); result.Error != nil {
+		t.Fatalf("failed to seed app: %s", result.Error)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	mqttListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		listener.Close()
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	h := &Harness{
+		t:        t,
+		URL:      "http://" + listener.Addr().String(),
+		MQTTAddr: mqttListener.Addr().String(),
+		AppID:    app.ID,
+		DB:       database,
+		Channels: store.NewMemoryStore(),
+		Broker:   broker.NewMemoryBroker(),
+		listener: listener,
+	}
+
+	h.Server = server.NewServerWithDependencies(cfg, server.Dependencies{
+		DB:       database,
+		Channels: h.Channels,
+		Broker:   h.Broker,
+	})
+
+	go h.Server.Serve(listener)
+	go h.Server.ServeMQTT(mqttListener)
+	t.Cleanup(h.Close)
+
+	return h
+}
+
+// Close closes the server and its clients, it can be called more than once.
+func (h *Harness) Close() {
+	if h.closed {
+		return
+	}
+
+	h.closed = true
+	h.Server.Close()
+	h.listener.Close()
+}
+
+// CreateKey creates an API key of the app with the capabilities (channel -> comma separated capabilities, see
+// websocket.HasCapability) and returns it as "<id>:<secret>".
+func (h *Harness) CreateKey(capabilities map[string]string) string {
+	h.t.Helper()
+
+	capabilitiesJSON, err := json.Marshal(capabilities)
+	if err != nil {
+		h.t.Fatalf("failed to encode capabilities: %s", err)
+	}
+
+	key := models.ApiKey{ID: uuid.NewString(), Secret: uuid.NewString(), Capabilities: string(capabilitiesJSON), AppID: h.AppID}
+	if result := h.DB.Create(&key); result.Error != nil {
+		h.t.Fatalf("failed to create key: %s", result.Error)
+	}
+
+	return key.ID + ":" + key.Secret
+}
+
+// Dial connects to /realtime with the query and returns the connection without waiting for the hello message, it's
+// meant for testing authentication.
+func (h *Harness) Dial(query url.Values) (*Client, error) {
+	return h.DialWithHeader(query, nil)
+}
+
+// DialWithHeader is like Dial sending the header in the handshake, e.g. to connect from an origin.
+func (h *Harness) DialWithHeader(query url.Values, header http.Header) (*Client, error) {
+	return h.dial(websocket.DefaultDialer, query, header)
+}
+
+func (h *Harness) dial(dialer *websocket.Dialer, query url.Values, header http.Header) (*Client, error) {
+	u := "ws" + h.URL[len("http"):] + "/realtime?" + query.Encode()
+	ws, _, err := dialer.Dial(u, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(h.t, ws), nil
+}
+
+// Connect connects to /realtime with the key and waits for the hello message.
+func (h *Harness) Connect(key string) *Client {
+	return h.connect(websocket.DefaultDialer, key)
+}
+
+// ConnectCompressed is like Connect negotiating permessage-deflate compression.
+func (h *Harness) ConnectCompressed(key string) *Client {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	return h.connect(&dialer, key)
+}
+
+func (h *Harness) connect(dialer *websocket.Dialer, key string) *Client {
+	h.t.Helper()
+
+	c, err := h.dial(dialer, url.Values{"key": {key}}, nil)
+	if err != nil {
+		h.t.Fatalf("failed to connect: %s", err)
+	}
+
+	var hello struct {
+		SessionID string `json:"sid"`
+	}
+
+	c.Expect("hello").Decode(&hello)
+	c.SessionID = hello.SessionID
+
+	return c
+}
+
+// Request sends a request to the REST API authenticated with the key, encoding body as JSON if it's not nil.
+func (h *Harness) Request(method string, path string, key string, body interface{}) *http.Response {
+	h.t.Helper()
+
+	request, err := newRequest(method, h.URL+path+"?key="+url.QueryEscape(key), body)
+	if err != nil {
+		h.t.Fatalf("failed to create request: %s", err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		h.t.Fatalf("failed to send request: %s", err)
+	}
+
+	h.t.Cleanup(func() { response.Body.Close() })
+	return response
+}
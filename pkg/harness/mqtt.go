@@ -0,0 +1,202 @@
+package harness
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/mqtt"
+)
+
+// MQTTClient is an MQTT client of a Harness.
+type MQTTClient struct {
+	t       testing.TB
+	conn    net.Conn
+	version byte
+
+	// Packets read from the connection, closed with the error that ended it.
+	packets chan *mqtt.Packet
+	err     error
+
+	packetID uint16
+}
+
+// ConnectMQTT connects to the MQTT listener with the version of the protocol, authenticating with the key or the
+// token as the password, and returns the client with the reason code of the CONNACK.
+func (h *Harness) ConnectMQTT(version byte, password string) (*MQTTClient, byte) {
+	h.t.Helper()
+
+	conn, err := net.Dial("tcp", h.MQTTAddr)
+	if err != nil {
+		h.t.Fatalf("failed to connect to MQTT: %s", err)
+	}
+
+	c := &MQTTClient{t: h.t, conn: conn, version: version, packets: make(chan *mqtt.Packet, 256)}
+	h.t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		defer close(c.packets)
+		reader := bufio.NewReader(conn)
+		for {
+			p, err := mqtt.ReadPacket(reader, 1<<20)
+			if err != nil {
+				c.err = err
+				return
+			}
+
+			c.packets <- p
+		}
+	}()
+
+	connect := &mqtt.Connect{Version: version, CleanStart: true, KeepAlive: 60, ClientID: "harness", Password: password, HasPassword: true}
+	c.Send(connect.Encode())
+
+	code, _, err := mqtt.DecodeConnack(version, c.Expect(mqtt.TypeConnack))
+	if err != nil {
+		h.t.Fatalf("failed to decode CONNACK: %s", err)
+	}
+
+	return c, code
+}
+
+// Send sends the packet.
+func (c *MQTTClient) Send(p *mqtt.Packet) {
+	c.t.Helper()
+	if _, err := p.WriteTo(c.conn); err != nil {
+		c.t.Fatalf("failed to write packet %d: %s", p.Type, err)
+	}
+}
+
+func (c *MQTTClient) nextPacketID() uint16 {
+	c.packetID++
+	return c.packetID
+}
+
+// Expect waits for the next packet and fails the test unless it's of the type.
+func (c *MQTTClient) Expect(packetType byte) *mqtt.Packet {
+	c.t.Helper()
+
+	select {
+	case p, ok := <-c.packets:
+		if !ok {
+			c.t.Fatalf("expected packet %d, but the connection closed: %v", packetType, c.err)
+		}
+
+		if p.Type != packetType {
+			c.t.Fatalf("expected packet %d, but got %d (%v)", packetType, p.Type, p.Body)
+		}
+
+		return p
+
+	case <-time.After(expectTimeout):
+		c.t.Fatalf("expected packet %d, but got nothing", packetType)
+	}
+
+	return nil
+}
+
+// ExpectPublish waits for the next packet and fails the test unless it's a PUBLISH.
+func (c *MQTTClient) ExpectPublish() *mqtt.Publish {
+	c.t.Helper()
+
+	publish, err := mqtt.DecodePublish(c.version, c.Expect(mqtt.TypePublish))
+	if err != nil {
+		c.t.Fatalf("failed to decode PUBLISH: %s", err)
+	}
+
+	return publish
+}
+
+// ExpectNothing fails the test if a packet arrives within d.
+func (c *MQTTClient) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+
+	select {
+	case p, ok := <-c.packets:
+		if ok {
+			c.t.Fatalf("expected no packets, but got %d (%v)", p.Type, p.Body)
+		}
+
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed waits for the connection to be closed, skipping any packet sent before, and returns the reason code
+// of the DISCONNECT sent before closing it if any.
+func (c *MQTTClient) ExpectClosed() (code byte, disconnected bool) {
+	c.t.Helper()
+
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case p, ok := <-c.packets:
+			if !ok {
+				return code, disconnected
+			}
+
+			if p.Type == mqtt.TypeDisconnect && len(p.Body) > 0 {
+				code, disconnected = p.Body[0], true
+			}
+
+		case <-timeout:
+			c.t.Fatalf("expected the connection to close, but it's still open")
+		}
+	}
+}
+
+// Subscribe subscribes to the filters and returns the reason codes of the SUBACK.
+func (c *MQTTClient) Subscribe(filters ...string) []byte {
+	c.t.Helper()
+
+	subscribe := &mqtt.Subscribe{PacketID: c.nextPacketID()}
+	for _, filter := range filters {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, mqtt.Subscription{Filter: filter})
+	}
+
+	c.Send(subscribe.Encode(c.version))
+
+	packetID, codes, err := mqtt.DecodeSuback(c.version, c.Expect(mqtt.TypeSuback))
+	if err != nil || packetID != subscribe.PacketID {
+		c.t.Fatalf("expected SUBACK %d, but got %d (%v)", subscribe.PacketID, packetID, err)
+	}
+
+	return codes
+}
+
+// Unsubscribe unsubscribes from the filters and waits for the UNSUBACK.
+func (c *MQTTClient) Unsubscribe(filters ...string) {
+	c.t.Helper()
+
+	unsubscribe := &mqtt.Unsubscribe{PacketID: c.nextPacketID(), Filters: filters}
+	c.Send(unsubscribe.Encode(c.version))
+	c.Expect(mqtt.TypeUnsuback)
+}
+
+// Publish publishes the payload on the topic with QoS 1 and returns the reason code of the PUBACK.
+func (c *MQTTClient) Publish(topic string, payload []byte, properties mqtt.Properties) byte {
+	c.t.Helper()
+
+	publish := &mqtt.Publish{Topic: topic, QoS: 1, PacketID: c.nextPacketID(), Payload: payload, Properties: properties}
+	c.Send(publish.Encode(c.version))
+
+	packetID, code, err := mqtt.DecodeAck(c.version, c.Expect(mqtt.TypePuback))
+	if err != nil || packetID != publish.PacketID {
+		c.t.Fatalf("expected PUBACK %d, but got %d (%v)", publish.PacketID, packetID, err)
+	}
+
+	return code
+}
+
+// Ping sends a PINGREQ and waits for the PINGRESP.
+func (c *MQTTClient) Ping() {
+	c.t.Helper()
+	c.Send(&mqtt.Packet{Type: mqtt.TypePingreq})
+	c.Expect(mqtt.TypePingresp)
+}
+
+// Close disconnects from the server.
+func (c *MQTTClient) Close() {
+	c.Send(&mqtt.Packet{Type: mqtt.TypeDisconnect})
+	c.conn.Close()
+}
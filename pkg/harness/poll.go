@@ -0,0 +1,159 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/protocol"
+)
+
+// PollSession is a long-polling client of a Harness.
+type PollSession struct {
+	t   testing.TB
+	url string
+
+	// ID of the session, a secret of the client.
+	ID string
+
+	// Messages polled in the background, closed when the session is over.
+	messages chan *Message
+}
+
+// StartPolling starts a long-polling session authenticated with the key and polls it in the background until the
+// session is over or the test finishes.
+func (h *Harness) StartPolling(key string) *PollSession {
+	h.t.Helper()
+
+	response, err := http.Post(h.URL+"/poll?key="+url.QueryEscape(key), "application/json", nil)
+	if err != nil {
+		h.t.Fatalf("failed to start polling: %s", err)
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		h.t.Fatalf("expected status code %d, but got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		h.t.Fatalf("failed to decode session: %s", err)
+	}
+
+	s := &PollSession{t: h.t, url: h.URL + "/poll/" + body.ID, ID: body.ID, messages: make(chan *Message, 256)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.t.Cleanup(cancel)
+
+	go func() {
+		defer close(s.messages)
+		for {
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+			if err != nil {
+				return
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				return
+			}
+
+			var messages []*Message
+			err = json.NewDecoder(response.Body).Decode(&messages)
+			response.Body.Close()
+			if err != nil || response.StatusCode != http.StatusOK {
+				return
+			}
+
+			for _, message := range messages {
+				message.t = h.t
+				s.messages <- message
+			}
+		}
+	}()
+
+	return s
+}
+
+// Send sends a message of the type with the data.
+func (s *PollSession) Send(messageType string, data interface{}) {
+	s.t.Helper()
+
+	request, err := newRequest(http.MethodPost, s.url, []*protocol.Message{{Type: messageType, Data: data}})
+	if err != nil {
+		s.t.Fatalf("failed to create request: %s", err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		s.t.Fatalf("failed to send message %s: %s", messageType, err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		s.t.Fatalf("expected status code %d, but got %d", http.StatusAccepted, response.StatusCode)
+	}
+}
+
+// Expect waits for the next message and fails the test unless it's of the type.
+func (s *PollSession) Expect(messageType string) *Message {
+	s.t.Helper()
+
+	select {
+	case message, ok := <-s.messages:
+		if !ok {
+			s.t.Fatalf("expected message %s, but the session is over", messageType)
+		}
+
+		if message.Type != messageType {
+			s.t.Fatalf("expected message %s, but got %s (%s%s)", messageType, message.Type, message.Data, message.Reason)
+		}
+
+		return message
+
+	case <-time.After(expectTimeout):
+		s.t.Fatalf("expected message %s, but got nothing", messageType)
+	}
+
+	return nil
+}
+
+// ExpectEnd waits for the session to be over.
+func (s *PollSession) ExpectEnd() {
+	s.t.Helper()
+
+	for {
+		select {
+		case _, ok := <-s.messages:
+			if !ok {
+				return
+			}
+
+		case <-time.After(expectTimeout):
+			s.t.Fatalf("expected the session to be over")
+		}
+	}
+}
+
+// Close ends the session.
+func (s *PollSession) Close() {
+	s.t.Helper()
+
+	request, err := http.NewRequest(http.MethodDelete, s.url, nil)
+	if err != nil {
+		s.t.Fatalf("failed to create request: %s", err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		s.t.Fatalf("failed to end session: %s", err)
+	}
+
+	response.Body.Close()
+}
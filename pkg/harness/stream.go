@@ -0,0 +1,123 @@
+package harness
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Event received by a Stream.
+type Event struct {
+	Name string
+	Data string
+
+	t testing.TB
+}
+
+// Decode decodes the data of the event into v.
+func (e *Event) Decode(v interface{}) {
+	e.t.Helper()
+	if err := json.Unmarshal([]byte(e.Data), v); err != nil {
+		e.t.Fatalf("failed to decode data of event %s: %s", e.Name, err)
+	}
+}
+
+// Stream is a Server-Sent Events client of a Harness.
+type Stream struct {
+	t        testing.TB
+	response *http.Response
+
+	// Events read from the stream, closed when it ends.
+	events chan *Event
+}
+
+// Stream connects to /sse with the query and fails the test unless the stream starts.
+func (h *Harness) Stream(query url.Values) *Stream {
+	h.t.Helper()
+
+	response, err := http.Get(h.URL + "/sse?" + query.Encode())
+	if err != nil {
+		h.t.Fatalf("failed to connect: %s", err)
+	}
+
+	h.t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK {
+		h.t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+
+	s := &Stream{t: h.t, response: response, events: make(chan *Event, 256)}
+	go func() {
+		defer close(s.events)
+
+		event := &Event{t: h.t}
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.Name != "" {
+					s.events <- event
+				}
+
+				event = &Event{t: h.t}
+
+			case strings.HasPrefix(line, "event: "):
+				event.Name = strings.TrimPrefix(line, "event: ")
+
+			case strings.HasPrefix(line, "data: "):
+				event.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+
+	return s
+}
+
+// Expect waits for the next event and fails the test unless it has the name.
+func (s *Stream) Expect(name string) *Event {
+	s.t.Helper()
+
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			s.t.Fatalf("expected event %s, but the stream ended", name)
+		}
+
+		if event.Name != name {
+			s.t.Fatalf("expected event %s, but got %s (%s)", name, event.Name, event.Data)
+		}
+
+		return event
+
+	case <-time.After(expectTimeout):
+		s.t.Fatalf("expected event %s, but got nothing", name)
+	}
+
+	return nil
+}
+
+// ExpectEnd waits for the stream to end.
+func (s *Stream) ExpectEnd() {
+	s.t.Helper()
+
+	for {
+		select {
+		case _, ok := <-s.events:
+			if !ok {
+				return
+			}
+
+		case <-time.After(expectTimeout):
+			s.t.Fatalf("expected the stream to end")
+		}
+	}
+}
+
+// Close closes the stream.
+func (s *Stream) Close() {
+	s.response.Body.Close()
+}
@@ -0,0 +1,397 @@
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/webhooks"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// Integration kinds.
+const (
+	KindNats      = "nats"
+	KindJetStream = "jetstream"
+	KindHTTP      = "http"
+)
+
+// Kinds lists every integration kind.
+var Kinds = []string{KindNats, KindJetStream, KindHTTP}
+
+const (
+	// NATS queue group used so every message is forwarded by a single server.
+	queueGroup = "integrations"
+
+	// Maximum messages being forwarded at once.
+	maxConcurrentForwards = 64
+
+	// Attempts made to forward a message over HTTP.
+	maxHTTPAttempts = 3
+
+	// How long the integrations of an app are cached before being loaded again.
+	cacheTTL = 30 * time.Second
+
+	// Time allowed to database and JetStream operations.
+	operationTimeout = 5 * time.Second
+)
+
+// Prefix of the subjects NATS and JetStream integrations publish on, followed by the ID of the app.
+const subjectPrefix = "integrations"
+
+// Message is what gets forwarded to the targets of integrations.
+type Message struct {
+	AppID     string      `json:"app_id"`
+	Channel   string      `json:"channel"`
+	Event     string      `json:"event"`
+	Data      interface{} `json:"data"`
+	Timestamp int64       `json:"timestamp"` // Unix milliseconds.
+}
+
+type cacheEntry struct {
+	integrations []models.Integration
+	expiresAt    time.Time
+}
+
+// Forwarder forwards the messages published on channels to the targets of the integrations of their apps.
+type Forwarder struct {
+	db         *gorm.DB
+	broker     broker.Broker
+	js         nats.JetStreamContext
+	httpClient *http.Client
+
+	// Limits the forwards in flight, messages are dropped when it's full so the subscriptions don't block.
+	forwards chan struct{}
+
+	// Base delay between HTTP attempts, increased linearly after every attempt.
+	retryBackoff time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+
+	// Forwards in flight, which are waited for when stopping. Guarded by mu along with stopped so none start once
+	// they're waited for.
+	sends   sync.WaitGroup
+	stopped bool
+
+	// Subscriptions to the messages of apps, set once running.
+	messages *broker.AppChannels
+}
+
+// NewForwarder returns an initialized Forwarder.
+func NewForwarder(db *gorm.DB) *Forwarder {
+	return &Forwarder{
+		db:           db,
+		httpClient:   webhooks.NewHTTPClient(),
+		forwards:     make(chan struct{}, maxConcurrentForwards),
+		retryBackoff: time.Second,
+		cache:        make(map[string]*cacheEntry),
+	}
+}
+
+// ValidateTarget validates the target of an integration of the kind. URLs have to point to public addresses so
+// integrations can't reach the network of the server.
+func ValidateTarget(ctx context.Context, kind string, target string) error {
+	switch kind {
+	case KindNats, KindJetStream:
+		if target == "" || strings.ContainsAny(target, " \t\r\n*>") || strings.HasPrefix(target, ".") || strings.HasSuffix(target, ".") || strings.Contains(target, "..") {
+			return errors.New("invalid target, must be a NATS subject without wildcards")
+		}
+
+	case KindHTTP:
+		if err := webhooks.ValidateURL(ctx, target); err != nil {
+			return err
+		}
+
+	default:
+		return errors.New("invalid kind, must be one of " + strings.Join(Kinds, ", "))
+	}
+
+	return nil
+}
+
+// Run subscribes to the messages published on the channels of the apps with integrations on every server and
+// forwards them until ctx is done, then unsubscribes and waits for the forwards in flight, which stop retrying.
+func (f *Forwarder) Run(ctx context.Context, b broker.Broker) {
+	f.broker = b
+
+	// JetStream is only available when the broker is NATS.
+	if natsBroker, ok := b.(*broker.NatsBroker); ok {
+		js, jsErr := natsBroker.Conn().JetStream()
+		if jsErr != nil {
+			logrus.Error(fmt.Sprintf("JetStream integrations are unavailable: %s", jsErr))
+		}
+
+		f.js = js
+	}
+
+	messages := broker.NewAppChannels(func(subject string) (broker.Subscription, error) {
+		return broker.QueueSubscribeJSON(b, subject, queueGroup, func(data *websocket.NatsChannelPublishData) {
+			// Channel parts: <app-id>:<channel-name>
+			channelParts := strings.Split(data.Channel, ":")
+			if len(channelParts) != 2 {
+				return
+			}
+
+			f.forward(ctx, &Message{
+				AppID:     channelParts[0],
+				Channel:   channelParts[1],
+				Event:     data.Event,
+				Data:      data.Data,
+				Timestamp: time.Now().UnixMilli(),
+			})
+		})
+	})
+	defer messages.Close()
+
+	f.mu.Lock()
+	f.messages = messages
+	f.mu.Unlock()
+	f.refreshMessages(messages)
+
+	// Integrations changed through other servers are picked up as their caches expire.
+	ticker := time.NewTicker(cacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.refreshMessages(messages)
+
+		case <-ctx.Done():
+			messages.Close()
+
+			f.mu.Lock()
+			f.stopped = true
+			f.mu.Unlock()
+
+			f.sends.Wait()
+			return
+		}
+	}
+}
+
+// Invalidate drops the cached integrations of the app so they're loaded again on the next message, and subscribes to
+// the messages of the app or unsubscribes from them depending on whether it still has integrations.
+func (f *Forwarder) Invalidate(appID string) {
+	f.mu.Lock()
+	delete(f.cache, appID)
+	messages := f.messages
+	f.mu.Unlock()
+
+	if messages == nil {
+		return
+	}
+
+	err := messages.RefreshApp(appID, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		var count int64
+		result := f.db.WithContext(ctx).Model(&models.Integration{}).Where("app_id = ?", appID).Count(&count)
+		return count > 0, result.Error
+	})
+
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the messages of app %s: %s", appID, err))
+	}
+}
+
+// Subscribes to the messages of the apps with integrations only.
+func (f *Forwarder) refreshMessages(messages *broker.AppChannels) {
+	err := messages.Refresh(func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		var appIDs []string
+		result := f.db.WithContext(ctx).Model(&models.Integration{}).Distinct().Pluck("app_id", &appIDs)
+		return appIDs, result.Error
+	})
+
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the messages of apps with integrations: %s", err))
+	}
+}
+
+func (f *Forwarder) forward(ctx context.Context, message *Message) {
+	integrations, err := f.appIntegrations(message.AppID)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to load integrations of app %s: %s", message.AppID, err))
+		return
+	}
+
+	matching := Match(integrations, message.Channel, message.Event)
+	if len(matching) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	for _, integration := range matching {
+		integration := integration
+		select {
+		case f.forwards <- struct{}{}:
+		default:
+			logrus.Error(fmt.Sprintf("dropping message to integration %s, too many messages are being forwarded", integration.ID))
+			continue
+		}
+
+		f.mu.Lock()
+		if f.stopped {
+			f.mu.Unlock()
+			<-f.forwards
+			return
+		}
+		f.sends.Add(1)
+		f.mu.Unlock()
+
+		go func() {
+			defer f.sends.Done()
+			defer func() { <-f.forwards }()
+			if err := f.send(ctx, integration, body); err != nil {
+				logrus.Error(fmt.Sprintf("failed to forward message to integration %s: %s", integration.ID, err))
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) send(ctx context.Context, integration models.Integration, body []byte) error {
+	switch integration.Kind {
+	case KindNats:
+		return f.broker.Publish(Subject(integration.AppID, integration.Target), body)
+
+	case KindJetStream:
+		if f.js == nil {
+			return errors.New("JetStream is unavailable")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		_, err := f.js.Publish(Subject(integration.AppID, integration.Target), body, nats.Context(ctx))
+		return err
+
+	case KindHTTP:
+		return f.post(ctx, integration, body)
+	}
+
+	return errors.New("unknown integration kind " + integration.Kind)
+}
+
+// Posts the message to the endpoint, retrying server errors with a linear backoff until ctx is done.
+func (f *Forwarder) post(ctx context.Context, integration models.Integration, body []byte) error {
+	var lastErr error
+	for attempt := 1; attempt <= maxHTTPAttempts; attempt++ {
+		request, err := http.NewRequest(http.MethodPost, integration.Target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Mycelium-Integration-Id", integration.ID)
+		request.Header.Set("X-Mycelium-Timestamp", timestamp)
+		if integration.Secret != "" {
+			request.Header.Set("X-Mycelium-Signature", webhooks.Sign(integration.Secret, timestamp, body))
+		}
+
+		response, err := f.httpClient.Do(request)
+		if errors.Is(err, webhooks.ErrPrivateAddress) {
+			// The endpoint won't become public by retrying.
+			return err
+		}
+
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode < 500 {
+				if response.StatusCode >= 300 {
+					return errors.New("unexpected status " + response.Status)
+				}
+
+				return nil
+			}
+
+			err = errors.New("unexpected status " + response.Status)
+		}
+
+		lastErr = err
+		if attempt < maxHTTPAttempts && !f.backOff(ctx, attempt) {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// Waits before the next HTTP attempt, returning false without waiting if ctx is done first.
+func (f *Forwarder) backOff(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(time.Duration(attempt) * f.retryBackoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (f *Forwarder) appIntegrations(appID string) ([]models.Integration, error) {
+	f.mu.Lock()
+	entry, ok := f.cache[appID]
+	f.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.integrations, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+
+	var integrations []models.Integration
+	if result := f.db.WithContext(ctx).Find(&integrations, "app_id = ?", appID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	f.mu.Lock()
+	f.cache[appID] = &cacheEntry{integrations: integrations, expiresAt: time.Now().Add(cacheTTL)}
+	f.mu.Unlock()
+
+	return integrations, nil
+}
+
+// Subject returns the subject the NATS or JetStream integration of the app with the target publishes on. Every app
+// publishes under its own prefix, integrations.<app-id>, so it can't publish on the subjects of other apps or on the
+// ones used internally by Mycelium.
+func Subject(appID string, target string) string {
+	return subjectPrefix + "." + appID + "." + target
+}
+
+// Match returns the integrations that forward the event published on the channel.
+func Match(integrations []models.Integration, channel string, event string) []models.Integration {
+	return common.Filter(integrations, func(integration models.Integration) bool {
+		if !common.MatchChannelPattern(integration.Pattern, channel) {
+			return false
+		}
+
+		return integration.Events == "" || slices.Contains(strings.Split(integration.Events, ","), event)
+	})
+}
@@ -0,0 +1,141 @@
+package integrations
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/webhooks"
+)
+
+func TestValidateTargetRejectsWildcards(t *testing.T) {
+	for _, target := range []string{"", "orders.*", "orders.>", ".orders", "orders.", "orders..created"} {
+		if err := ValidateTarget(context.Background(), KindNats, target); err == nil {
+			t.Fatalf("expected target %q to be rejected", target)
+		}
+	}
+
+	if err := ValidateTarget(context.Background(), KindJetStream, "orders.created"); err != nil {
+		t.Fatalf("expected target %q to be valid, but got %s", "orders.created", err)
+	}
+}
+
+func TestSubjectIsNamespacedByApp(t *testing.T) {
+	// Subjects of Mycelium or other apps are published on under the namespace of the app.
+	for _, target := range []string{"mycelium.other.lobby", "situation_change", "$JS.API.INFO"} {
+		if subject := Subject("app", target); subject != "integrations.app."+target {
+			t.Fatalf("expected subject %q, but got %q", "integrations.app."+target, subject)
+		}
+	}
+}
+
+func TestHTTPTargetsMustBePublic(t *testing.T) {
+	for _, target := range []string{"http://127.0.0.1/", "http://169.254.169.254/", "http://10.0.0.1/hook", "ftp://example.com"} {
+		if err := ValidateTarget(context.Background(), KindHTTP, target); err == nil {
+			t.Fatalf("expected target %q to be rejected", target)
+		}
+	}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	// Targets resolving to private addresses once saved aren't posted to either.
+	f := NewForwarder(nil)
+	if err := f.post(context.Background(), models.Integration{ID: "integration", Kind: KindHTTP, Target: server.URL}, []byte("{}")); !errors.Is(err, webhooks.ErrPrivateAddress) {
+		t.Fatalf("expected %v, but got %v", webhooks.ErrPrivateAddress, err)
+	}
+
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("expected no requests, but got %d", requests)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	integrations := []models.Integration{
+		{ID: "all", Pattern: "*"},
+		{ID: "orders", Pattern: "orders-*", Events: "created,cancelled"},
+		{ID: "lobby", Pattern: "lobby"},
+	}
+
+	matched := Match(integrations, "orders-eu", "created")
+	if len(matched) != 2 || matched[0].ID != "all" || matched[1].ID != "orders" {
+		t.Fatalf("expected integrations all and orders to match, but got %v", matched)
+	}
+
+	matched = Match(integrations, "orders-eu", "updated")
+	if len(matched) != 1 || matched[0].ID != "all" {
+		t.Fatalf("expected integration all to match, but got %v", matched)
+	}
+}
+
+func TestPostStopsRetryingOnceStopped(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	f := NewForwarder(nil)
+	f.httpClient = &http.Client{}
+	f.retryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := f.post(ctx, models.Integration{ID: "integration", Kind: KindHTTP, Target: server.URL}, []byte("{}")); err == nil {
+		t.Fatalf("expected the post to fail")
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected %d attempt, but got %d", 1, requests)
+	}
+}
+
+func TestForwardDropsMessagesWhenBusy(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	f := NewForwarder(nil)
+	f.httpClient = &http.Client{}
+	f.cache["app"] = &cacheEntry{
+		integrations: []models.Integration{{ID: "integration", AppID: "app", Kind: KindHTTP, Target: server.URL, Pattern: "*"}},
+		expiresAt:    time.Now().Add(time.Hour),
+	}
+
+	for i := 0; i < maxConcurrentForwards; i++ {
+		f.forwards <- struct{}{}
+	}
+
+	// The subscription isn't blocked while the forwards in flight finish.
+	done := make(chan struct{})
+	go func() {
+		f.forward(context.Background(), &Message{AppID: "app", Channel: "lobby", Event: "greeting"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the message to be dropped")
+	}
+
+	<-f.forwards
+	f.forward(context.Background(), &Message{AppID: "app", Channel: "lobby", Event: "greeting"})
+	f.sends.Wait()
+
+	if requests != 1 {
+		t.Fatalf("expected %d request, but got %d", 1, requests)
+	}
+}
@@ -0,0 +1,230 @@
+// Package jsonpatch creates and applies JSON patches (RFC 6902) between documents decoded by encoding/json.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Operation of a patch, only add, remove and replace are created.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves out the value of remove operations, the value of other operations can be null.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+
+	type operation Operation
+	return json.Marshal(operation(o))
+}
+
+// Diff returns the operations that turn the document from into to. Objects are patched key by key and arrays index
+// by index, anything else that changed is replaced.
+func Diff(from interface{}, to interface{}) []Operation {
+	return diff("", from, to, nil)
+}
+
+func diff(path string, from interface{}, to interface{}, operations []Operation) []Operation {
+	switch from := from.(type) {
+	case map[string]interface{}:
+		to, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		// Sorted so the same documents always give the same patch.
+		keys := make([]string, 0, len(from)+len(to))
+		for key := range from {
+			keys = append(keys, key)
+		}
+
+		for key := range to {
+			if _, ok := from[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			fromValue, inFrom := from[key]
+			toValue, inTo := to[key]
+			keyPath := path + "/" + escape(key)
+
+			switch {
+			case !inTo:
+				operations = append(operations, Operation{Op: "remove", Path: keyPath})
+
+			case !inFrom:
+				operations = append(operations, Operation{Op: "add", Path: keyPath, Value: toValue})
+
+			default:
+				operations = diff(keyPath, fromValue, toValue, operations)
+			}
+		}
+
+		return operations
+
+	case []interface{}:
+		to, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+
+		common := len(from)
+		if len(to) < common {
+			common = len(to)
+		}
+
+		for i := 0; i < common; i++ {
+			operations = diff(path+"/"+strconv.Itoa(i), from[i], to[i], operations)
+		}
+
+		for i := common; i < len(to); i++ {
+			operations = append(operations, Operation{Op: "add", Path: path + "/-", Value: to[i]})
+		}
+
+		// From the end so the indexes of the elements left don't change.
+		for i := len(from) - 1; i >= common; i-- {
+			operations = append(operations, Operation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+
+		return operations
+	}
+
+	if reflect.DeepEqual(from, to) {
+		return operations
+	}
+
+	return append(operations, Operation{Op: "replace", Path: path, Value: to})
+}
+
+// Apply applies the operations to the document and returns the result, the document is modified.
+func Apply(document interface{}, operations []Operation) (interface{}, error) {
+	for _, operation := range operations {
+		var err error
+		if document, err = apply(document, operation); err != nil {
+			return nil, err
+		}
+	}
+
+	return document, nil
+}
+
+func apply(document interface{}, operation Operation) (interface{}, error) {
+	if operation.Path == "" {
+		if operation.Op == "remove" {
+			return nil, errors.New("can't remove the whole document")
+		}
+
+		return operation.Value, nil
+	}
+
+	if !strings.HasPrefix(operation.Path, "/") {
+		return nil, fmt.Errorf("invalid path %s", operation.Path)
+	}
+
+	tokens := strings.Split(operation.Path[1:], "/")
+	parent, err := walk(document, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := unescape(tokens[len(tokens)-1])
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := container[last]; !ok && operation.Op != "add" {
+			return nil, fmt.Errorf("path %s not found", operation.Path)
+		}
+
+		if operation.Op == "remove" {
+			delete(container, last)
+		} else {
+			container[last] = operation.Value
+		}
+
+		return document, nil
+
+	case []interface{}:
+		index := len(container)
+		if last != "-" {
+			if index, err = strconv.Atoi(last); err != nil || index < 0 || index > len(container) {
+				return nil, fmt.Errorf("invalid index in path %s", operation.Path)
+			}
+		}
+
+		var updated []interface{}
+		switch {
+		case operation.Op == "add":
+			updated = append(container[:index:index], append([]interface{}{operation.Value}, container[index:]...)...)
+
+		case index == len(container):
+			return nil, fmt.Errorf("path %s not found", operation.Path)
+
+		case operation.Op == "remove":
+			updated = append(container[:index:index], container[index+1:]...)
+
+		default:
+			container[index] = operation.Value
+			return document, nil
+		}
+
+		// Arrays can't grow or shrink in place, the new one replaces the old one in its parent.
+		parentPath := ""
+		if len(tokens) > 1 {
+			parentPath = "/" + strings.Join(tokens[:len(tokens)-1], "/")
+		}
+
+		return apply(document, Operation{Op: "replace", Path: parentPath, Value: updated})
+
+	default:
+		return nil, fmt.Errorf("path %s not found", operation.Path)
+	}
+}
+
+func walk(document interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[unescape(token)]
+			if !ok {
+				return nil, fmt.Errorf("key %s not found", token)
+			}
+
+			document = value
+
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil, fmt.Errorf("index %s not found", token)
+			}
+
+			document = container[index]
+
+		default:
+			return nil, fmt.Errorf("%s not found", token)
+		}
+	}
+
+	return document, nil
+}
+
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func unescape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+}
@@ -0,0 +1,70 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, document string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(document), &v); err != nil {
+		t.Fatalf("failed to decode %s: %s", document, err)
+	}
+
+	return v
+}
+
+func TestDiffApply(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{`{"a": 1, "b": {"c": [1, 2, 3]}}`, `{"a": 2, "b": {"c": [1, 2, 3]}}`},
+		{`{"a": 1, "b": 2}`, `{"b": 2, "c": null}`},
+		{`{"list": [1, 2, 3]}`, `{"list": [1, 5]}`},
+		{`{"list": [1]}`, `{"list": [1, {"x": true}, "y"]}`},
+		{`[1, 2]`, `[1, 2, 3]`},
+		{`[1, 2, 3]`, `[3]`},
+		{`{"a/b": 1, "c~d": 2}`, `{"a/b": 3, "c~d": 4}`},
+		{`{"a": [1]}`, `"replaced"`},
+		{`{"a": 1}`, `{"a": 1}`},
+	}
+
+	for _, test := range tests {
+		patch := Diff(decode(t, test.from), decode(t, test.to))
+
+		// Patches go through JSON to clients.
+		data, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatalf("failed to encode the patch: %s", err)
+		}
+
+		var decoded []Operation
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("failed to decode the patch: %s", err)
+		}
+
+		result, err := Apply(decode(t, test.from), decoded)
+		if err != nil {
+			t.Fatalf("expected %s to apply, but got %s", data, err)
+		}
+
+		if !reflect.DeepEqual(result, decode(t, test.to)) {
+			t.Fatalf("expected %s to turn %s into %s, but got %v", data, test.from, test.to, result)
+		}
+	}
+}
+
+func TestDiffUnchanged(t *testing.T) {
+	if patch := Diff(decode(t, `{"a": [1, {"b": null}]}`), decode(t, `{"a": [1, {"b": null}]}`)); len(patch) != 0 {
+		t.Fatalf("expected no operations, but got %+v", patch)
+	}
+}
+
+func TestMarshalRemove(t *testing.T) {
+	data, _ := json.Marshal([]Operation{{Op: "remove", Path: "/a"}, {Op: "add", Path: "/b"}})
+	if string(data) != `[{"op":"remove","path":"/a"},{"op":"add","path":"/b","value":null}]` {
+		t.Fatalf("expected remove without a value, but got %s", data)
+	}
+}
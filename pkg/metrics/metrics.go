@@ -0,0 +1,89 @@
+// Package metrics keeps counters of the server and serves them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	sample func() float64
+}
+
+var (
+	mu      sync.Mutex
+	metrics = make(map[string]*metric)
+)
+
+func register(name string, help string, kind string, sample func() float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := metrics[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+
+	metrics[name] = &metric{name: name, help: help, kind: kind, sample: sample}
+}
+
+// Counter is a value that only goes up, e.g. the messages sent.
+type Counter struct {
+	value uint64
+}
+
+// NewCounter registers a counter with the name and description.
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", func() float64 { return float64(c.Value()) })
+	return c
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// NewGaugeFunc registers a gauge with the name and description, its value is the one returned by sample when the
+// metrics are read.
+func NewGaugeFunc(name string, help string, sample func() float64) {
+	register(name, help, "gauge", sample)
+}
+
+// Handler serves every metric registered.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+
+		registered := make([]*metric, len(names))
+		sort.Strings(names)
+		for i, name := range names {
+			registered[i] = metrics[name]
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range registered {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.sample())
+		}
+	})
+}
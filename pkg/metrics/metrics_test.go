@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Metrics can only be registered once.
+var testRequests = NewCounter("test_requests_total", "Requests handled.")
+
+func init() {
+	NewGaugeFunc("test_ratio", "Ratio of something.", func() float64 { return 0.25 })
+}
+
+func TestHandler(t *testing.T) {
+	testRequests.Add(2)
+	testRequests.Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	expected := "# HELP test_ratio Ratio of something.\n# TYPE test_ratio gauge\ntest_ratio 0.25\n" +
+		fmt.Sprintf("# HELP test_requests_total Requests handled.\n# TYPE test_requests_total counter\ntest_requests_total %d\n", testRequests.Value())
+	if body := recorder.Body.String(); !strings.Contains(body, expected) {
+		t.Fatalf("expected the metrics to contain %q, but got %q", expected, body)
+	}
+}
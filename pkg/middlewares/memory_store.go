@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/common"
+)
+
+// memoryStore is a limiter.Store counting fixed windows in memory. It replaces the memory store of the limiter,
+// whose keys share their bytes with pooled buffers so a key can turn into another one and take its count.
+type memoryStore struct {
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSwept time.Time
+}
+
+type window struct {
+	count      int64
+	expiration time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{windows: make(map[string]*window)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	return s.Increment(ctx, key, 1, rate)
+}
+
+func (s *memoryStore) Peek(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	w := s.current(key, rate, now)
+	return common.GetContextFromState(now, rate, w.expiration, w.count), nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, key string, rate limiter.Rate) (limiter.Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	delete(s.windows, key)
+	return common.GetContextFromState(now, rate, now.Add(rate.Period), 0), nil
+}
+
+func (s *memoryStore) Increment(ctx context.Context, key string, count int64, rate limiter.Rate) (limiter.Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	w := s.current(key, rate, now)
+	w.count += count
+	s.windows[key] = w
+	return common.GetContextFromState(now, rate, w.expiration, w.count), nil
+}
+
+// Returns the window of the key at the time, a new one if it has expired. Must be called with the lock held.
+func (s *memoryStore) current(key string, rate limiter.Rate, now time.Time) *window {
+	w, ok := s.windows[key]
+	if !ok || !now.Before(w.expiration) {
+		return &window{expiration: now.Add(rate.Period)}
+	}
+
+	return w
+}
+
+// Forgets the expired windows once a minute. Must be called with the lock held.
+func (s *memoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSwept) < time.Minute {
+		return
+	}
+
+	s.lastSwept = now
+	for key, w := range s.windows {
+		if !now.Before(w.expiration) {
+			delete(s.windows, key)
+		}
+	}
+}
@@ -1,38 +1,83 @@
 package middlewares
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
-	"github.com/sirupsen/logrus"
 	"github.com/ulule/limiter/v3"
-	mgin "github.com/ulule/limiter/v3/drivers/middleware/gin"
 	sredis "github.com/ulule/limiter/v3/drivers/store/redis"
 )
 
-func NewRateLimiterMiddleware(formattedRate string, rdb *redis.Client) (gin.HandlerFunc, error) {
-	// Define a limit rate to 15000 requests per hour.
-	rate, rateErr := limiter.NewRateFromFormatted(formattedRate)
-	if rateErr != nil {
-		logrus.Fatalln(rateErr)
+// RateLimiterKey is the key of the RateLimiter of the route in the context of the request.
+const RateLimiterKey = "rate_limiter"
+
+// RateLimiter is the budget of requests of a group of routes, it's counted per key by the controllers once the
+// request is authenticated so clients behind the same IP don't share it.
+type RateLimiter struct {
+	// Name of the budget, the routes sharing a name share the budget.
+	Name    string
+	Limiter *limiter.Limiter
+}
+
+// NewRateLimitStore returns the store of the rate limits, it's in memory when running without redis.
+func NewRateLimitStore(rdb *redis.Client) (limiter.Store, error) {
+	if rdb == nil {
+		return newMemoryStore(), nil
 	}
 
-	// Create a rate limiter store with the redis client.
-	limiterStore, limiterStoreErr := sredis.NewStoreWithOptions(rdb, limiter.StoreOptions{
+	return sredis.NewStoreWithOptions(rdb, limiter.StoreOptions{
 		Prefix: "rate_limiter",
 	})
+}
+
+// NewRateLimiter returns the budget with the name and rate.
+func NewRateLimiter(name string, formattedRate string, limiterStore limiter.Store) (*RateLimiter, error) {
+	rate, err := limiter.NewRateFromFormatted(formattedRate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{Name: name, Limiter: limiter.New(limiterStore, rate)}, nil
+}
 
-	if limiterStoreErr != nil {
-		return nil, limiterStoreErr
+// RateLimitMiddleware sets the budget of the routes, the routes without one aren't limited.
+func RateLimitMiddleware(name string, formattedRate string, limiterStore limiter.Store) (gin.HandlerFunc, error) {
+	rateLimiter, err := NewRateLimiter(name, formattedRate, limiterStore)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a new middleware with the limiter instance.
-	middleware := mgin.NewMiddleware(limiter.New(limiterStore, rate))
-	return middleware, nil
+	return func(c *gin.Context) {
+		c.Set(RateLimiterKey, rateLimiter)
+		c.Next()
+	}, nil
 }
 
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware allows requests from the origins, "*" allows any origin.
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	allowAny := false
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAny = true
+		}
+
+		allowed[origin] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
+		if allowAny {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Vary", "Origin")
+			if origin := c.Request.Header.Get("Origin"); allowed[origin] {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+		}
+
 		c.Header("Access-Control-Allow-Headers", "*")
 
 		if c.Request.Method == "OPTIONS" {
@@ -43,3 +88,29 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// TimeoutMiddleware gives the context of requests a deadline, it bounds the database, channel store and broker
+// operations of the handlers.
+func TimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// ClientCertificateMiddleware rejects requests made without a client certificate verified by the TLS listener.
+func ClientCertificateMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "client certificate required",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+type AllowedOrigin struct {
+	ID    string `json:"id"`
+	AppID string `json:"app_id"`
+
+	// Origin allowed to connect to the app from browsers, e.g. "https://example.com". A "*." before the host allows
+	// every subdomain of it, e.g. "https://*.example.com".
+	Origin string `json:"origin"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
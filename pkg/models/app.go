@@ -1,7 +1,11 @@
 package models
 
 type App struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Maximum connections to the app across every server, 0 means the limit of the servers applies.
+	MaxConnections int64 `json:"max_connections"`
+
 	ApiKeys []ApiKey
 }
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+type ChannelRule struct {
+	ID    string `json:"id"`
+	AppID string `json:"app_id"`
+
+	// Channel name the rule applies to, a trailing "*" makes it apply to every channel with that prefix.
+	Pattern string `json:"pattern"`
+
+	PersistHistory bool   `json:"persist_history"`
+	HistoryTTL     int64  `json:"history_ttl"`      // Seconds, 0 means persisted history never expires.
+	MaxPayloadSize int    `json:"max_payload_size"` // Bytes, 0 means no limit other than the message size limit.
+	AllowedEvents  string `json:"allowed_events"`   // Comma separated, empty means every event is allowed.
+	ClientPublish  bool   `json:"client_publish"`
+	EchoPublisher  bool   `json:"echo_publisher"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
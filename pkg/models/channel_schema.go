@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type ChannelSchema struct {
+	ID    string `json:"id"`
+	AppID string `json:"app_id"`
+
+	// Channel name the schema applies to, a trailing "*" makes it apply to every channel with that prefix.
+	Pattern string `json:"pattern"`
+
+	// Event the schema applies to, empty means every event.
+	Event string `json:"event"`
+
+	// JSON Schema the data of published messages must conform to.
+	Schema string `json:"schema"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+type Integration struct {
+	ID    string `json:"id"`
+	AppID string `json:"app_id"`
+
+	// Where messages are forwarded: "nats", "jetstream" or "http".
+	Kind string `json:"kind"`
+
+	// NATS subject for the "nats" and "jetstream" kinds, published on under integrations.<app-id>, URL for the "http"
+	// kind.
+	Target string `json:"target"`
+
+	// Secret used to sign HTTP requests with HMAC-SHA256.
+	Secret string `json:"secret,omitempty"`
+
+	// Channel name the integration applies to, a trailing "*" makes it apply to every channel with that prefix.
+	Pattern string `json:"pattern"`
+
+	// Comma separated events forwarded, empty means every event.
+	Events string `json:"events"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+type Webhook struct {
+	ID    string `json:"id"`
+	AppID string `json:"app_id"`
+	URL   string `json:"url"`
+
+	// Secret used to sign the deliveries with HMAC-SHA256.
+	Secret string `json:"secret"`
+
+	// Comma separated events (e.g. "channel.occupied,presence.enter"), see the webhooks package for all of them.
+	Events string `json:"events"`
+
+	// Channel name the webhook applies to, a trailing "*" makes it apply to every channel with that prefix.
+	Pattern string `json:"pattern"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,633 @@
+// Package mqtt reads and writes the packets of MQTT 3.1.1 and MQTT 5 without QoS 2, retained messages or
+// authentication exchanges.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Types of packets.
+const (
+	TypeConnect     = 1
+	TypeConnack     = 2
+	TypePublish     = 3
+	TypePuback      = 4
+	TypePubrec      = 5
+	TypePubrel      = 6
+	TypePubcomp     = 7
+	TypeSubscribe   = 8
+	TypeSuback      = 9
+	TypeUnsubscribe = 10
+	TypeUnsuback    = 11
+	TypePingreq     = 12
+	TypePingresp    = 13
+	TypeDisconnect  = 14
+	TypeAuth        = 15
+)
+
+// Protocol versions.
+const (
+	Version311 = 4
+	Version5   = 5
+)
+
+// ErrMalformed is returned when a packet doesn't follow the protocol.
+var ErrMalformed = errors.New("malformed packet")
+
+// ErrTooLarge is returned when a packet is bigger than the maximum size allowed.
+var ErrTooLarge = errors.New("packet too large")
+
+// Packet as read from or written to a connection, its body is the variable header and the payload.
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// ReadPacket reads the next packet, failing with ErrTooLarge if its body is bigger than maxSize bytes.
+func ReadPacket(r *bufio.Reader, maxSize int) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &Packet{Type: header >> 4, Flags: header & 0x0f, Body: body}, nil
+}
+
+// WriteTo writes the packet to w.
+func (p *Packet) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, len(p.Body)+5)
+	buf = append(buf, p.Type<<4|p.Flags)
+	buf = appendVarint(buf, len(p.Body))
+	buf = append(buf, p.Body...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	value, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+
+		multiplier *= 128
+	}
+
+	return 0, ErrMalformed
+}
+
+func appendVarint(buf []byte, value int) []byte {
+	for {
+		b := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			b |= 0x80
+		}
+
+		buf = append(buf, b)
+		if value == 0 {
+			return buf
+		}
+	}
+}
+
+// decoder reads the fields of the body of a packet, the first error is kept and every read after it returns zero
+// values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformed
+	}
+
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.buf) < 2 {
+		d.fail()
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.buf) < 4 {
+		d.fail()
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) varint() int {
+	r := &byteReader{d: d}
+	v, err := readVarint(r)
+	if err != nil {
+		d.fail()
+	}
+
+	return v
+}
+
+type byteReader struct {
+	d *decoder
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(r.d.buf) < 1 {
+		return 0, ErrMalformed
+	}
+
+	return r.d.byte(), nil
+}
+
+func (d *decoder) binary() []byte {
+	size := int(d.uint16())
+	if len(d.buf) < size {
+		d.fail()
+		return nil
+	}
+
+	b := d.buf[:size]
+	d.buf = d.buf[size:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) bytes(size int) []byte {
+	if size < 0 || len(d.buf) < size {
+		d.fail()
+		return nil
+	}
+
+	b := d.buf[:size]
+	d.buf = d.buf[size:]
+	return b
+}
+
+// Returns the bit if set is true, 0 otherwise.
+func flag(set bool, bit byte) byte {
+	if set {
+		return bit
+	}
+
+	return 0
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUint16(buf, uint16(len(s))), s...)
+}
+
+// Connect is the first packet of a connection.
+type Connect struct {
+	Version    byte
+	CleanStart bool
+	KeepAlive  uint16
+	ClientID   string
+
+	// Will message, published when the connection is lost.
+	HasWill     bool
+	WillTopic   string
+	WillPayload []byte
+	WillQoS     byte
+	WillRetain  bool
+
+	Username    string
+	Password    string
+	HasUsername bool
+	HasPassword bool
+
+	Properties Properties
+}
+
+// DecodeConnect decodes the body of a CONNECT packet. Versions other than 3.1.1 and 5 are returned without the rest
+// of the packet so the server can reject them.
+func DecodeConnect(body []byte) (*Connect, error) {
+	d := &decoder{buf: body}
+	if name := d.string(); d.err == nil && name != "MQTT" {
+		return nil, ErrMalformed
+	}
+
+	c := &Connect{Version: d.byte()}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if c.Version != Version311 && c.Version != Version5 {
+		return c, nil
+	}
+
+	flags := d.byte()
+	if flags&0x01 != 0 {
+		return nil, ErrMalformed
+	}
+
+	c.CleanStart = flags&0x02 != 0
+	c.HasWill = flags&0x04 != 0
+	c.WillQoS = flags >> 3 & 0x03
+	c.WillRetain = flags&0x20 != 0
+	c.HasPassword = flags&0x40 != 0
+	c.HasUsername = flags&0x80 != 0
+	c.KeepAlive = d.uint16()
+
+	if c.Version == Version5 {
+		c.Properties = d.properties()
+	}
+
+	c.ClientID = d.string()
+	if c.HasWill {
+		if c.Version == Version5 {
+			d.properties()
+		}
+
+		c.WillTopic = d.string()
+		c.WillPayload = d.binary()
+	}
+
+	if c.HasUsername {
+		c.Username = d.string()
+	}
+
+	if c.HasPassword {
+		c.Password = string(d.binary())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return c, nil
+}
+
+// Encode encodes the CONNECT packet, the properties are left out before MQTT 5.
+func (c *Connect) Encode() *Packet {
+	flags := c.WillQoS<<3 | flag(c.CleanStart, 0x02) | flag(c.HasWill, 0x04) | flag(c.WillRetain, 0x20) | flag(c.HasPassword, 0x40) | flag(c.HasUsername, 0x80)
+
+	body := append(appendString(nil, "MQTT"), c.Version, flags)
+	body = appendUint16(body, c.KeepAlive)
+	if c.Version == Version5 {
+		body = c.Properties.appendTo(body)
+	}
+
+	body = appendString(body, c.ClientID)
+	if c.HasWill {
+		if c.Version == Version5 {
+			body = Properties(nil).appendTo(body)
+		}
+
+		body = appendString(appendString(body, c.WillTopic), string(c.WillPayload))
+	}
+
+	if c.HasUsername {
+		body = appendString(body, c.Username)
+	}
+
+	if c.HasPassword {
+		body = appendString(body, c.Password)
+	}
+
+	return &Packet{Type: TypeConnect, Body: body}
+}
+
+// DecodeConnack decodes a CONNACK packet and returns its reason code.
+func DecodeConnack(version byte, p *Packet) (code byte, properties Properties, err error) {
+	d := &decoder{buf: p.Body}
+	d.byte()
+	code = d.byte()
+	if version == Version5 {
+		properties = d.properties()
+	}
+
+	return code, properties, d.err
+}
+
+// EncodeConnack encodes a CONNACK packet, the properties are left out before MQTT 5.
+func EncodeConnack(version byte, code byte, properties Properties) *Packet {
+	body := []byte{0, code}
+	if version == Version5 {
+		body = properties.appendTo(body)
+	}
+
+	return &Packet{Type: TypeConnack, Body: body}
+}
+
+// Publish is a message published on a topic.
+type Publish struct {
+	Topic    string
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+	Payload  []byte
+
+	Properties Properties
+}
+
+// DecodePublish decodes a PUBLISH packet.
+func DecodePublish(version byte, p *Packet) (*Publish, error) {
+	d := &decoder{buf: p.Body}
+	publish := &Publish{
+		Dup:    p.Flags&0x08 != 0,
+		QoS:    p.Flags >> 1 & 0x03,
+		Retain: p.Flags&0x01 != 0,
+		Topic:  d.string(),
+	}
+
+	if publish.QoS > 0 {
+		publish.PacketID = d.uint16()
+	}
+
+	if version == Version5 {
+		publish.Properties = d.properties()
+	}
+
+	publish.Payload = d.buf
+	if d.err != nil || publish.QoS == 3 {
+		return nil, ErrMalformed
+	}
+
+	return publish, nil
+}
+
+// Encode encodes the PUBLISH packet, the properties are left out before MQTT 5.
+func (p *Publish) Encode(version byte) *Packet {
+	flags := p.QoS<<1 | flag(p.Dup, 0x08) | flag(p.Retain, 0x01)
+
+	body := appendString(nil, p.Topic)
+	if p.QoS > 0 {
+		body = appendUint16(body, p.PacketID)
+	}
+
+	if version == Version5 {
+		body = p.Properties.appendTo(body)
+	}
+
+	return &Packet{Type: TypePublish, Flags: flags, Body: append(body, p.Payload...)}
+}
+
+// EncodeAck encodes a PUBACK, PUBREC, PUBREL or PUBCOMP packet. The reason code is left out before MQTT 5 or when
+// it's success and there are no properties.
+func EncodeAck(version byte, packetType byte, packetID uint16, code byte, properties Properties) *Packet {
+	var flags byte
+	if packetType == TypePubrel {
+		flags = 0x02
+	}
+
+	body := appendUint16(nil, packetID)
+	if version == Version5 && (code != 0 || len(properties) > 0) {
+		body = properties.appendTo(append(body, code))
+	}
+
+	return &Packet{Type: packetType, Flags: flags, Body: body}
+}
+
+// DecodeAck decodes a PUBACK, PUBREC, PUBREL or PUBCOMP packet, its reason code is success when it's left out.
+func DecodeAck(version byte, p *Packet) (packetID uint16, code byte, err error) {
+	d := &decoder{buf: p.Body}
+	packetID = d.uint16()
+	if version == Version5 && len(d.buf) > 0 {
+		code = d.byte()
+	}
+
+	return packetID, code, d.err
+}
+
+// Subscription to the topics matching a filter.
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// Subscribe asks for the messages published on the topics matching the filters.
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+// DecodeSubscribe decodes a SUBSCRIBE packet.
+func DecodeSubscribe(version byte, p *Packet) (*Subscribe, error) {
+	if p.Flags != 0x02 {
+		return nil, ErrMalformed
+	}
+
+	d := &decoder{buf: p.Body}
+	subscribe := &Subscribe{PacketID: d.uint16()}
+	if version == Version5 {
+		d.properties()
+	}
+
+	for len(d.buf) > 0 && d.err == nil {
+		filter := d.string()
+		options := d.byte()
+		subscribe.Subscriptions = append(subscribe.Subscriptions, Subscription{Filter: filter, QoS: options & 0x03})
+	}
+
+	if d.err != nil || len(subscribe.Subscriptions) == 0 {
+		return nil, ErrMalformed
+	}
+
+	return subscribe, nil
+}
+
+// Encode encodes the SUBSCRIBE packet.
+func (s *Subscribe) Encode(version byte) *Packet {
+	body := appendUint16(nil, s.PacketID)
+	if version == Version5 {
+		body = Properties(nil).appendTo(body)
+	}
+
+	for _, subscription := range s.Subscriptions {
+		body = append(appendString(body, subscription.Filter), subscription.QoS)
+	}
+
+	return &Packet{Type: TypeSubscribe, Flags: 0x02, Body: body}
+}
+
+// DecodeSuback decodes a SUBACK packet and returns the reason code of every subscription.
+func DecodeSuback(version byte, p *Packet) (packetID uint16, codes []byte, err error) {
+	d := &decoder{buf: p.Body}
+	packetID = d.uint16()
+	if version == Version5 {
+		d.properties()
+	}
+
+	return packetID, d.buf, d.err
+}
+
+// EncodeSuback encodes a SUBACK packet with a reason code (the QoS granted or a failure) for every subscription.
+func EncodeSuback(version byte, packetID uint16, codes []byte) *Packet {
+	body := appendUint16(nil, packetID)
+	if version == Version5 {
+		body = Properties(nil).appendTo(body)
+	}
+
+	return &Packet{Type: TypeSuback, Body: append(body, codes...)}
+}
+
+// Unsubscribe asks to stop getting the messages of the filters.
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+}
+
+// DecodeUnsubscribe decodes an UNSUBSCRIBE packet.
+func DecodeUnsubscribe(version byte, p *Packet) (*Unsubscribe, error) {
+	if p.Flags != 0x02 {
+		return nil, ErrMalformed
+	}
+
+	d := &decoder{buf: p.Body}
+	unsubscribe := &Unsubscribe{PacketID: d.uint16()}
+	if version == Version5 {
+		d.properties()
+	}
+
+	for len(d.buf) > 0 && d.err == nil {
+		unsubscribe.Filters = append(unsubscribe.Filters, d.string())
+	}
+
+	if d.err != nil || len(unsubscribe.Filters) == 0 {
+		return nil, ErrMalformed
+	}
+
+	return unsubscribe, nil
+}
+
+// Encode encodes the UNSUBSCRIBE packet.
+func (u *Unsubscribe) Encode(version byte) *Packet {
+	body := appendUint16(nil, u.PacketID)
+	if version == Version5 {
+		body = Properties(nil).appendTo(body)
+	}
+
+	for _, filter := range u.Filters {
+		body = appendString(body, filter)
+	}
+
+	return &Packet{Type: TypeUnsubscribe, Flags: 0x02, Body: body}
+}
+
+// EncodeUnsuback encodes an UNSUBACK packet, the reason codes are left out before MQTT 5.
+func EncodeUnsuback(version byte, packetID uint16, codes []byte) *Packet {
+	body := appendUint16(nil, packetID)
+	if version == Version5 {
+		body = append(Properties(nil).appendTo(body), codes...)
+	}
+
+	return &Packet{Type: TypeUnsuback, Body: body}
+}
+
+// EncodeDisconnect encodes a DISCONNECT packet sent by the server, it only exists since MQTT 5 so it's nil before.
+func EncodeDisconnect(version byte, code byte, reason string) *Packet {
+	if version != Version5 {
+		return nil
+	}
+
+	var properties Properties
+	if reason != "" {
+		properties = Properties{{ID: PropertyReasonString, Value: reason}}
+	}
+
+	return &Packet{Type: TypeDisconnect, Body: properties.appendTo([]byte{code})}
+}
+
+// ValidTopic reports whether the topic name can be published on: not empty and without wildcards.
+func ValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// ValidFilter reports whether the topic filter is valid, wildcards have to take whole levels and "#" has to be the
+// last one.
+func ValidFilter(filter string) bool {
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && level != "#" {
+			return false
+		}
+
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match reports whether the topic matches the filter. Topics starting with "$" only match filters starting with
+// "$" too.
+func Match(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") != strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i == len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
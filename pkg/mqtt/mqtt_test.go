@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Writes the packet and reads it back.
+func roundTrip(t *testing.T, p *Packet) *Packet {
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write packet: %s", err)
+	}
+
+	read, err := ReadPacket(bufio.NewReader(&buf), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to read packet: %s", err)
+	}
+
+	return read
+}
+
+func TestReadPacketSizes(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 300000} {
+		p := roundTrip(t, &Packet{Type: TypePublish, Flags: 0x03, Body: make([]byte, size)})
+		if p.Type != TypePublish || p.Flags != 0x03 || len(p.Body) != size {
+			t.Fatalf("expected a publish packet of %d bytes, but got type %d with %d bytes", size, p.Type, len(p.Body))
+		}
+	}
+
+	var buf bytes.Buffer
+	(&Packet{Type: TypePublish, Body: make([]byte, 100)}).WriteTo(&buf)
+	if _, err := ReadPacket(bufio.NewReader(&buf), 99); err != ErrTooLarge {
+		t.Fatalf("expected %v, but got %v", ErrTooLarge, err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		connect := &Connect{
+			Version:     version,
+			CleanStart:  true,
+			KeepAlive:   30,
+			ClientID:    "device",
+			HasWill:     true,
+			WillTopic:   "devices/device",
+			WillPayload: []byte("gone"),
+			WillQoS:     1,
+			Username:    "user",
+			Password:    "key:secret",
+			HasUsername: true,
+			HasPassword: true,
+		}
+
+		if version == Version5 {
+			connect.Properties = Properties{{ID: PropertySessionExpiry, Value: uint32(60)}, {ID: PropertyUserProperty, Value: UserProperty{Key: "k", Value: "v"}}}
+		}
+
+		decoded, err := DecodeConnect(roundTrip(t, connect.Encode()).Body)
+		if err != nil {
+			t.Fatalf("failed to decode connect: %s", err)
+		}
+
+		if !reflect.DeepEqual(decoded, connect) {
+			t.Fatalf("expected %+v, but got %+v", connect, decoded)
+		}
+	}
+
+	decoded, err := DecodeConnect((&Connect{Version: 3}).Encode().Body)
+	if err != nil || decoded.Version != 3 {
+		t.Fatalf("expected the unsupported version to be decoded, but got %+v (%v)", decoded, err)
+	}
+
+	if _, err := DecodeConnect([]byte{0, 4, 'M', 'Q'}); err != ErrMalformed {
+		t.Fatalf("expected %v, but got %v", ErrMalformed, err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		publish := &Publish{Topic: "a/b", QoS: 1, Dup: true, PacketID: 7, Payload: []byte(`{"x":1}`)}
+		if version == Version5 {
+			publish.Properties = Properties{{ID: PropertyUserProperty, Value: UserProperty{Key: "event", Value: "reading"}}}
+		}
+
+		decoded, err := DecodePublish(version, roundTrip(t, publish.Encode(version)))
+		if err != nil {
+			t.Fatalf("failed to decode publish: %s", err)
+		}
+
+		if !reflect.DeepEqual(decoded, publish) {
+			t.Fatalf("expected %+v, but got %+v", publish, decoded)
+		}
+	}
+
+	if _, err := DecodePublish(Version5, &Packet{Type: TypePublish, Body: []byte{0, 1, 'a', 5, 0x23}}); err != ErrMalformed {
+		t.Fatalf("expected %v for truncated properties, but got %v", ErrMalformed, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		subscribe := &Subscribe{PacketID: 3, Subscriptions: []Subscription{{Filter: "a/+", QoS: 1}, {Filter: "#"}}}
+		decoded, err := DecodeSubscribe(version, roundTrip(t, subscribe.Encode(version)))
+		if err != nil || !reflect.DeepEqual(decoded, subscribe) {
+			t.Fatalf("expected %+v, but got %+v (%v)", subscribe, decoded, err)
+		}
+
+		packetID, codes, err := DecodeSuback(version, roundTrip(t, EncodeSuback(version, 3, []byte{0, 0x80})))
+		if err != nil || packetID != 3 || !bytes.Equal(codes, []byte{0, 0x80}) {
+			t.Fatalf("expected suback 3 with codes [0 128], but got %d with %v (%v)", packetID, codes, err)
+		}
+
+		unsubscribe := &Unsubscribe{PacketID: 4, Filters: []string{"a/+"}}
+		decodedUnsubscribe, err := DecodeUnsubscribe(version, roundTrip(t, unsubscribe.Encode(version)))
+		if err != nil || !reflect.DeepEqual(decodedUnsubscribe, unsubscribe) {
+			t.Fatalf("expected %+v, but got %+v (%v)", unsubscribe, decodedUnsubscribe, err)
+		}
+	}
+
+	if _, err := DecodeSubscribe(Version311, &Packet{Type: TypeSubscribe, Flags: 0x02, Body: []byte{0, 1}}); err != ErrMalformed {
+		t.Fatalf("expected %v without subscriptions, but got %v", ErrMalformed, err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	packetID, code, err := DecodeAck(Version5, roundTrip(t, EncodeAck(Version5, TypePuback, 9, 0x87, nil)))
+	if err != nil || packetID != 9 || code != 0x87 {
+		t.Fatalf("expected puback 9 with code %d, but got %d with %d (%v)", 0x87, packetID, code, err)
+	}
+
+	if p := EncodeAck(Version5, TypePuback, 9, 0, nil); len(p.Body) != 2 {
+		t.Fatalf("expected the success code to be left out, but got %v", p.Body)
+	}
+
+	code, properties, err := DecodeConnack(Version5, roundTrip(t, EncodeConnack(Version5, 0x86, Properties{{ID: PropertyReasonString, Value: "invalid key"}})))
+	if err != nil || code != 0x86 || properties.Get(PropertyReasonString) != "invalid key" {
+		t.Fatalf("expected connack %d with a reason, but got %d with %v (%v)", 0x86, code, properties, err)
+	}
+
+	if p := EncodeDisconnect(Version311, 0x8b, ""); p != nil {
+		t.Fatalf("expected no disconnect before MQTT 5, but got %v", p)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/a", false},
+		{"+", "a", true},
+		{"a/+", "a", false},
+	}
+
+	for _, test := range tests {
+		if match := Match(test.filter, test.topic); match != test.match {
+			t.Fatalf("expected %s matching %s to be %v, but got %v", test.filter, test.topic, test.match, match)
+		}
+	}
+
+	for _, filter := range []string{"a/#/b", "a+", "a/b#", ""} {
+		if ValidFilter(filter) {
+			t.Fatalf("expected %q to be an invalid filter", filter)
+		}
+	}
+
+	if !ValidTopic("a/b") || ValidTopic("a/+") || ValidTopic("") {
+		t.Fatalf("expected only a/b to be a valid topic")
+	}
+}
@@ -0,0 +1,192 @@
+package mqtt
+
+// Identifiers of the MQTT 5 properties.
+const (
+	PropertyPayloadFormat                 = 0x01
+	PropertyMessageExpiry                 = 0x02
+	PropertyContentType                   = 0x03
+	PropertyResponseTopic                 = 0x08
+	PropertyCorrelationData               = 0x09
+	PropertySubscriptionIdentifier        = 0x0b
+	PropertySessionExpiry                 = 0x11
+	PropertyAssignedClientID              = 0x12
+	PropertyServerKeepAlive               = 0x13
+	PropertyAuthenticationMethod          = 0x15
+	PropertyAuthenticationData            = 0x16
+	PropertyRequestProblemInformation     = 0x17
+	PropertyWillDelay                     = 0x18
+	PropertyRequestResponseInformation    = 0x19
+	PropertyResponseInformation           = 0x1a
+	PropertyServerReference               = 0x1c
+	PropertyReasonString                  = 0x1f
+	PropertyReceiveMaximum                = 0x21
+	PropertyTopicAliasMaximum             = 0x22
+	PropertyTopicAlias                    = 0x23
+	PropertyMaximumQoS                    = 0x24
+	PropertyRetainAvailable               = 0x25
+	PropertyUserProperty                  = 0x26
+	PropertyMaximumPacketSize             = 0x27
+	PropertyWildcardSubscriptionAvailable = 0x28
+	PropertySubscriptionIDAvailable       = 0x29
+	PropertySharedSubscriptionAvailable   = 0x2a
+)
+
+// Kinds of values of the properties.
+const (
+	kindByte = iota + 1
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindStringPair
+)
+
+var propertyKinds = map[byte]int{
+	PropertyPayloadFormat:                 kindByte,
+	PropertyMessageExpiry:                 kindUint32,
+	PropertyContentType:                   kindString,
+	PropertyResponseTopic:                 kindString,
+	PropertyCorrelationData:               kindBinary,
+	PropertySubscriptionIdentifier:        kindVarint,
+	PropertySessionExpiry:                 kindUint32,
+	PropertyAssignedClientID:              kindString,
+	PropertyServerKeepAlive:               kindUint16,
+	PropertyAuthenticationMethod:          kindString,
+	PropertyAuthenticationData:            kindBinary,
+	PropertyRequestProblemInformation:     kindByte,
+	PropertyWillDelay:                     kindUint32,
+	PropertyRequestResponseInformation:    kindByte,
+	PropertyResponseInformation:           kindString,
+	PropertyServerReference:               kindString,
+	PropertyReasonString:                  kindString,
+	PropertyReceiveMaximum:                kindUint16,
+	PropertyTopicAliasMaximum:             kindUint16,
+	PropertyTopicAlias:                    kindUint16,
+	PropertyMaximumQoS:                    kindByte,
+	PropertyRetainAvailable:               kindByte,
+	PropertyUserProperty:                  kindStringPair,
+	PropertyMaximumPacketSize:             kindUint32,
+	PropertyWildcardSubscriptionAvailable: kindByte,
+	PropertySubscriptionIDAvailable:       kindByte,
+	PropertySharedSubscriptionAvailable:   kindByte,
+}
+
+// Property of an MQTT 5 packet. Its value is a byte, uint16, uint32, int (variable byte integers), string, []byte or
+// UserProperty depending on the identifier.
+type Property struct {
+	ID    byte
+	Value interface{}
+}
+
+// UserProperty is a key and value property defined by the application, a packet can have many with the same key.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of an MQTT 5 packet, in order.
+type Properties []Property
+
+// Get returns the value of the first property with the identifier, nil if there's none.
+func (p Properties) Get(id byte) interface{} {
+	for _, property := range p {
+		if property.ID == id {
+			return property.Value
+		}
+	}
+
+	return nil
+}
+
+// User returns the value of the first user property with the key, false if there's none.
+func (p Properties) User(key string) (string, bool) {
+	for _, property := range p {
+		if user, ok := property.Value.(UserProperty); ok && property.ID == PropertyUserProperty && user.Key == key {
+			return user.Value, true
+		}
+	}
+
+	return "", false
+}
+
+func (d *decoder) properties() Properties {
+	size := d.varint()
+	properties := &decoder{buf: d.bytes(size)}
+	if d.err != nil {
+		return nil
+	}
+
+	var p Properties
+	for len(properties.buf) > 0 {
+		id := properties.byte()
+
+		var value interface{}
+		switch propertyKinds[id] {
+		case kindByte:
+			value = properties.byte()
+
+		case kindUint16:
+			value = properties.uint16()
+
+		case kindUint32:
+			value = properties.uint32()
+
+		case kindVarint:
+			value = properties.varint()
+
+		case kindString:
+			value = properties.string()
+
+		case kindBinary:
+			value = properties.binary()
+
+		case kindStringPair:
+			value = UserProperty{Key: properties.string(), Value: properties.string()}
+
+		default:
+			properties.fail()
+		}
+
+		if properties.err != nil {
+			d.err = properties.err
+			return nil
+		}
+
+		p = append(p, Property{ID: id, Value: value})
+	}
+
+	return p
+}
+
+// appendTo appends the length of the properties followed by the properties.
+func (p Properties) appendTo(buf []byte) []byte {
+	var encoded []byte
+	for _, property := range p {
+		encoded = append(encoded, property.ID)
+		switch value := property.Value.(type) {
+		case byte:
+			encoded = append(encoded, value)
+
+		case uint16:
+			encoded = appendUint16(encoded, value)
+
+		case uint32:
+			encoded = append(encoded, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+
+		case int:
+			encoded = appendVarint(encoded, value)
+
+		case string:
+			encoded = appendString(encoded, value)
+
+		case []byte:
+			encoded = appendString(encoded, string(value))
+
+		case UserProperty:
+			encoded = appendString(appendString(encoded, value.Key), value.Value)
+		}
+	}
+
+	return append(appendVarint(buf, len(encoded)), encoded...)
+}
@@ -0,0 +1,124 @@
+// Package origins checks the origin of browser requests against the origins allowed by apps, so the keys and tokens
+// of an app can't be used from other sites.
+package origins
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/models"
+	"gorm.io/gorm"
+)
+
+// How long the allowed origins of an app are cached before being loaded again, this is how long it takes for a
+// change made through the admin API to be picked up by every server.
+const cacheTTL = 30 * time.Second
+
+type cacheEntry struct {
+	origins   []models.AllowedOrigin
+	expiresAt time.Time
+}
+
+// Store loads the allowed origins of apps and caches them.
+type Store struct {
+	db    *gorm.DB
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+// NewStore returns an initialized Store.
+func NewStore(db *gorm.DB) *Store {
+	return &Store{
+		db:    db,
+		cache: make(map[string]*cacheEntry),
+	}
+}
+
+// ForApp returns the origins allowed by the app.
+func (s *Store) ForApp(ctx context.Context, appID string) ([]models.AllowedOrigin, error) {
+	return s.appOrigins(ctx, appID)
+}
+
+// Invalidate drops the cached origins of the app so they're loaded again on the next lookup.
+func (s *Store) Invalidate(appID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, appID)
+}
+
+func (s *Store) appOrigins(ctx context.Context, appID string) ([]models.AllowedOrigin, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[appID]
+	s.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.origins, nil
+	}
+
+	var origins []models.AllowedOrigin
+	if result := s.db.WithContext(ctx).Find(&origins, "app_id = ?", appID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	s.mu.Lock()
+	s.cache[appID] = &cacheEntry{origins: origins, expiresAt: time.Now().Add(cacheTTL)}
+	s.mu.Unlock()
+
+	return origins, nil
+}
+
+// Allowed reports whether the origin is allowed. Apps without allowed origins allow any origin and requests without
+// an origin aren't made by browsers so they're always allowed.
+func Allowed(allowed []models.AllowedOrigin, origin string) bool {
+	return origin == "" || len(allowed) == 0 || Match(allowed, origin)
+}
+
+// Match reports whether any of the allowed origins matches the origin, an allowed origin like "https://*.example.com"
+// matches the subdomains of example.com with the same scheme and port but not example.com itself.
+func Match(allowed []models.AllowedOrigin, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowedOrigin := range allowed {
+		if allowedOrigin.Origin == origin {
+			return true
+		}
+
+		scheme, host, ok := strings.Cut(allowedOrigin.Origin, "://*.")
+		if !ok {
+			continue
+		}
+
+		prefix := scheme + "://"
+		suffix := "." + host
+		if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) || len(origin) < len(prefix)+len(suffix) {
+			continue
+		}
+
+		subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+		if subdomain != "" && !strings.ContainsAny(subdomain, "/:@") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Normalize validates the origin and returns it the way browsers send it, lowercased and without a trailing slash.
+func Normalize(origin string) (string, error) {
+	origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("invalid origin, must be like https://example.com or https://*.example.com")
+	}
+
+	if u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || strings.Contains(u.Host, "*") {
+		return "", errors.New("invalid origin, must be a scheme and a host with an optional port")
+	}
+
+	return origin, nil
+}
@@ -0,0 +1,52 @@
+package origins
+
+import (
+	"testing"
+
+	"github.com/gmencz/mycelium/pkg/models"
+)
+
+func TestMatch(t *testing.T) {
+	allowed := []models.AllowedOrigin{
+		{Origin: "https://example.com"},
+		{Origin: "https://*.example.org"},
+		{Origin: "http://*.localhost:3000"},
+	}
+
+	tests := []struct {
+		origin string
+		match  bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"http://example.com", false},
+		{"https://app.example.com", false},
+		{"https://app.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"https://app.example.org:8443", false},
+		{"http://app.localhost:3000", true},
+		{"http://app.localhost", false},
+	}
+
+	for _, test := range tests {
+		if match := Match(allowed, test.origin); match != test.match {
+			t.Fatalf("expected origin %s to match %t, but got %t", test.origin, test.match, match)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, origin := range []string{"https://Example.com/", "https://*.example.com", "http://localhost:3000"} {
+		if _, err := Normalize(origin); err != nil {
+			t.Fatalf("expected origin %s to be valid, but got %s", origin, err)
+		}
+	}
+
+	for _, origin := range []string{"example.com", "ftp://example.com", "https://example.com/path", "https://a.*.example.com", "https://user@example.com", "*"} {
+		if _, err := Normalize(origin); err == nil {
+			t.Fatalf("expected origin %s to be invalid", origin)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package protocol
 
+import "github.com/gmencz/mycelium/pkg/jsonpatch"
+
 // Message types.
 const (
 	MessageTypeHello = "hello" // Server -> client on successful connection.
@@ -14,6 +16,7 @@ const (
 
 	MessageTypePublish        = "publish"         // Client -> server when wanting to unsubscribe from a channel.
 	MessageTypePublishSuccess = "publish_success" // Server -> client after a successful publish.
+	MessageTypePublishDelta   = "publish_delta"   // Server -> client instead of "publish" on channels subscribed to with deltas.
 
 	MessageTypeSituationListen        = "situation_listen"         // Client -> server when wanting to listen to the situation of channels.
 	MessageTypeSituationListenSuccess = "situation_listen_success" // Server -> client after a situation listen.
@@ -22,6 +25,30 @@ const (
 	MessageTypeSituationUnlistenSuccess = "situation_unlisten_success" // Server -> client after a situation unlisten.
 
 	MessageTypeSituationChange = "situation_change" // Server -> client after a situation change.
+
+	MessageTypePresenceEnter        = "presence_enter"         // Client -> server when wanting to enter the presence set of a channel.
+	MessageTypePresenceEnterSuccess = "presence_enter_success" // Server -> client after entering the presence set of a channel.
+
+	MessageTypePresenceLeave        = "presence_leave"         // Client -> server when wanting to leave the presence set of a channel.
+	MessageTypePresenceLeaveSuccess = "presence_leave_success" // Server -> client after leaving the presence set of a channel.
+
+	MessageTypePresenceChange = "presence_change" // Server -> client after a member enters or leaves the presence set of a channel.
+
+	MessageTypeOccupancyListen        = "occupancy_listen"         // Client -> server when wanting to listen to the occupancy of channels.
+	MessageTypeOccupancyListenSuccess = "occupancy_listen_success" // Server -> client after an occupancy listen.
+
+	MessageTypeOccupancyUnlisten        = "occupancy_unlisten"         // Client -> server when wanting to unlisten to the occupancy of channels.
+	MessageTypeOccupancyUnlistenSuccess = "occupancy_unlisten_success" // Server -> client after an occupancy unlisten.
+
+	MessageTypeOccupancy = "occupancy" // Server -> client after the occupancy of a channel changes, at most once per second per channel.
+
+	MessageTypeReconnect = "reconnect" // Server -> client before closing the connection when the server is shutting down.
+)
+
+// Presence actions.
+const (
+	PresenceActionEnter = "enter"
+	PresenceActionLeave = "leave"
 )
 
 // Server <-> client message.
@@ -39,6 +66,8 @@ type HelloMessageData struct {
 type SubscribeMessageData struct {
 	SequenceNumber int64  `json:"s"`
 	Channel        string `json:"c"`
+	History        bool   `json:"h"`  // Replay the persisted history of the channel after subscribing.
+	Delta          bool   `json:"dt"` // Receive messages as patches against the previous message of the channel.
 }
 
 // Data of messages of type "unsubscribe".
@@ -52,11 +81,17 @@ type ErrorMessage struct {
 	SequenceNumber int64  `json:"s"`
 	Type           string `json:"t"`
 	Reason         string `json:"r"`
+	Code           string `json:"c,omitempty"` // One of ErrorCode*, for errors clients can handle.
 }
 
+// The message was rejected because the client, the channel or the app sent too many messages, it can be retried
+// later.
+const ErrorCodeRateLimited = "rate_limited"
+
 // Data of messages of type "subscribe_success".
 type SubscribeSuccessMessageData struct {
 	SequenceNumber int64 `json:"s"`
+	Delta          bool  `json:"dt,omitempty"` // Messages of the channel will be sent as deltas.
 }
 
 // Data of messages of type "publish_success".
@@ -76,10 +111,19 @@ type PublishMessageData struct {
 	Data    interface{} `json:"d"`
 }
 
+// Data of messages of type "publish_delta". The patch (RFC 6902) turns the data of the previous message received on
+// the channel into the data of this one. Every few messages and whenever a delta can't be applied, e.g. for the first
+// message after subscribing, a "publish" message with the whole data is sent instead.
+type PublishDeltaMessageData struct {
+	Channel string                `json:"c"`
+	Event   string                `json:"e"`
+	Patch   []jsonpatch.Operation `json:"p"`
+}
+
 // Data data of messages of type "publish".
 type PublishMessageDataData struct {
 	SequenceNumber   int64       `json:"s"`
-	IncludePublisher bool        `json:"ip"`
+	IncludePublisher *bool       `json:"ip"` // When omitted, the echo_publisher rule of the channel is used.
 	Channel          string      `json:"c"`
 	Event            string      `json:"e"`
 	Data             interface{} `json:"d"`
@@ -113,6 +157,74 @@ type SituationChangeMessageData struct {
 	Situation string `json:"s"`
 }
 
+// Data of messages of type "presence_enter".
+type PresenceEnterMessageData struct {
+	SequenceNumber int64       `json:"s"`
+	Channel        string      `json:"c"`
+	Data           interface{} `json:"d"`
+}
+
+// Data of messages of type "presence_leave".
+type PresenceLeaveMessageData struct {
+	SequenceNumber int64  `json:"s"`
+	Channel        string `json:"c"`
+}
+
+// Data of messages of type "presence_enter_success".
+type PresenceEnterSuccessMessageData struct {
+	SequenceNumber int64 `json:"s"`
+}
+
+// Data of messages of type "presence_leave_success".
+type PresenceLeaveSuccessMessageData struct {
+	SequenceNumber int64 `json:"s"`
+}
+
+// Data of messages of type "presence_change".
+type PresenceChangeMessageData struct {
+	Channel   string      `json:"c"`
+	Action    string      `json:"a"`
+	SessionID string      `json:"sid"`
+	Data      interface{} `json:"d,omitempty"`
+}
+
+// Data of messages of type "occupancy_listen".
+type OccupancyListenMessageData struct {
+	SequenceNumber int64  `json:"s"`
+	ChannelPrefix  string `json:"cp"`
+}
+
+// Data of messages of type "occupancy_unlisten".
+type OccupancyUnlistenMessageData struct {
+	SequenceNumber int64  `json:"s"`
+	ChannelPrefix  string `json:"cp"`
+}
+
+// Data of messages of type "occupancy_listen_success".
+type OccupancyListenSuccessMessageData struct {
+	SequenceNumber int64 `json:"s"`
+}
+
+// Data of messages of type "occupancy_unlisten_success".
+type OccupancyUnlistenSuccessMessageData struct {
+	SequenceNumber int64 `json:"s"`
+}
+
+// Data of messages of type "occupancy".
+type OccupancyMessageData struct {
+	Channel         string `json:"c"`
+	Subscribers     int64  `json:"sc"`
+	Publishers      int64  `json:"pc"`
+	PresenceMembers int64  `json:"pmc"`
+}
+
+// Data of messages of type "reconnect". Clients should wait the delay plus a random part of the jitter (both in
+// milliseconds) before reconnecting, so they don't all reconnect to the other servers at once.
+type ReconnectMessageData struct {
+	Delay  int64 `json:"dl"`
+	Jitter int64 `json:"j"`
+}
+
 // Returns a message with the data of messages of type "hello".
 func NewHelloMessage(data *HelloMessageData) *Message {
 	return &Message{
@@ -153,6 +265,14 @@ func NewPublishMessage(data *PublishMessageData) *Message {
 	}
 }
 
+// Returns a message with the data of messages of type "publish_delta".
+func NewPublishDeltaMessage(data *PublishDeltaMessageData) *Message {
+	return &Message{
+		Type: MessageTypePublishDelta,
+		Data: data,
+	}
+}
+
 // Returns a message with the data of messages of type "situation_change".
 func NewSituationChangeMessage(data *SituationChangeMessageData) *Message {
 	return &Message{
@@ -176,3 +296,59 @@ func NewSituationUnlistenSuccessMessage(data *SituationUnlistenSuccessMessageDat
 		Data: data,
 	}
 }
+
+// Returns a message with the data of messages of type "presence_enter_success".
+func NewPresenceEnterSuccessMessage(data *PresenceEnterSuccessMessageData) *Message {
+	return &Message{
+		Type: MessageTypePresenceEnterSuccess,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "presence_leave_success".
+func NewPresenceLeaveSuccessMessage(data *PresenceLeaveSuccessMessageData) *Message {
+	return &Message{
+		Type: MessageTypePresenceLeaveSuccess,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "presence_change".
+func NewPresenceChangeMessage(data *PresenceChangeMessageData) *Message {
+	return &Message{
+		Type: MessageTypePresenceChange,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "occupancy_listen_success".
+func NewOccupancyListenSuccessMessage(data *OccupancyListenSuccessMessageData) *Message {
+	return &Message{
+		Type: MessageTypeOccupancyListenSuccess,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "occupancy_unlisten_success".
+func NewOccupancyUnlistenSuccessMessage(data *OccupancyUnlistenSuccessMessageData) *Message {
+	return &Message{
+		Type: MessageTypeOccupancyUnlistenSuccess,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "occupancy".
+func NewOccupancyMessage(data *OccupancyMessageData) *Message {
+	return &Message{
+		Type: MessageTypeOccupancy,
+		Data: data,
+	}
+}
+
+// Returns a message with the data of messages of type "reconnect".
+func NewReconnectMessage(data *ReconnectMessageData) *Message {
+	return &Message{
+		Type: MessageTypeReconnect,
+		Data: data,
+	}
+}
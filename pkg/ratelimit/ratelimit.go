@@ -0,0 +1,54 @@
+// Package ratelimit implements token buckets, which allow bursts of up to a number of events and refill at a steady
+// rate, so bursty but well behaved clients aren't punished the way they are by fixed windows.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Bucket is a token bucket, it's not safe for concurrent use.
+type Bucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// NewBucket returns a full bucket of burst tokens refilling at perSecond tokens per second.
+func NewBucket(perSecond float64, burst float64) *Bucket {
+	return &Bucket{perSecond: perSecond, burst: burst, tokens: burst}
+}
+
+// Allow takes a token from the bucket at the time, returning false if it's empty.
+func (b *Bucket) Allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Return puts back a token taken from the bucket at the time, without going over the burst.
+func (b *Bucket) Return(now time.Time) {
+	b.refill(now)
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// Idle reports whether the bucket would be full at the time, so it can be forgotten.
+func (b *Bucket) Idle(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.perSecond >= b.burst
+}
+
+// Adds the tokens refilled up to the time.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.perSecond)
+	}
+
+	if now.After(b.last) {
+		b.last = now
+	}
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow(now) {
+			t.Fatalf("expected the burst to be allowed, but event %d was rejected", i)
+		}
+	}
+
+	if b.Allow(now) {
+		t.Fatalf("expected an empty bucket to reject events")
+	}
+
+	// 10 tokens per second refill one every 100ms.
+	if !b.Allow(now.Add(100 * time.Millisecond)) {
+		t.Fatalf("expected a token after %s", 100*time.Millisecond)
+	}
+
+	if b.Allow(now.Add(150 * time.Millisecond)) {
+		t.Fatalf("expected no token after %s", 150*time.Millisecond)
+	}
+
+	if !b.Idle(now.Add(time.Second)) {
+		t.Fatalf("expected the bucket to be full after %s", time.Second)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow(now.Add(time.Hour)) {
+			t.Fatalf("expected the bucket to refill up to the burst, but event %d was rejected", i)
+		}
+	}
+
+	if b.Allow(now.Add(time.Hour)) {
+		t.Fatalf("expected the bucket to refill up to the burst only")
+	}
+}
@@ -0,0 +1,107 @@
+package rules
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// How long the rules of an app are cached before being loaded again, this is how long it takes for a change made
+// through the admin API to be picked up by every server.
+const cacheTTL = 30 * time.Second
+
+type cacheEntry struct {
+	rules     []models.ChannelRule
+	expiresAt time.Time
+}
+
+// Store loads the channel rules of apps and caches them.
+type Store struct {
+	db    *gorm.DB
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+// NewStore returns an initialized Store.
+func NewStore(db *gorm.DB) *Store {
+	return &Store{
+		db:    db,
+		cache: make(map[string]*cacheEntry),
+	}
+}
+
+// ForChannel returns the rule that applies to the channel of the app, or nil if no rule applies to it.
+func (s *Store) ForChannel(ctx context.Context, appID string, channel string) (*models.ChannelRule, error) {
+	rules, err := s.appRules(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+
+	return Find(rules, channel), nil
+}
+
+// Invalidate drops the cached rules of the app so they're loaded again on the next lookup.
+func (s *Store) Invalidate(appID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, appID)
+}
+
+func (s *Store) appRules(ctx context.Context, appID string) ([]models.ChannelRule, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[appID]
+	s.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.rules, nil
+	}
+
+	var rules []models.ChannelRule
+	if result := s.db.WithContext(ctx).Find(&rules, "app_id = ?", appID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	s.mu.Lock()
+	s.cache[appID] = &cacheEntry{rules: rules, expiresAt: time.Now().Add(cacheTTL)}
+	s.mu.Unlock()
+
+	return rules, nil
+}
+
+// Find returns the rule that applies to the channel. A rule for the exact channel name wins over prefix rules and
+// longer prefixes win over shorter ones.
+func Find(rules []models.ChannelRule, channel string) *models.ChannelRule {
+	var found *models.ChannelRule
+
+	for i := range rules {
+		rule := &rules[i]
+		if !common.MatchChannelPattern(rule.Pattern, channel) {
+			continue
+		}
+
+		if rule.Pattern == channel {
+			return rule
+		}
+
+		if found == nil || len(rule.Pattern) > len(found.Pattern) {
+			found = rule
+		}
+	}
+
+	return found
+}
+
+// AllowsEvent reports whether the rule allows publishing the event.
+func AllowsEvent(rule *models.ChannelRule, event string) bool {
+	if rule.AllowedEvents == "" {
+		return true
+	}
+
+	return slices.Contains(strings.Split(rule.AllowedEvents, ","), event)
+}
@@ -0,0 +1,188 @@
+package schemas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/xeipuuv/gojsonschema"
+	"gorm.io/gorm"
+)
+
+// How long the schemas of an app are cached before being loaded again, this is how long it takes for a change made
+// through the admin API to be picked up by every server.
+const cacheTTL = 30 * time.Second
+
+type compiledSchema struct {
+	channelSchema models.ChannelSchema
+	schema        *gojsonschema.Schema
+}
+
+type cacheEntry struct {
+	schemas   []compiledSchema
+	expiresAt time.Time
+}
+
+// Store loads the channel schemas of apps, compiles them and caches them.
+type Store struct {
+	db    *gorm.DB
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+// NewStore returns an initialized Store.
+func NewStore(db *gorm.DB) *Store {
+	return &Store{
+		db:    db,
+		cache: make(map[string]*cacheEntry),
+	}
+}
+
+// Compile compiles a JSON Schema, it's used to validate schemas before saving them. Only references within the schema
+// itself are allowed so schemas can't make the server read files or make requests.
+func Compile(schema string) (*gojsonschema.Schema, error) {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		return nil, errors.New("the schema is not valid JSON")
+	}
+
+	if hasExternalRef(parsed) {
+		return nil, errors.New("the schema can only contain references within itself")
+	}
+
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(parsed))
+}
+
+func hasExternalRef(v interface{}) bool {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if ref, ok := child.(string); ok && k == "$ref" && !strings.HasPrefix(ref, "#") {
+				return true
+			}
+
+			if hasExternalRef(child) {
+				return true
+			}
+		}
+
+	case []interface{}:
+		for _, child := range value {
+			if hasExternalRef(child) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Validate validates the data of an event published on the channel of the app against the schema that applies to it,
+// if any. When the data doesn't conform to the schema, reason describes why.
+func (s *Store) Validate(ctx context.Context, appID string, channel string, event string, data interface{}) (valid bool, reason string, err error) {
+	schemas, err := s.appSchemas(ctx, appID)
+	if err != nil {
+		return false, "", err
+	}
+
+	found := find(schemas, channel, event)
+	if found == nil {
+		return true, "", nil
+	}
+
+	result, err := found.schema.Validate(gojsonschema.NewGoLoader(data))
+	if err != nil {
+		return false, "", err
+	}
+
+	if result.Valid() {
+		return true, "", nil
+	}
+
+	reasons := make([]string, 0, len(result.Errors()))
+	for _, resultErr := range result.Errors() {
+		reasons = append(reasons, resultErr.String())
+	}
+
+	return false, strings.Join(reasons, "; "), nil
+}
+
+// Invalidate drops the cached schemas of the app so they're loaded again on the next validation.
+func (s *Store) Invalidate(appID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, appID)
+}
+
+func (s *Store) appSchemas(ctx context.Context, appID string) ([]compiledSchema, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[appID]
+	s.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.schemas, nil
+	}
+
+	var channelSchemas []models.ChannelSchema
+	if result := s.db.WithContext(ctx).Find(&channelSchemas, "app_id = ?", appID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	schemas := make([]compiledSchema, 0, len(channelSchemas))
+	for _, channelSchema := range channelSchemas {
+		schema, err := Compile(channelSchema.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("compiling schema %s: %w", channelSchema.ID, err)
+		}
+
+		schemas = append(schemas, compiledSchema{channelSchema: channelSchema, schema: schema})
+	}
+
+	s.mu.Lock()
+	s.cache[appID] = &cacheEntry{schemas: schemas, expiresAt: time.Now().Add(cacheTTL)}
+	s.mu.Unlock()
+
+	return schemas, nil
+}
+
+// find returns the schema that applies to the event on the channel. Schemas for the exact channel name win over
+// prefix schemas, longer prefixes win over shorter ones and schemas for the event win over schemas for every event.
+func find(schemas []compiledSchema, channel string, event string) *compiledSchema {
+	var found *compiledSchema
+
+	for i := range schemas {
+		schema := &schemas[i]
+		if !common.MatchChannelPattern(schema.channelSchema.Pattern, channel) {
+			continue
+		}
+
+		if schema.channelSchema.Event != "" && schema.channelSchema.Event != event {
+			continue
+		}
+
+		if found == nil || moreSpecific(schema.channelSchema, found.channelSchema, channel) {
+			found = schema
+		}
+	}
+
+	return found
+}
+
+func moreSpecific(a models.ChannelSchema, b models.ChannelSchema, channel string) bool {
+	aExact, bExact := a.Pattern == channel, b.Pattern == channel
+	if aExact != bExact {
+		return aExact
+	}
+
+	if len(a.Pattern) != len(b.Pattern) {
+		return len(a.Pattern) > len(b.Pattern)
+	}
+
+	return a.Event != "" && b.Event == ""
+}
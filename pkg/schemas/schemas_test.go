@@ -0,0 +1,58 @@
+package schemas
+
+import (
+	"testing"
+
+	"github.com/gmencz/mycelium/pkg/models"
+)
+
+func TestCompileRejectsExternalRefs(t *testing.T) {
+	if _, err := Compile(`{"properties": {"a": {"$ref": "file:///etc/passwd"}}}`); err == nil {
+		t.Fatalf("expected schema with an external reference to be rejected")
+	}
+
+	if _, err := Compile(`{"definitions": {"a": {"type": "string"}}, "properties": {"a": {"$ref": "#/definitions/a"}}}`); err != nil {
+		t.Fatalf("expected schema with an internal reference to compile, but got %s", err)
+	}
+}
+
+func TestFindMostSpecificSchema(t *testing.T) {
+	compile := func(pattern string, event string) compiledSchema {
+		schema, err := Compile(`{"type": "object"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return compiledSchema{channelSchema: models.ChannelSchema{Pattern: pattern, Event: event}, schema: schema}
+	}
+
+	schemas := []compiledSchema{
+		compile("*", ""),
+		compile("chat-*", ""),
+		compile("chat-*", "message"),
+		compile("chat-general", ""),
+	}
+
+	tests := []struct {
+		channel         string
+		event           string
+		expectedPattern string
+		expectedEvent   string
+	}{
+		{"lobby", "message", "*", ""},
+		{"chat-random", "typing", "chat-*", ""},
+		{"chat-random", "message", "chat-*", "message"},
+		{"chat-general", "message", "chat-general", ""},
+	}
+
+	for _, test := range tests {
+		found := find(schemas, test.channel, test.event)
+		if found == nil {
+			t.Fatalf("expected a schema for %s/%s", test.channel, test.event)
+		}
+
+		if found.channelSchema.Pattern != test.expectedPattern || found.channelSchema.Event != test.expectedEvent {
+			t.Fatalf("expected %s/%s to use schema %q/%q, but got %q/%q", test.channel, test.event, test.expectedPattern, test.expectedEvent, found.channelSchema.Pattern, found.channelSchema.Event)
+		}
+	}
+}
@@ -0,0 +1,1008 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/config"
+	"github.com/gmencz/mycelium/pkg/harness"
+	"github.com/gmencz/mycelium/pkg/integrations"
+	"github.com/gmencz/mycelium/pkg/jsonpatch"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/mqtt"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+var allCapabilities = map[string]string{"*": "*"}
+
+func TestAuthFailures(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"no credentials", url.Values{}},
+		{"key and token", url.Values{"key": {key}, "token": {"token"}}},
+		{"unknown key", url.Values{"key": {"unknown:secret"}}},
+		{"wrong secret", url.Values{"key": {key + "wrong"}}},
+		{"malformed key", url.Values{"key": {"malformed"}}},
+		{"malformed token", url.Values{"token": {"malformed"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := h.Dial(test.query)
+			if err != nil {
+				t.Fatalf("failed to connect: %s", err)
+			}
+
+			c.ExpectClose(4001)
+		})
+	}
+}
+
+func TestSubscribePublishUnsubscribe(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	subscriber := h.Connect(key)
+	publisher := h.Connect(key)
+
+	subscriber.Subscribe("lobby")
+	publisher.Subscribe("lobby")
+	publisher.Publish("lobby", "greeting", "hello", nil)
+
+	var data protocol.PublishMessageData
+	subscriber.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Channel != "lobby" || data.Event != "greeting" || data.Data != "hello" {
+		t.Fatalf("expected greeting on lobby, but got %+v", data)
+	}
+
+	subscriber.Unsubscribe("lobby")
+	publisher.Publish("lobby", "greeting", "hello", nil)
+	subscriber.ExpectNothing(200 * time.Millisecond)
+}
+
+func TestPublisherExclusion(t *testing.T) {
+	h := harness.Start(t)
+	c := h.Connect(h.CreateKey(allCapabilities))
+	c.Subscribe("lobby")
+
+	// Without a rule the publisher doesn't get its own messages.
+	c.Publish("lobby", "greeting", "hello", nil)
+	c.ExpectNothing(200 * time.Millisecond)
+
+	includePublisher := false
+	c.Publish("lobby", "greeting", "hello", &includePublisher)
+	c.ExpectNothing(200 * time.Millisecond)
+
+	includePublisher = true
+	c.SendPublish("lobby", "greeting", "hello", &includePublisher)
+	c.ExpectAll(protocol.MessageTypePublishSuccess, protocol.MessageTypePublish)
+}
+
+func TestSituationChanges(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	listener := h.Connect(key)
+	listener.SituationListen("game-")
+
+	subscriber := h.Connect(key)
+	subscriber.Subscribe("game-1")
+
+	var data protocol.SituationChangeMessageData
+	listener.Expect(protocol.MessageTypeSituationChange).Decode(&data)
+	if data.Channel != "game-1" || data.Situation != "occupied" {
+		t.Fatalf("expected game-1 to be occupied, but got %+v", data)
+	}
+
+	// Channels without the prefix aren't reported.
+	subscriber.Subscribe("lobby")
+	listener.ExpectNothing(200 * time.Millisecond)
+
+	subscriber.Unsubscribe("game-1")
+	listener.Expect(protocol.MessageTypeSituationChange).Decode(&data)
+	if data.Channel != "game-1" || data.Situation != "vacant" {
+		t.Fatalf("expected game-1 to be vacant, but got %+v", data)
+	}
+}
+
+func TestTooManyMessages(t *testing.T) {
+	cfg := harness.Config()
+	cfg.WebSocket.MaxMessagesPerSecond = 1
+	cfg.WebSocket.MessageBurst = 2
+
+	h := harness.StartWithConfig(t, cfg)
+	c := h.Connect(h.CreateKey(allCapabilities))
+
+	// The burst is allowed, the messages after it are rejected one by one.
+	c.Subscribe("lobby")
+	c.Subscribe("chat")
+	c.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: 3, Channel: "news"})
+
+	message := c.Expect(protocol.MessageTypeError)
+	if message.Code != protocol.ErrorCodeRateLimited || message.SequenceNumber != 3 {
+		t.Fatalf("expected message 3 to be rate limited, but got %+v", message)
+	}
+
+	// Clients that keep sending messages are disconnected.
+	for i := 0; i < 10; i++ {
+		c.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: int64(4 + i), Channel: "news"})
+	}
+
+	c.ExpectClose(4029)
+}
+
+func TestChannelMessagesPerSecond(t *testing.T) {
+	cfg := harness.Config()
+	cfg.WebSocket.ChannelMessagesPerSecond = 1
+
+	h := harness.StartWithConfig(t, cfg)
+	key := h.CreateKey(allCapabilities)
+
+	c := h.Connect(key)
+	c.Subscribe("lobby")
+	c.Publish("lobby", "greeting", "hello", nil)
+
+	c.SendPublish("lobby", "greeting", "hello", nil)
+	if message := c.Expect(protocol.MessageTypeError); message.Code != protocol.ErrorCodeRateLimited {
+		t.Fatalf("expected the message to be rate limited, but got %+v", message)
+	}
+
+	response := h.Request(http.MethodPost, "/channels/lobby/publish", key, map[string]interface{}{"event": "greeting", "data": "hello"})
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, but got %d", http.StatusTooManyRequests, response.StatusCode)
+	}
+
+	// Other channels have their own limit.
+	c.Subscribe("chat")
+	c.Publish("chat", "greeting", "hello", nil)
+}
+
+func TestShutdown(t *testing.T) {
+	cfg := harness.Config()
+	cfg.WebSocket.CloseGracePeriod.Duration = 5 * time.Second
+	cfg.Shutdown.ReconnectDelay.Duration = 2 * time.Second
+	cfg.Shutdown.DrainConcurrency = 4
+
+	h := harness.StartWithConfig(t, cfg)
+	key := h.CreateKey(allCapabilities)
+
+	clients := make([]*harness.Client, 50)
+	for i := range clients {
+		clients[i] = h.Connect(key)
+		clients[i].Subscribe("lobby")
+	}
+
+	// Clients close their connections right away, so draining doesn't wait for the grace period.
+	start := time.Now()
+	h.Close()
+	if elapsed := time.Since(start); elapsed >= cfg.WebSocket.CloseGracePeriod.Duration {
+		t.Fatalf("expected the server to drain in less than %s, but it took %s", cfg.WebSocket.CloseGracePeriod, elapsed)
+	}
+
+	for _, c := range clients {
+		var data protocol.ReconnectMessageData
+		c.Expect(protocol.MessageTypeReconnect).Decode(&data)
+		if data.Delay != 2000 {
+			t.Fatalf("expected a reconnect delay of %d, but got %d", 2000, data.Delay)
+		}
+
+		c.ExpectClose(4009)
+	}
+
+	if _, err := h.Dial(url.Values{"key": {key}}); err == nil {
+		t.Fatalf("expected new connections to fail after closing")
+	}
+
+	occupancy, err := h.Channels.Occupancy(context.Background(), h.AppID+":lobby")
+	if err != nil || occupancy.Subscribers != 0 {
+		t.Fatalf("expected no subscribers left, but got %+v (%v)", occupancy, err)
+	}
+}
+
+func TestGetChannel(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	c := h.Connect(key)
+	c.Subscribe("lobby")
+
+	response := h.Request(http.MethodGet, "/channels/lobby", key, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+
+	var body struct {
+		Occupancy store.Occupancy `json:"occupancy"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || body.Occupancy.Subscribers != 1 {
+		t.Fatalf("expected 1 subscriber, but got %+v (%v)", body.Occupancy, err)
+	}
+}
+
+func TestAdminCapability(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(map[string]string{"*": "subscribe,publish"})
+
+	for _, path := range []string{"/channel-rules", "/channel-schemas", "/webhooks", "/integrations", "/allowed-origins"} {
+		if response := h.Request(http.MethodGet, path, key, nil); response.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status code %d for %s, but got %d", http.StatusForbidden, path, response.StatusCode)
+		}
+	}
+
+	key = h.CreateKey(map[string]string{"*": "admin"})
+	if response := h.Request(http.MethodGet, "/channel-rules", key, nil); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	response := h.Request(http.MethodPost, "/allowed-origins", key, map[string]string{"origin": "https://*.example.com"})
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status code %d, but got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	c, err := h.DialWithHeader(url.Values{"key": {key}}, http.Header{"Origin": {"https://evil.com"}})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	c.ExpectClose(4003)
+
+	c, err = h.DialWithHeader(url.Values{"key": {key}}, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	c.Expect(protocol.MessageTypeHello)
+
+	for origin, statusCode := range map[string]int{"https://evil.com": http.StatusForbidden, "https://app.example.com": http.StatusOK} {
+		request, _ := http.NewRequest(http.MethodGet, h.URL+"/channels?key="+url.QueryEscape(key), nil)
+		request.Header.Set("Origin", origin)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("failed to send request: %s", err)
+		}
+
+		response.Body.Close()
+		if response.StatusCode != statusCode {
+			t.Fatalf("expected status code %d from %s, but got %d", statusCode, origin, response.StatusCode)
+		}
+
+		if statusCode == http.StatusOK && response.Header.Get("Access-Control-Allow-Origin") != origin {
+			t.Fatalf("expected %s to be allowed to read the response, but got %q", origin, response.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *config.Config)
+		closeCode int
+	}{
+		{"server", func(cfg *config.Config) { cfg.WebSocket.MaxConnections = 2 }, 4031},
+		{"app", func(cfg *config.Config) { cfg.WebSocket.MaxConnectionsPerApp = 2 }, 4032},
+		{"ip", func(cfg *config.Config) { cfg.WebSocket.MaxConnectionsPerIP = 2 }, 4033},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := harness.Config()
+			test.configure(cfg)
+
+			h := harness.StartWithConfig(t, cfg)
+			key := h.CreateKey(allCapabilities)
+
+			first := h.Connect(key)
+			h.Connect(key)
+
+			c, err := h.Dial(url.Values{"key": {key}})
+			if err != nil {
+				t.Fatalf("failed to connect: %s", err)
+			}
+
+			c.ExpectClose(test.closeCode)
+
+			// The connection is admitted once another one is closed.
+			first.Close()
+			time.Sleep(100 * time.Millisecond)
+			h.Connect(key)
+		})
+	}
+}
+
+func TestAppConnectionLimit(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	if result := h.DB.Model(&models.App{}).Where("id = ?", h.AppID).Update("max_connections", 1); result.Error != nil {
+		t.Fatalf("failed to update app: %s", result.Error)
+	}
+
+	h.Connect(key)
+
+	c, err := h.Dial(url.Values{"key": {key}})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	c.ExpectClose(4032)
+}
+
+func TestIntegrationsForwardMessages(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	forwarded := make(chan []byte, 10)
+	h.Broker.Subscribe(integrations.Subject(h.AppID, "orders.created"), func(data []byte) { forwarded <- data })
+
+	body := map[string]interface{}{"event": "created", "data": "order"}
+	expectForwarded := func(expected bool) {
+		t.Helper()
+		if response := h.Request(http.MethodPost, "/channels/orders/publish", key, body); response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+		}
+
+		select {
+		case data := <-forwarded:
+			if !expected {
+				t.Fatalf("expected the message not to be forwarded, but got %s", data)
+			}
+
+		case <-time.After(200 * time.Millisecond):
+			if expected {
+				t.Fatalf("expected the message to be forwarded")
+			}
+		}
+	}
+
+	// Messages are only listened to while the app has integrations.
+	expectForwarded(false)
+
+	response := h.Request(http.MethodPost, "/integrations", key, map[string]interface{}{"kind": "nats", "target": "orders.created"})
+	var integration models.Integration
+	if response.StatusCode != http.StatusCreated || json.NewDecoder(response.Body).Decode(&integration) != nil {
+		t.Fatalf("expected status code %d, but got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	expectForwarded(true)
+
+	if response := h.Request(http.MethodDelete, "/integrations/"+integration.ID, key, nil); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d, but got %d", http.StatusNoContent, response.StatusCode)
+	}
+
+	expectForwarded(false)
+}
+
+func TestRESTPublishClientRule(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	clientPublish := false
+	rule := map[string]interface{}{"pattern": "announcements", "client_publish": &clientPublish}
+	if response := h.Request(http.MethodPost, "/channel-rules", key, rule); response.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status code %d, but got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	// Keys are only used from the server side, tokens are given to clients.
+	keyParts := strings.Split(key, ":")
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = keyParts[0]
+	signed, err := token.SignedString([]byte(keyParts[1]))
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, h.URL+"/channels/announcements/publish", strings.NewReader(`{"event":"news","data":"hi"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+signed)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status code %d, but got %d", http.StatusForbidden, response.StatusCode)
+	}
+
+	body := map[string]interface{}{"event": "news", "data": "hi"}
+	if response := h.Request(http.MethodPost, "/channels/announcements/publish", key, body); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestRESTRateLimit(t *testing.T) {
+	cfg := harness.Config()
+	cfg.RateLimit.REST = "2-M"
+	cfg.RateLimit.Publish = "1-M"
+
+	h := harness.StartWithConfig(t, cfg)
+	key := h.CreateKey(allCapabilities)
+
+	for i := 0; i < 2; i++ {
+		response := h.Request(http.MethodGet, "/channels", key, nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+		}
+
+		if remaining := response.Header.Get("RateLimit-Remaining"); remaining != strconv.Itoa(1-i) {
+			t.Fatalf("expected %d requests remaining, but got %q", 1-i, remaining)
+		}
+	}
+
+	response := h.Request(http.MethodGet, "/channels", key, nil)
+	if response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected status code %d with Retry-After, but got %d", http.StatusTooManyRequests, response.StatusCode)
+	}
+
+	if policy := response.Header.Get("RateLimit-Policy"); policy != "2;w=60" {
+		t.Fatalf("expected policy 2;w=60, but got %q", policy)
+	}
+
+	// Publishing has its own budget.
+	body := map[string]interface{}{"event": "greeting", "data": "hello"}
+	if response := h.Request(http.MethodPost, "/channels/lobby/publish", key, body); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+
+	if response := h.Request(http.MethodPost, "/channels/lobby/publish", key, body); response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, but got %d", http.StatusTooManyRequests, response.StatusCode)
+	}
+
+	// Admin routes use the rest budget by default.
+	cfg = harness.Config()
+	cfg.RateLimit.REST = "1-M"
+	cfg.RateLimit.Admin = ""
+	h = harness.StartWithConfig(t, cfg)
+	key = h.CreateKey(allCapabilities)
+
+	h.Request(http.MethodGet, "/channels", key, nil)
+	if response := h.Request(http.MethodGet, "/webhooks", key, nil); response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, but got %d", http.StatusTooManyRequests, response.StatusCode)
+	}
+
+	// Every key has its own budget and health checks aren't limited.
+	if response := h.Request(http.MethodGet, "/channels", h.CreateKey(allCapabilities), nil); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+	}
+
+	for i := 0; i < 3; i++ {
+		response := h.Request(http.MethodGet, "/health/live", "", nil)
+		if response.StatusCode != http.StatusOK || response.Header.Get("RateLimit-Limit") != "" {
+			t.Fatalf("expected health checks not to be limited, but got %d", response.StatusCode)
+		}
+	}
+}
+
+func TestRESTFailedAuthRateLimit(t *testing.T) {
+	cfg := harness.Config()
+	cfg.RateLimit.FailedAuth = "2-M"
+
+	h := harness.StartWithConfig(t, cfg)
+	key := h.CreateKey(allCapabilities)
+
+	for i := 0; i < 2; i++ {
+		if response := h.Request(http.MethodGet, "/channels", "unknown:secret", nil); response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status code %d, but got %d", http.StatusUnauthorized, response.StatusCode)
+		}
+	}
+
+	// Keys aren't looked up once the IP used up its budget, even valid ones.
+	response := h.Request(http.MethodGet, "/channels", key, nil)
+	if response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected status code %d with Retry-After, but got %d", http.StatusTooManyRequests, response.StatusCode)
+	}
+
+	// Requests that authenticate don't count against the budget.
+	h = harness.StartWithConfig(t, cfg)
+	key = h.CreateKey(allCapabilities)
+
+	for i := 0; i < 3; i++ {
+		if response := h.Request(http.MethodGet, "/channels", key, nil); response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, but got %d", http.StatusOK, response.StatusCode)
+		}
+	}
+}
+
+// metric returns the value of the metric served by /metrics.
+func metric(t *testing.T, h *harness.Harness, name string) float64 {
+	response := h.Request(http.MethodGet, "/metrics", "", nil)
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %s", err)
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value := strings.TrimPrefix(line, name+" ")
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid value of %s: %s", name, value)
+			}
+
+			return v
+		}
+	}
+
+	t.Fatalf("expected metric %s", name)
+	return 0
+}
+
+func TestCompression(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	subscriber := h.ConnectCompressed(key)
+	publisher := h.Connect(key)
+	subscriber.Subscribe("lobby")
+	publisher.Subscribe("lobby")
+
+	compressed := metric(t, h, "mycelium_websocket_compressed_messages_sent_total")
+
+	// Messages under the threshold aren't compressed.
+	publisher.Publish("lobby", "greeting", "hello", nil)
+	subscriber.Expect(protocol.MessageTypePublish)
+	if value := metric(t, h, "mycelium_websocket_compressed_messages_sent_total"); value != compressed {
+		t.Fatalf("expected %g compressed messages, but got %g", compressed, value)
+	}
+
+	text := strings.Repeat("hello world ", 100)
+	publisher.Publish("lobby", "greeting", text, nil)
+
+	var data protocol.PublishMessageData
+	subscriber.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Data != text {
+		t.Fatalf("expected the message to be decompressed, but got %v", data.Data)
+	}
+
+	if value := metric(t, h, "mycelium_websocket_compressed_messages_sent_total"); value != compressed+1 {
+		t.Fatalf("expected %g compressed messages, but got %g", compressed+1, value)
+	}
+
+	if ratio := metric(t, h, "mycelium_websocket_compression_ratio"); ratio <= 0 || ratio >= 0.5 {
+		t.Fatalf("expected the repeated text to compress, but got a ratio of %g", ratio)
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	cfg := harness.Config()
+	cfg.WebSocket.DeltaKeyframeInterval = 4
+
+	h := harness.StartWithConfig(t, cfg)
+	key := h.CreateKey(allCapabilities)
+
+	subscriber := h.Connect(key)
+	plain := h.Connect(key)
+	publisher := h.Connect(key)
+	subscriber.SubscribeDelta("dashboard")
+	plain.Subscribe("dashboard")
+	publisher.Subscribe("dashboard")
+
+	var state interface{}
+	for i := 1; i <= 5; i++ {
+		snapshot := map[string]interface{}{
+			"title":   "Dashboard with a long title that doesn't change between snapshots",
+			"version": float64(i),
+			"series":  []interface{}{float64(1), float64(2), float64(i)},
+		}
+
+		publisher.Publish("dashboard", "snapshot", snapshot, nil)
+
+		// The first message and every fourth one are keyframes.
+		expected := protocol.MessageTypePublishDelta
+		if i == 1 || i == 4 {
+			expected = protocol.MessageTypePublish
+		}
+
+		message := subscriber.Expect(expected)
+		if expected == protocol.MessageTypePublish {
+			var data protocol.PublishMessageData
+			message.Decode(&data)
+			state = data.Data
+		} else {
+			var data protocol.PublishDeltaMessageData
+			message.Decode(&data)
+
+			var err error
+			if state, err = jsonpatch.Apply(state, data.Patch); err != nil {
+				t.Fatalf("expected the patch to apply, but got %s", err)
+			}
+		}
+
+		if !reflect.DeepEqual(state, snapshot) {
+			t.Fatalf("expected snapshot %v, but got %v", snapshot, state)
+		}
+
+		// Subscribers that didn't ask for deltas get the whole data.
+		plain.Expect(protocol.MessageTypePublish)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	response, err := http.Get(h.URL + "/sse?channels=lobby&key=invalid")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d, but got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+
+	listener := h.Connect(key)
+	listener.SituationListen("lob")
+
+	// The stream may be listening by the time lobby gets occupied, so it listens to the other channels only.
+	stream := h.Stream(url.Values{"key": {key}, "channels": {"lobby"}, "situations": {"lobby-"}})
+	stream.Expect(protocol.MessageTypeHello)
+	stream.Expect(protocol.MessageTypeSubscribeSuccess)
+	stream.Expect(protocol.MessageTypeSituationListenSuccess)
+	listener.Expect(protocol.MessageTypeSituationChange)
+
+	// SSE subscribers count like any other subscriber.
+	response = h.Request(http.MethodGet, "/channels/lobby", key, nil)
+	var body struct {
+		Occupancy store.Occupancy `json:"occupancy"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || body.Occupancy.Subscribers != 1 {
+		t.Fatalf("expected 1 subscriber, but got %+v (%v)", body.Occupancy, err)
+	}
+
+	h.Request(http.MethodPost, "/channels/lobby/publish", key, map[string]interface{}{"event": "greeting", "data": "hello"})
+
+	var data protocol.PublishMessageData
+	stream.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Channel != "lobby" || data.Event != "greeting" || data.Data != "hello" {
+		t.Fatalf("expected greeting on lobby, but got %+v", data)
+	}
+
+	// Situation changes of other channels with the prefix are streamed too.
+	other := h.Connect(key)
+	other.Subscribe("lobby-2")
+
+	var situation protocol.SituationChangeMessageData
+	stream.Expect(protocol.MessageTypeSituationChange).Decode(&situation)
+	if situation.Channel != "lobby-2" || situation.Situation != "occupied" {
+		t.Fatalf("expected lobby-2 to be occupied, but got %+v", situation)
+	}
+
+	// Closing the stream unsubscribes the client.
+	stream.Close()
+	listener.Expect(protocol.MessageTypeSituationChange)
+	listener.Expect(protocol.MessageTypeSituationChange).Decode(&situation)
+	if situation.Channel != "lobby" || situation.Situation != "vacant" {
+		t.Fatalf("expected lobby to be vacant, but got %+v", situation)
+	}
+}
+
+func TestSSEShutdown(t *testing.T) {
+	h := harness.Start(t)
+	stream := h.Stream(url.Values{"key": {h.CreateKey(allCapabilities)}, "channels": {"lobby"}})
+	stream.Expect(protocol.MessageTypeHello)
+	stream.Expect(protocol.MessageTypeSubscribeSuccess)
+
+	h.Close()
+	stream.Expect(protocol.MessageTypeReconnect)
+
+	var closeData struct {
+		Code int `json:"code"`
+	}
+
+	stream.Expect("close").Decode(&closeData)
+	if closeData.Code != 4009 {
+		t.Fatalf("expected close code %d, but got %d", 4009, closeData.Code)
+	}
+
+	stream.ExpectEnd()
+}
+
+func TestLongPolling(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	response, err := http.Post(h.URL+"/poll?key=invalid", "application/json", nil)
+	if err != nil {
+		t.Fatalf("failed to start polling: %s", err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d, but got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+
+	subscriber := h.Connect(key)
+	subscriber.Subscribe("lobby")
+
+	session := h.StartPolling(key)
+	session.Expect(protocol.MessageTypeHello)
+
+	session.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: 1, Channel: "lobby"})
+	session.Expect(protocol.MessageTypeSubscribeSuccess)
+
+	session.Send(protocol.MessageTypeSituationListen, &protocol.SituationListenMessageData{SequenceNumber: 2, ChannelPrefix: "lob"})
+	session.Expect(protocol.MessageTypeSituationListenSuccess)
+
+	// Messages published by long-polling clients reach every subscriber, and the other way around.
+	session.Send(protocol.MessageTypePublish, &protocol.PublishMessageDataData{SequenceNumber: 3, Channel: "lobby", Event: "greeting", Data: "hello"})
+	session.Expect(protocol.MessageTypePublishSuccess)
+
+	var data protocol.PublishMessageData
+	subscriber.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Channel != "lobby" || data.Event != "greeting" || data.Data != "hello" {
+		t.Fatalf("expected greeting on lobby, but got %+v", data)
+	}
+
+	subscriber.Publish("lobby", "reply", "hi", nil)
+	session.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Event != "reply" || data.Data != "hi" {
+		t.Fatalf("expected reply on lobby, but got %+v", data)
+	}
+
+	other := h.Connect(key)
+	other.Subscribe("lobby-2")
+
+	var situation protocol.SituationChangeMessageData
+	session.Expect(protocol.MessageTypeSituationChange).Decode(&situation)
+	if situation.Channel != "lobby-2" || situation.Situation != "occupied" {
+		t.Fatalf("expected lobby-2 to be occupied, but got %+v", situation)
+	}
+
+	// Ending the session unsubscribes the client and forgets the session.
+	session.Close()
+	session.ExpectEnd()
+
+	response = h.Request(http.MethodGet, "/channels/lobby", key, nil)
+	var body struct {
+		Occupancy store.Occupancy `json:"occupancy"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || body.Occupancy.Subscribers != 1 {
+		t.Fatalf("expected 1 subscriber, but got %+v (%v)", body.Occupancy, err)
+	}
+
+	response, err = http.Get(h.URL + "/poll/" + session.ID)
+	if err != nil {
+		t.Fatalf("failed to poll: %s", err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d, but got %d", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestLongPollingInvalidMessage(t *testing.T) {
+	h := harness.Start(t)
+	session := h.StartPolling(h.CreateKey(allCapabilities))
+	session.Expect(protocol.MessageTypeHello)
+
+	response, err := http.Post(h.URL+"/poll/"+session.ID, "application/json", strings.NewReader("[1]"))
+	if err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+
+	response.Body.Close()
+	var closeData struct {
+		Code int `json:"code"`
+	}
+
+	session.Expect("close").Decode(&closeData)
+	if closeData.Code != 4010 {
+		t.Fatalf("expected close code %d, but got %d", 4010, closeData.Code)
+	}
+
+	session.ExpectEnd()
+}
+
+func TestLongPollingOtherInstance(t *testing.T) {
+	cfg := harness.Config()
+	cfg.Instance = "local"
+
+	h := harness.StartWithConfig(t, cfg)
+	session := h.StartPolling(h.CreateKey(allCapabilities))
+	session.Expect(protocol.MessageTypeHello)
+
+	if !strings.HasPrefix(session.ID, "local.") {
+		t.Fatalf("expected the session ID to start with the instance, but got %q", session.ID)
+	}
+
+	// Sessions of other instances are replayed on them, unknown ones of this instance aren't found.
+	response := h.Request(http.MethodGet, "/poll/remote."+uuid.NewString(), "", nil)
+	if response.StatusCode != http.StatusConflict || response.Header.Get("Fly-Replay") != "instance=remote" {
+		t.Fatalf("expected status code %d with Fly-Replay, but got %d (%q)", http.StatusConflict, response.StatusCode, response.Header.Get("Fly-Replay"))
+	}
+
+	for _, id := range []string{"local." + uuid.NewString(), uuid.NewString()} {
+		response := h.Request(http.MethodGet, "/poll/"+id, "", nil)
+		if response.StatusCode != http.StatusNotFound || response.Header.Get("Fly-Replay") != "" {
+			t.Fatalf("expected status code %d, but got %d", http.StatusNotFound, response.StatusCode)
+		}
+	}
+}
+
+func TestLongPollingShutdown(t *testing.T) {
+	h := harness.Start(t)
+	session := h.StartPolling(h.CreateKey(allCapabilities))
+	session.Expect(protocol.MessageTypeHello)
+
+	// Clients that aren't polling when the server shuts down only find out when their next poll fails.
+	time.Sleep(100 * time.Millisecond)
+
+	h.Close()
+	session.Expect(protocol.MessageTypeReconnect)
+
+	var closeData struct {
+		Code int `json:"code"`
+	}
+
+	session.Expect("close").Decode(&closeData)
+	if closeData.Code != 4009 {
+		t.Fatalf("expected close code %d, but got %d", 4009, closeData.Code)
+	}
+
+	session.ExpectEnd()
+}
+
+func TestMQTTPatterns(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	// Channel patterns are only subscribed to through the wildcards of MQTT.
+	subscriber := h.Connect(key)
+	subscriber.Send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: 1, Channel: "sensors-*"})
+	subscriber.Expect(protocol.MessageTypeError)
+
+	device, code := h.ConnectMQTT(mqtt.Version5, h.CreateKey(map[string]string{"sensors-kitchen": "subscribe"}))
+	if code != 0 {
+		t.Fatalf("expected the connection to be accepted, but got reason code %d", code)
+	}
+
+	// Filters of the same pattern share its subscription, and filters no channel the key can subscribe to matches
+	// are refused.
+	codes := device.Subscribe("sensors/+", "sensors/#", "sensors/kitchen", "other/#")
+	if !reflect.DeepEqual(codes, []byte{0, 0, 0, 0x80}) {
+		t.Fatalf("expected reason codes [0 0 0 128], but got %v", codes)
+	}
+
+	publisher := h.Connect(key)
+	publisher.Subscribe("sensors-kitchen")
+	publisher.Subscribe("sensors-hall")
+
+	// Subscribers of a channel and of a pattern matching it get its messages once, and only the ones of the
+	// channels they're allowed to subscribe to.
+	publisher.Publish("sensors-hall", "reading", 1, nil)
+	publisher.Publish("sensors-kitchen", "reading", 2, nil)
+
+	publish := device.ExpectPublish()
+	if publish.Topic != "sensors/kitchen" || string(publish.Payload) != "2" {
+		t.Fatalf("expected reading 2 on sensors/kitchen, but got %+v", publish)
+	}
+
+	device.ExpectNothing(100 * time.Millisecond)
+
+	// The pattern stays subscribed to until no filter uses it.
+	device.Unsubscribe("sensors/+", "sensors/kitchen")
+	publisher.Publish("sensors-kitchen", "reading", 3, nil)
+	if publish := device.ExpectPublish(); string(publish.Payload) != "3" {
+		t.Fatalf("expected reading 3, but got %+v", publish)
+	}
+
+	device.Unsubscribe("sensors/#")
+	publisher.Publish("sensors-kitchen", "reading", 4, nil)
+	device.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestMQTT(t *testing.T) {
+	h := harness.Start(t)
+	key := h.CreateKey(allCapabilities)
+
+	for _, version := range []byte{mqtt.Version311, mqtt.Version5} {
+		if _, code := h.ConnectMQTT(version, "unknown:secret"); code == 0 {
+			t.Fatalf("expected MQTT %d clients with an unknown key to be rejected", version)
+		}
+	}
+
+	subscriber := h.Connect(key)
+	subscriber.Subscribe("sensors-kitchen")
+
+	device, code := h.ConnectMQTT(mqtt.Version5, key)
+	if code != 0 {
+		t.Fatalf("expected the connection to be accepted, but got reason code %d", code)
+	}
+
+	// Topics are channels with their levels separated by "/" instead of "-".
+	if code := device.Publish("sensors/kitchen", []byte(`{"temperature":21}`), nil); code != 0 {
+		t.Fatalf("expected the message to be published, but got reason code %d", code)
+	}
+
+	var data protocol.PublishMessageData
+	subscriber.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Channel != "sensors-kitchen" || data.Event != "message" || !reflect.DeepEqual(data.Data, map[string]interface{}{"temperature": float64(21)}) {
+		t.Fatalf("expected the temperature on sensors-kitchen, but got %+v", data)
+	}
+
+	device.Publish("sensors/kitchen", []byte("open"), mqtt.Properties{{ID: mqtt.PropertyUserProperty, Value: mqtt.UserProperty{Key: "event", Value: "door"}}})
+	subscriber.Expect(protocol.MessageTypePublish).Decode(&data)
+	if data.Event != "door" || data.Data != "open" {
+		t.Fatalf("expected the door to be open, but got %+v", data)
+	}
+
+	// Payloads are delivered back as they were published, JSON strings included.
+	device.Subscribe("sensors/kitchen")
+	for _, payload := range []string{`"closed"`, "closed", `{"temperature":21}`} {
+		// With QoS 0, so no PUBACK races the message.
+		device.Send((&mqtt.Publish{Topic: "sensors/kitchen", Payload: []byte(payload)}).Encode(mqtt.Version5))
+		subscriber.Expect(protocol.MessageTypePublish)
+		if publish := device.ExpectPublish(); string(publish.Payload) != payload {
+			t.Fatalf("expected the payload %s, but got %s", payload, publish.Payload)
+		}
+	}
+
+	device.Unsubscribe("sensors/kitchen")
+
+	// Wildcards subscribe to channel patterns.
+	codes := device.Subscribe("commands/+/light", "invalid/#/filter")
+	if !reflect.DeepEqual(codes, []byte{0, 0x8f}) {
+		t.Fatalf("expected reason codes [0 143], but got %v", codes)
+	}
+
+	publisher := h.Connect(key)
+	publisher.Subscribe("commands-kitchen-light")
+	publisher.Subscribe("commands-kitchen-heating")
+
+	publisher.Publish("commands-kitchen-heating", "set", "on", nil)
+	publisher.Publish("commands-kitchen-light", "set", "off", nil)
+
+	publish := device.ExpectPublish()
+	if event, _ := publish.Properties.User("event"); publish.Topic != "commands/kitchen/light" || string(publish.Payload) != "off" || event != "set" {
+		t.Fatalf("expected set off on commands/kitchen/light, but got %+v", publish)
+	}
+
+	device.Ping()
+	device.Unsubscribe("commands/+/light")
+	publisher.Publish("commands-kitchen-light", "set", "on", nil)
+	device.ExpectNothing(100 * time.Millisecond)
+
+	// Topics that aren't channels close the connection.
+	device.Send((&mqtt.Publish{Topic: "sensors/kitchen-1", Payload: []byte("1")}).Encode(mqtt.Version5))
+	if code, disconnected := device.ExpectClosed(); !disconnected || code != 0x90 {
+		t.Fatalf("expected a DISCONNECT with reason code %d, but got %d (%v)", 0x90, code, disconnected)
+	}
+}
+
+func TestMQTTShutdown(t *testing.T) {
+	h := harness.Start(t)
+	device, _ := h.ConnectMQTT(mqtt.Version5, h.CreateKey(allCapabilities))
+	device.Subscribe("sensors/#")
+
+	h.Close()
+	if code, disconnected := device.ExpectClosed(); !disconnected || code != 0x8b {
+		t.Fatalf("expected a DISCONNECT with reason code %d, but got %d (%v)", 0x8b, code, disconnected)
+	}
+}
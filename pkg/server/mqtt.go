@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ServeMQTT accepts MQTT connections on the listener until the server is shut down, it's meant to run alongside
+// Serve. Its clients are registered in the same hub as the other realtime clients, so connections are only accepted
+// once Serve runs the hub.
+func (s *Server) ServeMQTT(listener net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+
+	default:
+		s.mqttListener = listener
+		s.mu.Unlock()
+	}
+
+	select {
+	case <-s.wsHub.Running():
+	case <-s.stopping:
+		return nil
+	}
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			// Backs off on temporary errors like running out of file descriptors, like http.Server does.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if delay = delay * 2; delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay > time.Second {
+					delay = time.Second
+				}
+
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+
+		delay = 0
+		go s.serveMQTT(conn)
+	}
+}
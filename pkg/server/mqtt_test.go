@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/websocket"
+)
+
+func TestServeMQTTWaitsForTheHub(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	s := &Server{
+		wsHub:    websocket.NewHub(websocket.Options{OperationTimeout: time.Second}),
+		stopping: make(chan struct{}),
+		serveMQTT: func(conn net.Conn) {
+			conn.Close()
+			accepted <- struct{}{}
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeMQTT(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-accepted:
+		t.Fatalf("expected the connection not to be accepted before the hub runs")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := broker.NewMemoryBroker()
+	defer b.Close()
+	go s.wsHub.Run(ctx, store.NewMemoryStore(), b)
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection to be accepted once the hub runs")
+	}
+
+	listener.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+}
+
+func TestServeMQTTAfterShutdown(t *testing.T) {
+	s := &Server{wsHub: websocket.NewHub(websocket.Options{}), stopping: make(chan struct{})}
+	close(s.stopping)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	// The listener is closed instead of being left open after the server shut down.
+	if err := s.ServeMQTT(listener); err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	if _, err := listener.Accept(); err == nil {
+		t.Fatalf("expected the listener to be closed")
+	}
+}
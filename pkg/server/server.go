@@ -2,164 +2,467 @@ package server
 
 import (
 	"context"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/config"
 	"github.com/gmencz/mycelium/pkg/controllers"
 	"github.com/gmencz/mycelium/pkg/db"
+	"github.com/gmencz/mycelium/pkg/integrations"
+	"github.com/gmencz/mycelium/pkg/metrics"
 	"github.com/gmencz/mycelium/pkg/middlewares"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/webhooks"
 	"github.com/gmencz/mycelium/pkg/websocket"
 	"github.com/go-redis/redis/v8"
-	wsLib "github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
-)
-
-var (
-	port          = os.Getenv("PORT")
-	natsHost      = os.Getenv("NATS_HOST")
-	redisAddress  = os.Getenv("REDIS_ADDRESS")
-	redisPassword = os.Getenv("REDIS_PASSWORD")
+	"gorm.io/gorm"
 )
 
 type Server struct {
-	router          *gin.Engine
-	wsHub           *websocket.Hub
-	rdb             *redis.Client
-	nc              *nats.EncodedConn
-	shutdownSignals chan os.Signal
+	config       *config.Config
+	httpServer   *http.Server
+	wsHub        *websocket.Hub
+	webhooks     *webhooks.Dispatcher
+	integrations *integrations.Forwarder
+	channels     store.ChannelStore
+	broker       broker.Broker
+
+	// Plaintext server redirecting to the TLS one.
+	redirectServer *http.Server
+
+	// Handles the connections to the MQTT listener, which is closed on shutdown.
+	serveMQTT    func(conn net.Conn)
+	mqttListener net.Listener
+
+	// Cancels the context the background work of the server runs with.
+	mu     sync.Mutex
+	cancel context.CancelFunc
+
+	// Closed once the server starts shutting down, guarded by mu.
+	stopping chan struct{}
+
+	// Webhooks and integrations, which use the broker until they stop.
+	background sync.WaitGroup
 }
 
-func NewServer() *Server {
+// Dependencies of a Server, the ones left nil are created from the config. Redis is optional when the channel
+// store is given, without it rate limits are kept in memory and webhook dead letters aren't kept.
+type Dependencies struct {
+	DB       *gorm.DB
+	Redis    *redis.Client
+	Channels store.ChannelStore
+	Broker   broker.Broker
+}
+
+func NewServer(cfg *config.Config) *Server {
+	return NewServerWithDependencies(cfg, Dependencies{})
+}
+
+// NewServerWithDependencies returns a Server using the given dependencies, e.g. to run it in-process in tests.
+func NewServerWithDependencies(cfg *config.Config, deps Dependencies) *Server {
 	// Router
 	router := gin.Default()
 	router.SetTrustedProxies(nil)
 
 	// Dependencies
-	wsHub := websocket.NewHub()
-	database := db.NewDB()
-	nc, ncErr := nats.Connect(natsHost)
-	if ncErr != nil {
-		logrus.Fatalln(ncErr)
+	wsHub := websocket.NewHub(websocket.Options{
+		PongWait:             cfg.WebSocket.PongWait.Duration,
+		WriteWait:            cfg.WebSocket.WriteWait.Duration,
+		CloseGracePeriod:     cfg.WebSocket.CloseGracePeriod.Duration,
+		MaxMessageSize:       cfg.WebSocket.MaxMessageSize,
+		MaxChannels:          cfg.WebSocket.MaxChannels,
+		MaxMessagesPerSecond: cfg.WebSocket.MaxMessagesPerSecond,
+		MessageBurst:         cfg.WebSocket.MessageBurst,
+		PublishLimits: websocket.PublishLimits{
+			ChannelMessagesPerSecond: cfg.WebSocket.ChannelMessagesPerSecond,
+			AppMessagesPerSecond:     cfg.WebSocket.AppMessagesPerSecond,
+		},
+		OperationTimeout:      cfg.OperationTimeout.Duration,
+		MaxConnections:        cfg.WebSocket.MaxConnections,
+		MaxConnectionsPerApp:  int64(cfg.WebSocket.MaxConnectionsPerApp),
+		MaxConnectionsPerIP:   cfg.WebSocket.MaxConnectionsPerIP,
+		CompressionLevel:      cfg.WebSocket.CompressionLevel,
+		CompressionThreshold:  cfg.WebSocket.CompressionThreshold,
+		DeltaKeyframeInterval: cfg.WebSocket.DeltaKeyframeInterval,
+
+		// Streams end before the write timeout of the server resets them.
+		StreamTimeout: cfg.HTTP.WriteTimeout.Duration * 9 / 10,
+		PollTimeout:   cfg.HTTP.WriteTimeout.Duration * 2 / 3,
+		Instance:      cfg.Instance,
+	})
+
+	database := deps.DB
+	if database == nil {
+		database = db.NewDB(cfg.Database.URL)
 	}
 
-	c, cErr := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
-	if cErr != nil {
-		logrus.Fatalln(cErr)
+	messageBroker := deps.Broker
+	if messageBroker == nil {
+		var brokerErr error
+		if messageBroker, brokerErr = newBroker(cfg); brokerErr != nil {
+			logrus.Fatalln(brokerErr)
+		}
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddress,
-		Password: redisPassword,
-		DB:       0, // use default DB
-		Username: "default",
-	})
+	rdb := deps.Redis
+	channelStore := deps.Channels
+	if channelStore == nil {
+		switch cfg.ChannelStore {
+		case "memory":
+			channelStore = store.NewMemoryStore()
+
+		case "redis":
+			if rdb == nil {
+				rdb = redis.NewClient(&redis.Options{
+					Addr:     cfg.Redis.Address,
+					Password: cfg.Redis.Password,
+					DB:       0, // use default DB
+					Username: "default",
+				})
+			}
+
+			channelStore = store.NewRedisStore(rdb)
+		}
+	}
+
+	rateLimitStore, rateLimitStoreErr := middlewares.NewRateLimitStore(rdb)
+	if rateLimitStoreErr != nil {
+		logrus.Fatalln(rateLimitStoreErr)
+	}
+
+	// Budgets of the REST API, the publish and admin routes have their own unless they use the rest rate.
+	budget := func(name string, rate string) gin.HandlerFunc {
+		if rate == "" {
+			name, rate = "rest", cfg.RateLimit.REST
+		}
+
+		middleware, err := middlewares.RateLimitMiddleware(name, rate, rateLimitStore)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+
+		return middleware
+	}
 
-	rateLimiterMiddleware, rateLimiterMiddlewareErr := middlewares.NewRateLimiterMiddleware("15000-H", rdb)
-	if rateLimiterMiddlewareErr != nil {
-		logrus.Fatalln(rateLimiterMiddlewareErr)
+	// Requests failing authentication are counted per IP since they have no key.
+	var failedAuth *middlewares.RateLimiter
+	if cfg.RateLimit.FailedAuth != "" {
+		var failedAuthErr error
+		failedAuth, failedAuthErr = middlewares.NewRateLimiter("failed-auth", cfg.RateLimit.FailedAuth, rateLimitStore)
+		if failedAuthErr != nil {
+			logrus.Fatalln(failedAuthErr)
+		}
 	}
 
 	// Middlewares
-	router.Use(middlewares.CORSMiddleware())
-	router.Use(rateLimiterMiddleware)
+	router.Use(middlewares.CORSMiddleware(cfg.CORS.AllowedOrigins))
+
+	webhookDispatcher := webhooks.NewDispatcher(database, rdb)
+	integrationsForwarder := integrations.NewForwarder(database)
 
 	// Routes
 	controller := &controllers.Controller{
-		Rdb: rdb,
-		Db:  database,
+		Rdb:          rdb,
+		Channels:     channelStore,
+		Db:           database,
+		Broker:       messageBroker,
+		Rules:        rules.NewStore(database),
+		Schemas:      schemas.NewStore(database),
+		Webhooks:     webhookDispatcher,
+		Integrations: integrationsForwarder,
+		Origins:      origins.NewStore(database),
+
+		PublishLimits: wsHub.Options.PublishLimits,
+		FailedAuth:    failedAuth,
+
+		NatsHealthcheckEndpoint: cfg.Nats.HealthcheckEndpoint,
 	}
 
 	router.GET("/realtime", func(ctx *gin.Context) {
-		controller.Realtime(ctx, database, rdb, c, wsHub)
+		controller.Realtime(ctx, database, channelStore, messageBroker, wsHub)
 	})
 
-	router.GET("/health", controller.Health)
-	router.GET("/health/live", controller.HealthLive)
+	router.GET("/sse", func(ctx *gin.Context) {
+		controller.SSE(ctx, database, channelStore, messageBroker, wsHub)
+	})
 
-	router.GET("/channels", controller.GetChannels)
+	// Long-polling sessions for clients that can use neither websockets nor SSE.
+	router.POST("/poll", func(ctx *gin.Context) {
+		controller.CreatePollSession(ctx, database, channelStore, messageBroker, wsHub)
+	})
 
-	srv := &Server{
-		router:          router,
-		wsHub:           wsHub,
-		rdb:             rdb,
-		nc:              c,
-		shutdownSignals: make(chan os.Signal, 1),
+	router.GET("/poll/:id", func(ctx *gin.Context) {
+		controller.Poll(ctx, wsHub)
+	})
+
+	router.POST("/poll/:id", func(ctx *gin.Context) {
+		controller.SendPollMessages(ctx, wsHub)
+	})
+
+	router.DELETE("/poll/:id", func(ctx *gin.Context) {
+		controller.DeletePollSession(ctx, wsHub)
+	})
+
+	// The realtime connections outlive the timeout of the REST API.
+	api := router.Group("/", middlewares.TimeoutMiddleware(cfg.HTTP.RequestTimeout.Duration))
+
+	api.GET("/health", controller.Health)
+	api.GET("/health/live", controller.HealthLive)
+	api.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// Health checks are made without client certificates.
+	rest := api.Group("/")
+	if cfg.TLS.ClientCAFile != "" {
+		rest.Use(middlewares.ClientCertificateMiddleware())
 	}
 
-	srv.configureSignals()
+	channels := rest.Group("/", budget("rest", cfg.RateLimit.REST))
+	channels.GET("/channels", controller.GetChannels)
+	channels.GET("/channels/:channel", controller.GetChannel)
+	rest.POST("/channels/:channel/publish", budget("publish", cfg.RateLimit.Publish), controller.Publish)
+
+	// Admin
+	admin := rest.Group("/", budget("admin", cfg.RateLimit.Admin))
+	admin.GET("/channel-rules", controller.GetChannelRules)
+	admin.POST("/channel-rules", controller.CreateChannelRule)
+	admin.PUT("/channel-rules/:id", controller.UpdateChannelRule)
+	admin.DELETE("/channel-rules/:id", controller.DeleteChannelRule)
+	admin.GET("/channel-schemas", controller.GetChannelSchemas)
+	admin.POST("/channel-schemas", controller.CreateChannelSchema)
+	admin.PUT("/channel-schemas/:id", controller.UpdateChannelSchema)
+	admin.DELETE("/channel-schemas/:id", controller.DeleteChannelSchema)
+	admin.GET("/webhooks", controller.GetWebhooks)
+	admin.POST("/webhooks", controller.CreateWebhook)
+	admin.GET("/webhooks/dead-letters", controller.GetWebhookDeadLetters)
+	admin.PUT("/webhooks/:id", controller.UpdateWebhook)
+	admin.DELETE("/webhooks/:id", controller.DeleteWebhook)
+	admin.GET("/integrations", controller.GetIntegrations)
+	admin.POST("/integrations", controller.CreateIntegration)
+	admin.PUT("/integrations/:id", controller.UpdateIntegration)
+	admin.DELETE("/integrations/:id", controller.DeleteIntegration)
+	admin.GET("/allowed-origins", controller.GetAllowedOrigins)
+	admin.POST("/allowed-origins", controller.CreateAllowedOrigin)
+	admin.DELETE("/allowed-origins/:id", controller.DeleteAllowedOrigin)
+
+	srv := &Server{
+		config: cfg,
+		httpServer: &http.Server{
+			Handler:           router,
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout.Duration,
+			ReadTimeout:       cfg.HTTP.ReadTimeout.Duration,
+			WriteTimeout:      cfg.HTTP.WriteTimeout.Duration,
+			IdleTimeout:       cfg.HTTP.IdleTimeout.Duration,
+			ConnContext:       websocket.WithConn,
+		},
+		wsHub:        wsHub,
+		webhooks:     webhookDispatcher,
+		integrations: integrationsForwarder,
+		channels:     channelStore,
+		broker:       messageBroker,
+		serveMQTT: func(conn net.Conn) {
+			websocket.ServeMQTT(conn, database, controller.Rules, controller.Schemas, controller.Origins, channelStore, messageBroker, wsHub)
+		},
+		stopping: make(chan struct{}),
+	}
 
 	return srv
 }
 
-func (s *Server) configureSignals() {
-	signal.Notify(s.shutdownSignals, syscall.SIGTERM, syscall.SIGINT)
-}
+func newBroker(cfg *config.Config) (broker.Broker, error) {
+	switch cfg.Broker {
+	case "nats":
+		return broker.NewNatsBroker(cfg.Nats.Host)
+
+	case "embedded":
+		return broker.NewEmbeddedBroker()
+
+	case "memory":
+		return broker.NewMemoryBroker(), nil
+	}
 
-func (s *Server) listenTerminationSignals() {
-	<-s.shutdownSignals
-	s.Shutdown()
+	return nil, errors.New("invalid broker, must be nats, embedded or memory")
 }
 
-func (s *Server) Start() (err error) {
-	defer s.Shutdown()
+// Start serves on the configured port until ctx is done, then shuts down within the shutdown timeout.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.config.Port))
+	if err != nil {
+		return err
+	}
 
-	go s.wsHub.Run(s.rdb, s.nc)
-	go s.listenTerminationSignals()
+	var certs *certificates
+	if s.config.TLS.Enabled() {
+		certs, err = newCertificates(s.config.TLS)
+		if err != nil {
+			listener.Close()
+			return err
+		}
 
-	return s.router.Run(":" + port)
-}
+		go certs.watch(ctx, s.config.TLS.ReloadInterval.Duration)
+		listener = tls.NewListener(listener, certs.listenerConfig())
 
-var ctx = context.Background()
+		if s.config.TLS.RedirectPort != 0 {
+			redirectListener, err := net.Listen("tcp", ":"+strconv.Itoa(s.config.TLS.RedirectPort))
+			if err != nil {
+				listener.Close()
+				return err
+			}
 
-func (s *Server) Shutdown() {
-	logrus.Info("attempting a graceful shutdown")
+			s.redirectServer = &http.Server{
+				Handler:           redirectHandler(s.config.Port),
+				ReadHeaderTimeout: s.config.HTTP.ReadHeaderTimeout.Duration,
+				IdleTimeout:       s.config.HTTP.IdleTimeout.Duration,
+			}
+
+			go func() {
+				if err := s.redirectServer.Serve(redirectListener); !errors.Is(err, http.ErrServerClosed) {
+					logrus.Error(err)
+				}
+			}()
+		}
+	}
+
+	if s.config.MQTT.Port != 0 {
+		mqttListener, err := net.Listen("tcp", ":"+strconv.Itoa(s.config.MQTT.Port))
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		if certs != nil {
+			mqttListener = tls.NewListener(mqttListener, certs.mqttListenerConfig())
+		}
+
+		// Set before serving so shutting down closes it even if ServeMQTT hasn't run yet.
+		s.mu.Lock()
+		s.mqttListener = mqttListener
+		s.mu.Unlock()
 
-	timeoutTimer := time.NewTimer(time.Minute)
+		go func() {
+			if err := s.ServeMQTT(mqttListener); err != nil {
+				logrus.Error(err)
+			}
+		}()
+	}
+
+	serveErr := make(chan error, 1)
 	go func() {
-		<-timeoutTimer.C
-		logrus.Info("forcing a shutdown")
-		os.Exit(1)
+		serveErr <- s.Serve(listener)
 	}()
 
-	for channel := range s.wsHub.ChannelsClients {
-		key := "subscribers:" + channel
-		decrBy := len(s.wsHub.ChannelsClients[channel])
-		i := s.rdb.DecrBy(ctx, key, int64(decrBy))
-		subscribersLeft := i.Val()
-		if subscribersLeft <= 0 {
-			s.rdb.Del(ctx, key)
-			s.nc.Publish("situation_change", &websocket.NatsSituationChangeData{
-				Channel:   channel,
-				Situation: "vacant",
-			})
+	select {
+	case err = <-serveErr:
+		if err != nil {
+			logrus.Error(err)
 		}
+
+	case <-ctx.Done():
 	}
 
-	appsDecrements := make(map[string]int64)
-	for client := range s.wsHub.Clients {
-		currentDecrements, exists := appsDecrements[client.AppID]
-		if exists {
-			appsDecrements[client.AppID] = currentDecrements + 1
-		} else {
-			appsDecrements[client.AppID] = 1
-		}
+	logrus.Info("attempting a graceful shutdown")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.Shutdown.Timeout.Duration)
+	defer cancel()
+
+	if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
 	}
 
-	for appID, decrBy := range appsDecrements {
-		key := "current-clients:" + appID
-		clientsLeft := s.rdb.DecrBy(ctx, key, decrBy)
-		if clientsLeft.Val() <= 0 {
-			s.rdb.Del(ctx, key)
-		}
+	return err
+}
+
+// Serve runs the server accepting connections on the listener until it's shut down.
+func (s *Server) Serve(listener net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	go s.wsHub.Run(ctx, s.channels, s.broker)
+	s.background.Add(2)
+	go func() {
+		defer s.background.Done()
+		s.webhooks.Run(ctx, s.broker)
+	}()
+
+	go func() {
+		defer s.background.Done()
+		s.integrations.Run(ctx, s.broker)
+	}()
+
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
 
-	for client := range s.wsHub.Clients {
-		client.CloseWithMessage(wsLib.FormatCloseMessage(4009, "please reconnect"))
+	return nil
+}
+
+// Shutdown stops accepting connections, waits for the requests being handled and asks the clients of the server to
+// reconnect (to another server), closing their connections and reverting what they added to the shared counters and
+// presence sets. It returns the error of ctx if it's done before the requests finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.redirectServer != nil {
+		s.redirectServer.Shutdown(ctx)
+	}
+
+	// MQTT clients are drained with the others.
+	s.mu.Lock()
+	select {
+	case <-s.stopping:
+	default:
+		close(s.stopping)
 	}
 
-	os.Exit(0)
+	if s.mqttListener != nil {
+		s.mqttListener.Close()
+	}
+	s.mu.Unlock()
+
+	// SSE streams are requests that only end once their clients are drained.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.httpServer.Shutdown(ctx)
+	}()
+
+	drainCtx, cancel := context.WithTimeout(ctx, s.config.WebSocket.CloseGracePeriod.Duration)
+	defer cancel()
+
+	s.wsHub.Drain(drainCtx, websocket.ReconnectHint{
+		Delay:  s.config.Shutdown.ReconnectDelay.Duration,
+		Jitter: s.config.Shutdown.ReconnectJitter.Duration,
+	}, s.config.Shutdown.DrainConcurrency)
+
+	err := <-shutdownErr
+
+	s.wsHub.Release(s.channels, s.broker)
+
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+
+	// Webhooks and integrations unsubscribe before the broker is closed.
+	s.background.Wait()
+
+	// Flushes what's left to publish.
+	s.broker.Close()
+
+	return err
+}
+
+// Close is like Shutdown without a deadline other than the close grace period of the connections.
+func (s *Server) Close() {
+	s.Shutdown(context.Background())
 }
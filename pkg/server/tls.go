@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// certificates keeps the TLS config of the server up to date with the files it's read from.
+type certificates struct {
+	files config.TLS
+
+	mu       sync.RWMutex
+	config   *tls.Config
+	modTimes []time.Time
+}
+
+func newCertificates(files config.TLS) (*certificates, error) {
+	c := &certificates{files: files}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certificates) paths() []string {
+	paths := []string{c.files.CertFile, c.files.KeyFile}
+	if c.files.ClientCAFile != "" {
+		paths = append(paths, c.files.ClientCAFile)
+	}
+
+	return paths
+}
+
+func (c *certificates) load() error {
+	modTimes, err := modTimes(c.paths())
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.files.CertFile, c.files.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.files.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(c.files.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return errors.New("no certificates found in " + c.files.ClientCAFile)
+		}
+
+		// Browsers connecting to /realtime don't have a certificate, it's up to the routes to require one.
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	c.mu.Lock()
+	c.config = tlsConfig
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	return nil
+}
+
+// changed reports whether any of the files was modified since they were loaded.
+func (c *certificates) changed() bool {
+	current, err := modTimes(c.paths())
+	if err != nil {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i, modTime := range current {
+		if !modTime.Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch reloads the files when they change until ctx is done, a failed reload keeps the previous config.
+func (c *certificates) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+
+			if err := c.load(); err != nil {
+				logrus.Errorf("failed to reload TLS files: %s", err)
+				continue
+			}
+
+			logrus.Info("reloaded TLS files")
+		}
+	}
+}
+
+// listenerConfig returns the config of a TLS listener, every connection gets the latest config loaded.
+func (c *certificates) listenerConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.config, nil
+		},
+	}
+}
+
+// mqttListenerConfig returns the config of the TLS listener of MQTT, which doesn't negotiate HTTP.
+func (c *certificates) mqttListenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			config := c.config.Clone()
+			config.NextProtos = nil
+			return config, nil
+		},
+	}
+}
+
+func modTimes(paths []string) ([]time.Time, error) {
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// redirectHandler redirects plaintext requests to the same URL served with TLS on the port.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// Unlike 301, 308 keeps the method and body of API requests.
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
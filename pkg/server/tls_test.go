@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/config"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 with the serial number and its key.
+func writeCertificate(t *testing.T, certFile string, keyFile string, serialNumber int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber),
+		Subject:      pkix.Name{CommonName: "mycelium"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+}
+
+// handshake connects to the listener and returns the serial number of its certificate and the negotiated protocol.
+func handshake(t *testing.T, address string) (int64, string) {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	return state.PeerCertificates[0].SerialNumber.Int64(), state.NegotiatedProtocol
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	files := config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeCertificate(t, files.CertFile, files.KeyFile, 1)
+
+	certs, err := newCertificates(files)
+	if err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(tls.NewListener(listener, certs.listenerConfig()))
+	t.Cleanup(func() { server.Close() })
+
+	serialNumber, protocol := handshake(t, listener.Addr().String())
+	if serialNumber != 1 || protocol != "h2" {
+		t.Fatalf("expected certificate %d over h2, but got %d over %q", 1, serialNumber, protocol)
+	}
+
+	if certs.changed() {
+		t.Fatalf("expected the files to be unchanged")
+	}
+
+	writeCertificate(t, files.CertFile, files.KeyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(files.CertFile, later, later)
+
+	if !certs.changed() {
+		t.Fatalf("expected the files to be changed")
+	}
+
+	if err := certs.load(); err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	if serialNumber, _ := handshake(t, listener.Addr().String()); serialNumber != 2 {
+		t.Fatalf("expected certificate %d after reloading, but got %d", 2, serialNumber)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port     int
+		host     string
+		location string
+	}{
+		{443, "example.com", "https://example.com/channels?key=a"},
+		{443, "example.com:80", "https://example.com/channels?key=a"},
+		{9001, "example.com:8080", "https://example.com:9001/channels?key=a"},
+		{9001, "[::1]:8080", "https://[::1]:9001/channels?key=a"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/channels?key=a", nil)
+		recorder := httptest.NewRecorder()
+		redirectHandler(test.port).ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusPermanentRedirect || recorder.Header().Get("Location") != test.location {
+			t.Fatalf("expected a redirect to %s, but got %d to %s", test.location, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
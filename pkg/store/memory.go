@@ -0,0 +1,371 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/ratelimit"
+)
+
+// Channels returned by every page of MemoryStore.Channels.
+const memoryChannelsPageSize = 100
+
+type memoryHistory struct {
+	entries   [][]byte
+	expiresAt time.Time
+}
+
+// MemoryStore is a ChannelStore kept in the memory of the process, it's only meant for running a single server
+// without redis and for tests.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// Counters of subscribers, publishers, clients and usage.
+	counters map[string]int64
+
+	// Server ID -> counter key -> amount contributed by the server.
+	contributions map[string]map[string]int64
+
+	// Channel -> session ID -> data.
+	presence map[string]map[string][]byte
+
+	// Server ID -> presence members of the server.
+	presenceContributions map[string]map[PresenceMember]bool
+
+	history map[string]*memoryHistory
+
+	// Server ID -> when its lease expires.
+	leases map[string]time.Time
+
+	// Token buckets and how many tokens were taken from them, full buckets are forgotten every now and then.
+	buckets     map[string]*ratelimit.Bucket
+	tokensTaken int
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters:              make(map[string]int64),
+		contributions:         make(map[string]map[string]int64),
+		presence:              make(map[string]map[string][]byte),
+		presenceContributions: make(map[string]map[PresenceMember]bool),
+		history:               make(map[string]*memoryHistory),
+		leases:                make(map[string]time.Time),
+		buckets:               make(map[string]*ratelimit.Bucket),
+	}
+}
+
+func (s *MemoryStore) contribute(serverID string, key string, amount int64) {
+	if s.contributions[serverID] == nil {
+		s.contributions[serverID] = make(map[string]int64)
+	}
+
+	s.contributions[serverID][key] += amount
+}
+
+// Must be called with the lock held.
+func (s *MemoryStore) incr(serverID string, key string) int64 {
+	s.counters[key]++
+	s.contribute(serverID, key, 1)
+	return s.counters[key]
+}
+
+// Must be called with the lock held, see decrCounterScript.
+func (s *MemoryStore) decr(serverID string, key string, decrBy int64) (emptied bool) {
+	current, ok := s.counters[key]
+	if !ok {
+		return false
+	}
+
+	if current <= decrBy {
+		s.contribute(serverID, key, -current)
+		delete(s.counters, key)
+		return true
+	}
+
+	s.contribute(serverID, key, -decrBy)
+
+	s.counters[key] = current - decrBy
+	return false
+}
+
+func (s *MemoryStore) AddSubscriber(ctx context.Context, serverID string, appChannel string) (occupied bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incr(serverID, subscribersKey(appChannel)) == 1, nil
+}
+
+func (s *MemoryStore) RemoveSubscribers(ctx context.Context, serverID string, appChannel string, count int64) (vacated bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.decr(serverID, subscribersKey(appChannel), count), nil
+}
+
+func (s *MemoryStore) AddPublisher(ctx context.Context, serverID string, appChannel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incr(serverID, publishersKey(appChannel))
+	return nil
+}
+
+func (s *MemoryStore) RemovePublishers(ctx context.Context, serverID string, appChannel string, count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decr(serverID, publishersKey(appChannel), count)
+	return nil
+}
+
+func (s *MemoryStore) AddClient(ctx context.Context, serverID string, appID string, max int64) (currentClients int64, admitted bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if max > 0 && s.counters[currentClientsKey(appID)] >= max {
+		return 0, false, nil
+	}
+
+	currentClients = s.incr(serverID, currentClientsKey(appID))
+	if peakKey := peakClientsKey(appID); currentClients > s.counters[peakKey] {
+		s.counters[peakKey] = currentClients
+	}
+
+	return currentClients, true, nil
+}
+
+func (s *MemoryStore) RemoveClients(ctx context.Context, serverID string, appID string, count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decr(serverID, currentClientsKey(appID), count)
+	return nil
+}
+
+func (s *MemoryStore) CountPublishedMessage(ctx context.Context, appID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[publishedMessagesKey(appID)]++
+	return nil
+}
+
+func (s *MemoryStore) EnterPresence(ctx context.Context, serverID string, appChannel string, sessionID string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.presence[appChannel] == nil {
+		s.presence[appChannel] = make(map[string][]byte)
+	}
+
+	if s.presenceContributions[serverID] == nil {
+		s.presenceContributions[serverID] = make(map[PresenceMember]bool)
+	}
+
+	s.presence[appChannel][sessionID] = data
+	s.presenceContributions[serverID][PresenceMember{AppChannel: appChannel, SessionID: sessionID}] = true
+	return nil
+}
+
+func (s *MemoryStore) LeavePresence(ctx context.Context, serverID string, appChannel string, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leavePresence(serverID, PresenceMember{AppChannel: appChannel, SessionID: sessionID})
+	return nil
+}
+
+// Must be called with the lock held.
+func (s *MemoryStore) leavePresence(serverID string, member PresenceMember) {
+	delete(s.presence[member.AppChannel], member.SessionID)
+	if len(s.presence[member.AppChannel]) == 0 {
+		delete(s.presence, member.AppChannel)
+	}
+
+	delete(s.presenceContributions[serverID], member)
+}
+
+func (s *MemoryStore) AppendHistory(ctx context.Context, appChannel string, entry []byte, max int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.history[appChannel]
+	if !ok || (!history.expiresAt.IsZero() && time.Now().After(history.expiresAt)) {
+		history = &memoryHistory{}
+		s.history[appChannel] = history
+	}
+
+	history.entries = append(history.entries, entry)
+	if int64(len(history.entries)) > max {
+		history.entries = history.entries[int64(len(history.entries))-max:]
+	}
+
+	if ttl > 0 {
+		history.expiresAt = time.Now().Add(ttl)
+	} else {
+		history.expiresAt = time.Time{}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) History(ctx context.Context, appChannel string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.history[appChannel]
+	if !ok {
+		return nil, nil
+	}
+
+	if !history.expiresAt.IsZero() && time.Now().After(history.expiresAt) {
+		delete(s.history, appChannel)
+		return nil, nil
+	}
+
+	return append([][]byte(nil), history.entries...), nil
+}
+
+func (s *MemoryStore) Occupancy(ctx context.Context, appChannel string) (*Occupancy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &Occupancy{
+		Subscribers:     s.counters[subscribersKey(appChannel)],
+		Publishers:      s.counters[publishersKey(appChannel)],
+		PresenceMembers: int64(len(s.presence[appChannel])),
+	}, nil
+}
+
+func (s *MemoryStore) Channels(ctx context.Context, appID string, prefix string, cursor uint64) (channels []string, nextCursor uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keyPrefix := subscribersKey(appID + ":")
+	all := make([]string, 0)
+	for key := range s.counters {
+		if strings.HasPrefix(key, keyPrefix+prefix) {
+			all = append(all, strings.TrimPrefix(key, keyPrefix))
+		}
+	}
+
+	// The cursor is an offset in the sorted channels.
+	sort.Strings(all)
+	if cursor >= uint64(len(all)) {
+		return []string{}, 0, nil
+	}
+
+	end := cursor + memoryChannelsPageSize
+	if end >= uint64(len(all)) {
+		return all[cursor:], 0, nil
+	}
+
+	return all[cursor:end], end, nil
+}
+
+func (s *MemoryStore) RenewLease(ctx context.Context, serverID string) (owned bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Servers are forgotten once their contributions are reverted.
+	_, owned = s.leases[serverID]
+	s.leases[serverID] = time.Now().Add(LeaseTTL)
+	return owned, nil
+}
+
+// ExpireLease makes the lease of the server expire right away as if the server died, it's meant for tests.
+func (s *MemoryStore) ExpireLease(serverID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leases[serverID]; ok {
+		s.leases[serverID] = time.Time{}
+	}
+}
+
+func (s *MemoryStore) ClaimExpiredServers(ctx context.Context, reaperID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := make([]string, 0)
+	for serverID, expiresAt := range s.leases {
+		if serverID != reaperID && time.Now().After(expiresAt) {
+			// Claimed until it's reverted.
+			s.leases[serverID] = time.Now().Add(reapLockTTL)
+			expired = append(expired, serverID)
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *MemoryStore) Revert(ctx context.Context, serverID string) (*Reverted, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reverted := &Reverted{}
+	for key, contributed := range s.contributions[serverID] {
+		if contributed <= 0 {
+			continue
+		}
+
+		emptied := s.decr(serverID, key, contributed)
+		if strings.HasPrefix(key, "subscribers:") {
+			channel := strings.TrimPrefix(key, "subscribers:")
+			if emptied {
+				reverted.Vacated = append(reverted.Vacated, channel)
+			}
+
+			reverted.Changed = append(reverted.Changed, channel)
+		} else if strings.HasPrefix(key, "publishers:") {
+			reverted.Changed = append(reverted.Changed, strings.TrimPrefix(key, "publishers:"))
+		}
+	}
+
+	for member := range s.presenceContributions[serverID] {
+		s.leavePresence(serverID, member)
+		reverted.Left = append(reverted.Left, member)
+		reverted.Changed = append(reverted.Changed, member.AppChannel)
+	}
+
+	delete(s.contributions, serverID)
+	delete(s.presenceContributions, serverID)
+	delete(s.leases, serverID)
+
+	return reverted, nil
+}
+
+func (s *MemoryStore) TakeToken(ctx context.Context, bucket string, perSecond int64, burst int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.tokensTaken++; s.tokensTaken%1024 == 0 {
+		for key, b := range s.buckets {
+			if b.Idle(now) {
+				delete(s.buckets, key)
+			}
+		}
+	}
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = ratelimit.NewBucket(float64(perSecond), float64(burst))
+		s.buckets[bucket] = b
+	}
+
+	return b.Allow(now), nil
+}
+
+func (s *MemoryStore) ReturnToken(ctx context.Context, bucket string, perSecond int64, burst int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forgotten buckets are full.
+	if b, ok := s.buckets[bucket]; ok {
+		b.Return(time.Now())
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
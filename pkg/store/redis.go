@@ -0,0 +1,422 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Set with the IDs of every server holding contributions.
+const serversKey = "servers"
+
+func leaseKey(serverID string) string {
+	return "server-lease:" + serverID
+}
+
+func reapLockKey(serverID string) string {
+	return "server-reap-lock:" + serverID
+}
+
+// Hash of counter key -> amount contributed by the server.
+func contributionsKey(serverID string) string {
+	return "server-contributions:" + serverID
+}
+
+// Set of "<app-id>:<channel-name>|<session-id>" for the presence members of the server.
+func presenceContributionsKey(serverID string) string {
+	return "server-presence:" + serverID
+}
+
+// Increments a shared counter and records the contribution of the server. Returns the new value of the counter.
+//
+// KEYS[1]: counter, KEYS[2]: contributions of the server.
+var incrCounterScript = redis.NewScript(`
+local value = redis.call("INCR", KEYS[1])
+redis.call("HINCRBY", KEYS[2], KEYS[1], 1)
+return value
+`)
+
+// Decrements a shared counter by up to ARGV[1] without going below zero, records the amount actually subtracted as
+// the contribution of the server and deletes the counter when it reaches zero. Returns what's left in the counter, or
+// -1 if there was nothing to decrement, so only the caller that empties the counter sees 0.
+//
+// KEYS[1]: counter, KEYS[2]: contributions of the server.
+var decrCounterScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if current <= 0 then
+	redis.call("DEL", KEYS[1])
+	return -1
+end
+
+local decrBy = math.min(tonumber(ARGV[1]), current)
+redis.call("HINCRBY", KEYS[2], KEYS[1], -decrBy)
+
+local left = redis.call("DECRBY", KEYS[1], decrBy)
+if left <= 0 then
+	redis.call("DEL", KEYS[1])
+end
+
+return left
+`)
+
+// Increments the clients of an app unless there are ARGV[1] (0 means no limit) already, recording the contribution of
+// the server and updating the peak clients. Returns the new number of clients, or -1 if it's at the limit.
+//
+// KEYS[1]: current clients, KEYS[2]: contributions of the server, KEYS[3]: peak clients.
+var addClientScript = redis.NewScript(`
+local max = tonumber(ARGV[1])
+if max > 0 and tonumber(redis.call("GET", KEYS[1]) or "0") >= max then
+	return -1
+end
+
+local value = redis.call("INCR", KEYS[1])
+redis.call("HINCRBY", KEYS[2], KEYS[1], 1)
+if value > tonumber(redis.call("GET", KEYS[3]) or "0") then
+	redis.call("SET", KEYS[3], value)
+end
+
+return value
+`)
+
+// Takes a token from a token bucket holding up to ARGV[3] tokens and refilling at ARGV[2] tokens per second, the time
+// is ARGV[1] in milliseconds. The bucket expires once it would be full again. Returns 1 if a token was taken.
+//
+// KEYS[1]: bucket.
+var takeTokenScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local perSecond = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * perSecond / 1000)
+	last = now
+end
+
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "last", last)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * 1000 / perSecond) + 1)
+return taken
+`)
+
+// Puts back a token taken with takeTokenScript, see it for the arguments. Buckets that expired are full already.
+//
+// KEYS[1]: bucket.
+var returnTokenScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local perSecond = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+if not bucket[1] then
+	return 0
+end
+
+local tokens = tonumber(bucket[1])
+local last = tonumber(bucket[2]) or now
+if now > last then
+	tokens = tokens + (now - last) * perSecond / 1000
+	last = now
+end
+
+tokens = math.min(burst, tokens + 1)
+redis.call("HSET", KEYS[1], "tokens", tokens, "last", last)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * 1000 / perSecond) + 1)
+return 1
+`)
+
+// Renews the lease of the server ARGV[1] for ARGV[3] milliseconds, the time is ARGV[2]. Returns 1 if the server was
+// still known, servers are forgotten once their contributions are reverted.
+//
+// KEYS[1]: lease of the server, KEYS[2]: servers.
+var renewLeaseScript = redis.NewScript(`
+local added = redis.call("SADD", KEYS[2], ARGV[1])
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1 - added
+`)
+
+// Claims a server for the reaper ARGV[1] for ARGV[2] milliseconds unless its lease exists or another reaper claimed it
+// already. Returns 1 if it was claimed.
+//
+// KEYS[1]: lease of the server, KEYS[2]: reap lock of the server.
+var claimServerScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+
+if redis.call("SET", KEYS[2], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+
+return 0
+`)
+
+// RedisStore is a ChannelStore shared by every server through redis.
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisStore returns a RedisStore using the client.
+func NewRedisStore(rdb *redis.Client) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func (s *RedisStore) incr(ctx context.Context, serverID string, key string) (int64, error) {
+	return incrCounterScript.Run(ctx, s.rdb, []string{key, contributionsKey(serverID)}).Int64()
+}
+
+func (s *RedisStore) decr(ctx context.Context, serverID string, key string, decrBy int64) (emptied bool, err error) {
+	left, err := decrCounterScript.Run(ctx, s.rdb, []string{key, contributionsKey(serverID)}, decrBy).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return left == 0, nil
+}
+
+func (s *RedisStore) AddSubscriber(ctx context.Context, serverID string, appChannel string) (occupied bool, err error) {
+	subscribers, err := s.incr(ctx, serverID, subscribersKey(appChannel))
+	return subscribers == 1, err
+}
+
+func (s *RedisStore) RemoveSubscribers(ctx context.Context, serverID string, appChannel string, count int64) (vacated bool, err error) {
+	return s.decr(ctx, serverID, subscribersKey(appChannel), count)
+}
+
+func (s *RedisStore) AddPublisher(ctx context.Context, serverID string, appChannel string) error {
+	_, err := s.incr(ctx, serverID, publishersKey(appChannel))
+	return err
+}
+
+func (s *RedisStore) RemovePublishers(ctx context.Context, serverID string, appChannel string, count int64) error {
+	_, err := s.decr(ctx, serverID, publishersKey(appChannel), count)
+	return err
+}
+
+func (s *RedisStore) AddClient(ctx context.Context, serverID string, appID string, max int64) (currentClients int64, admitted bool, err error) {
+	keys := []string{currentClientsKey(appID), contributionsKey(serverID), peakClientsKey(appID)}
+	currentClients, err = addClientScript.Run(ctx, s.rdb, keys, max).Int64()
+	if err != nil || currentClients < 0 {
+		return 0, false, err
+	}
+
+	return currentClients, true, nil
+}
+
+func (s *RedisStore) RemoveClients(ctx context.Context, serverID string, appID string, count int64) error {
+	_, err := s.decr(ctx, serverID, currentClientsKey(appID), count)
+	return err
+}
+
+func (s *RedisStore) CountPublishedMessage(ctx context.Context, appID string) error {
+	return s.rdb.Incr(ctx, publishedMessagesKey(appID)).Err()
+}
+
+func (s *RedisStore) EnterPresence(ctx context.Context, serverID string, appChannel string, sessionID string, data []byte) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, presenceKey(appChannel), sessionID, data)
+		pipe.SAdd(ctx, presenceContributionsKey(serverID), appChannel+"|"+sessionID)
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) LeavePresence(ctx context.Context, serverID string, appChannel string, sessionID string) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, presenceKey(appChannel), sessionID)
+		pipe.SRem(ctx, presenceContributionsKey(serverID), appChannel+"|"+sessionID)
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) AppendHistory(ctx context.Context, appChannel string, entry []byte, max int64, ttl time.Duration) error {
+	key := historyKey(appChannel)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, entry)
+		pipe.LTrim(ctx, key, -max, -1)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		} else {
+			pipe.Persist(ctx, key)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) History(ctx context.Context, appChannel string) ([][]byte, error) {
+	entries, err := s.rdb.LRange(ctx, historyKey(appChannel), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([][]byte, len(entries))
+	for i, entry := range entries {
+		history[i] = []byte(entry)
+	}
+
+	return history, nil
+}
+
+func (s *RedisStore) Occupancy(ctx context.Context, appChannel string) (*Occupancy, error) {
+	var subscribers, publishers *redis.StringCmd
+	var presenceMembers *redis.IntCmd
+
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		subscribers = pipe.Get(ctx, subscribersKey(appChannel))
+		publishers = pipe.Get(ctx, publishersKey(appChannel))
+		presenceMembers = pipe.HLen(ctx, presenceKey(appChannel))
+		return nil
+	})
+
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	occupancy := &Occupancy{PresenceMembers: presenceMembers.Val()}
+	occupancy.Subscribers, _ = subscribers.Int64()
+	occupancy.Publishers, _ = publishers.Int64()
+
+	return occupancy, nil
+}
+
+func (s *RedisStore) Channels(ctx context.Context, appID string, prefix string, cursor uint64) (channels []string, nextCursor uint64, err error) {
+	keyPrefix := subscribersKey(appID + ":")
+	keys, nextCursor, err := s.rdb.Scan(ctx, cursor, keyPrefix+prefix+"*", 100).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// SCAN can return the same key more than once.
+	seen := make(map[string]bool)
+	channels = make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			channels = append(channels, strings.TrimPrefix(key, keyPrefix))
+		}
+	}
+
+	return channels, nextCursor, nil
+}
+
+func (s *RedisStore) RenewLease(ctx context.Context, serverID string) (owned bool, err error) {
+	known, err := renewLeaseScript.Run(ctx, s.rdb, []string{leaseKey(serverID), serversKey}, serverID, time.Now().Unix(), LeaseTTL.Milliseconds()).Int64()
+	return known == 1, err
+}
+
+func (s *RedisStore) ClaimExpiredServers(ctx context.Context, reaperID string) ([]string, error) {
+	servers, err := s.rdb.SMembers(ctx, serversKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]string, 0)
+	for _, serverID := range servers {
+		if serverID == reaperID {
+			continue
+		}
+
+		// Only one server reverts the contributions of a dead server, and only if its lease didn't come back.
+		claimed, err := claimServerScript.Run(ctx, s.rdb, []string{leaseKey(serverID), reapLockKey(serverID)}, reaperID, reapLockTTL.Milliseconds()).Int64()
+		if err != nil {
+			return nil, err
+		}
+
+		if claimed != 1 {
+			continue
+		}
+
+		expired = append(expired, serverID)
+	}
+
+	return expired, nil
+}
+
+func (s *RedisStore) Revert(ctx context.Context, serverID string) (*Reverted, error) {
+	contributions, err := s.rdb.HGetAll(ctx, contributionsKey(serverID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := &Reverted{}
+	for key, value := range contributions {
+		contributed, _ := strconv.ParseInt(value, 10, 64)
+		if contributed <= 0 {
+			s.rdb.HDel(ctx, contributionsKey(serverID), key)
+			continue
+		}
+
+		// The contribution drops to zero as it's reverted so it's never reverted twice if this is interrupted.
+		emptied, err := s.decr(ctx, serverID, key, contributed)
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(key, "subscribers:") {
+			channel := strings.TrimPrefix(key, "subscribers:")
+			if emptied {
+				reverted.Vacated = append(reverted.Vacated, channel)
+			}
+
+			reverted.Changed = append(reverted.Changed, channel)
+		} else if strings.HasPrefix(key, "publishers:") {
+			reverted.Changed = append(reverted.Changed, strings.TrimPrefix(key, "publishers:"))
+		}
+	}
+
+	members, err := s.rdb.SMembers(ctx, presenceContributionsKey(serverID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		memberParts := strings.Split(member, "|")
+		if len(memberParts) != 2 {
+			continue
+		}
+
+		appChannel, sessionID := memberParts[0], memberParts[1]
+		if err := s.LeavePresence(ctx, serverID, appChannel, sessionID); err != nil {
+			continue
+		}
+
+		reverted.Left = append(reverted.Left, PresenceMember{AppChannel: appChannel, SessionID: sessionID})
+		reverted.Changed = append(reverted.Changed, appChannel)
+	}
+
+	s.rdb.Del(ctx, contributionsKey(serverID), presenceContributionsKey(serverID), leaseKey(serverID))
+	s.rdb.SRem(ctx, serversKey, serverID)
+
+	return reverted, nil
+}
+
+func (s *RedisStore) TakeToken(ctx context.Context, bucket string, perSecond int64, burst int64) (bool, error) {
+	now := time.Now().UnixMilli()
+	taken, err := takeTokenScript.Run(ctx, s.rdb, []string{rateLimitKey(bucket)}, now, perSecond, burst).Int64()
+	return taken == 1, err
+}
+
+func (s *RedisStore) ReturnToken(ctx context.Context, bucket string, perSecond int64, burst int64) error {
+	now := time.Now().UnixMilli()
+	return returnTokenScript.Run(ctx, s.rdb, []string{rateLimitKey(bucket)}, now, perSecond, burst).Err()
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.rdb.Ping(ctx).Err()
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ChannelStore keeps the state of channels shared by every server: how many clients are subscribed to and can publish
+// on every channel, who's present on them, their persisted history and the usage of every app.
+//
+// Channels are identified by "<app-id>:<channel-name>". Every server records what it adds to the counters and presence
+// sets under its ID so it can be reverted if the server goes away without cleaning up (see Revert).
+type ChannelStore interface {
+	// AddSubscriber adds a subscriber to the channel, occupied is true for exactly one caller every time the channel
+	// goes from having no subscribers to having one.
+	AddSubscriber(ctx context.Context, serverID string, appChannel string) (occupied bool, err error)
+
+	// RemoveSubscribers removes count subscribers from the channel, vacated is true for exactly one caller every time the
+	// channel is left without subscribers.
+	RemoveSubscribers(ctx context.Context, serverID string, appChannel string, count int64) (vacated bool, err error)
+
+	// AddPublisher adds a publisher to the channel.
+	AddPublisher(ctx context.Context, serverID string, appChannel string) error
+
+	// RemovePublishers removes count publishers from the channel.
+	RemovePublishers(ctx context.Context, serverID string, appChannel string, count int64) error
+
+	// AddClient adds a connected client to the app and updates its peak clients for the month unless the app already
+	// has max clients connected (0 means no limit). Returns the clients of the app connected right now.
+	AddClient(ctx context.Context, serverID string, appID string, max int64) (currentClients int64, admitted bool, err error)
+
+	// RemoveClients removes count connected clients from the app.
+	RemoveClients(ctx context.Context, serverID string, appID string, count int64) error
+
+	// CountPublishedMessage counts a message published by the app this month.
+	CountPublishedMessage(ctx context.Context, appID string) error
+
+	// EnterPresence adds the session to the presence set of the channel.
+	EnterPresence(ctx context.Context, serverID string, appChannel string, sessionID string, data []byte) error
+
+	// LeavePresence removes the session from the presence set of the channel.
+	LeavePresence(ctx context.Context, serverID string, appChannel string, sessionID string) error
+
+	// AppendHistory appends the entry to the history of the channel keeping at most max entries, the history expires
+	// after ttl without new entries unless it's 0.
+	AppendHistory(ctx context.Context, appChannel string, entry []byte, max int64, ttl time.Duration) error
+
+	// History returns the history of the channel, oldest entry first.
+	History(ctx context.Context, appChannel string) ([][]byte, error)
+
+	// Occupancy returns the occupancy of the channel.
+	Occupancy(ctx context.Context, appChannel string) (*Occupancy, error)
+
+	// Channels returns a page of the channels of the app with subscribers whose names start with prefix, starting at
+	// cursor. The returned cursor is 0 when there are no more pages.
+	Channels(ctx context.Context, appID string, prefix string, cursor uint64) (channels []string, nextCursor uint64, err error)
+
+	// RenewLease renews the lease of the server, which lasts LeaseTTL. owned is false if the server had no lease, e.g.
+	// because it expired and its contributions were reverted, in which case the server has to add them again.
+	RenewLease(ctx context.Context, serverID string) (owned bool, err error)
+
+	// ClaimExpiredServers returns the servers whose lease expired, claiming them for the reaper so no other server
+	// reverts them at the same time.
+	ClaimExpiredServers(ctx context.Context, reaperID string) ([]string, error)
+
+	// Revert reverts everything the server added to the counters and presence sets and forgets about the server.
+	Revert(ctx context.Context, serverID string) (*Reverted, error)
+
+	// TakeToken takes a token from the bucket shared by every server, which holds up to burst tokens and refills at
+	// perSecond tokens per second. Returns false if the bucket is empty.
+	TakeToken(ctx context.Context, bucket string, perSecond int64, burst int64) (bool, error)
+
+	// ReturnToken puts back a token taken from the bucket with TakeToken, e.g. when what it was taken for didn't
+	// happen after all. The bucket never holds more than burst tokens.
+	ReturnToken(ctx context.Context, bucket string, perSecond int64, burst int64) error
+
+	// Ping checks the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+const (
+	// How long the lease of a server lasts without being renewed.
+	LeaseTTL = 30 * time.Second
+
+	// How long a reaper has to revert the contributions of a dead server before another one can try.
+	reapLockTTL = time.Minute
+)
+
+// Occupancy of a channel across every server.
+type Occupancy struct {
+	Subscribers     int64 `json:"subscribers"`
+	Publishers      int64 `json:"publishers"`
+	PresenceMembers int64 `json:"presence_members"`
+}
+
+// PresenceMember is a session present on a channel.
+type PresenceMember struct {
+	AppChannel string
+	SessionID  string
+}
+
+// Reverted is what changed when the contributions of a server were reverted.
+type Reverted struct {
+	// Channels left without subscribers.
+	Vacated []string
+
+	// Channels whose occupancy changed.
+	Changed []string
+
+	// Sessions removed from presence sets.
+	Left []PresenceMember
+}
+
+func subscribersKey(appChannel string) string {
+	return "subscribers:" + appChannel
+}
+
+func publishersKey(appChannel string) string {
+	return "publishers:" + appChannel
+}
+
+func currentClientsKey(appID string) string {
+	return "current-clients:" + appID
+}
+
+func presenceKey(appChannel string) string {
+	return "presence:" + appChannel
+}
+
+func historyKey(appChannel string) string {
+	return "history:" + appChannel
+}
+
+func rateLimitKey(bucket string) string {
+	return "rate-limit:" + bucket
+}
+
+// Peak clients of the app this month (for pricing and analytics).
+func peakClientsKey(appID string) string {
+	year, month, _ := time.Now().UTC().Date()
+	return fmt.Sprintf("peak-clients:%s:%d-%d", appID, month, year)
+}
+
+// Published messages of the app this month (for pricing and analytics).
+func publishedMessagesKey(appID string) string {
+	year, month, _ := time.Now().UTC().Date()
+	return fmt.Sprintf("published-messages:%s:%d-%d", appID, month, year)
+}
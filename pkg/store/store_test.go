@@ -0,0 +1,285 @@
+package store
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var ctx = context.Background()
+
+// Connects to the redis at MYCELIUM_TEST_REDIS_ADDR, or to an in-memory one if it isn't set.
+func newTestRedisStore(t *testing.T) ChannelStore {
+	addr := os.Getenv("MYCELIUM_TEST_REDIS_ADDR")
+	if addr == "" {
+		mr := miniredis.RunT(t)
+		addr = mr.Addr()
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: addr, PoolSize: 64})
+	t.Cleanup(func() { rdb.Close() })
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Fatalf("failed to connect to redis at %s: %s", addr, err)
+	}
+
+	return NewRedisStore(rdb)
+}
+
+// Runs the test against every ChannelStore.
+func testStores(t *testing.T, test func(t *testing.T, s ChannelStore)) {
+	t.Run("redis", func(t *testing.T) { test(t, newTestRedisStore(t)) })
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+}
+
+func TestSubscribersTransitionExactlyOnce(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		channel := "test-app:" + t.Name()
+
+		// Subscribers on several servers join and leave the same channel at once.
+		const servers, subscribersPerServer, rounds = 4, 8, 25
+		var occupied, vacated int64
+		var wg sync.WaitGroup
+		for i := 0; i < servers; i++ {
+			serverID := string(rune('a' + i))
+			t.Cleanup(func() { s.Revert(ctx, serverID) })
+
+			for j := 0; j < subscribersPerServer; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for k := 0; k < rounds; k++ {
+						o, err := s.AddSubscriber(ctx, serverID, channel)
+						if err != nil {
+							t.Errorf("failed to add subscriber: %s", err)
+							return
+						}
+
+						if o {
+							atomic.AddInt64(&occupied, 1)
+						}
+
+						v, err := s.RemoveSubscribers(ctx, serverID, channel, 1)
+						if err != nil {
+							t.Errorf("failed to remove subscriber: %s", err)
+							return
+						}
+
+						if v {
+							atomic.AddInt64(&vacated, 1)
+						}
+					}
+				}()
+			}
+		}
+
+		wg.Wait()
+
+		if occupied == 0 || occupied != vacated {
+			t.Fatalf("expected as many occupied as vacant transitions, but got %d occupied and %d vacant", occupied, vacated)
+		}
+
+		occupancy, err := s.Occupancy(ctx, channel)
+		if err != nil || occupancy.Subscribers != 0 {
+			t.Fatalf("expected no subscribers left, but got %+v (%v)", occupancy, err)
+		}
+	})
+}
+
+func TestRemoveSubscribersNeverGoesBelowZero(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		channel := "test-app:" + t.Name()
+
+		if _, err := s.AddSubscriber(ctx, "server", channel); err != nil {
+			t.Fatalf("failed to add subscriber: %s", err)
+		}
+
+		if vacated, _ := s.RemoveSubscribers(ctx, "server", channel, 3); !vacated {
+			t.Fatalf("expected the channel to be vacated")
+		}
+
+		if vacated, _ := s.RemoveSubscribers(ctx, "server", channel, 1); vacated {
+			t.Fatalf("expected a vacant channel not to be vacated again")
+		}
+
+		channels, _, err := s.Channels(ctx, "test-app", "", 0)
+		if err != nil || len(channels) != 0 {
+			t.Fatalf("expected no channels, but got %v (%v)", channels, err)
+		}
+
+		// Only what was removed counts against the server, so reverting it removes the subscribers it adds later.
+		s.AddSubscriber(ctx, "server", channel)
+		s.Revert(ctx, "server")
+
+		occupancy, err := s.Occupancy(ctx, channel)
+		if err != nil || occupancy.Subscribers != 0 {
+			t.Fatalf("expected no subscribers left, but got %+v (%v)", occupancy, err)
+		}
+	})
+}
+
+func TestClaimExpiredServers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	s := NewRedisStore(rdb)
+
+	s.RenewLease(ctx, "dead")
+	s.RenewLease(ctx, "alive")
+	mr.FastForward(LeaseTTL + time.Second)
+	s.RenewLease(ctx, "alive")
+
+	servers, err := s.ClaimExpiredServers(ctx, "reaper")
+	if err != nil || len(servers) != 1 || servers[0] != "dead" {
+		t.Fatalf("expected only the dead server to be claimed, but got %v (%v)", servers, err)
+	}
+
+	// Claimed servers aren't claimed again by other reapers.
+	if servers, err := s.ClaimExpiredServers(ctx, "other-reaper"); err != nil || len(servers) != 0 {
+		t.Fatalf("expected no servers to be claimed, but got %v (%v)", servers, err)
+	}
+
+	mr.Close()
+	if _, err := s.ClaimExpiredServers(ctx, "reaper"); err == nil {
+		t.Fatalf("expected an error without redis")
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		if owned, err := s.RenewLease(ctx, "server"); err != nil || owned {
+			t.Fatalf("expected the first lease not to be owned, but got %t (%v)", owned, err)
+		}
+
+		if owned, err := s.RenewLease(ctx, "server"); err != nil || !owned {
+			t.Fatalf("expected the lease to be owned, but got %t (%v)", owned, err)
+		}
+
+		// Once its contributions are reverted the server has to add them again.
+		s.Revert(ctx, "server")
+		if owned, err := s.RenewLease(ctx, "server"); err != nil || owned {
+			t.Fatalf("expected the lease not to be owned after reverting, but got %t (%v)", owned, err)
+		}
+	})
+}
+
+func TestRevert(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		s.AddSubscriber(ctx, "dead", "test-app:lobby")
+		s.AddPublisher(ctx, "dead", "test-app:lobby")
+		s.AddSubscriber(ctx, "alive", "test-app:chat")
+		s.AddSubscriber(ctx, "dead", "test-app:chat")
+		s.AddClient(ctx, "dead", "test-app", 0)
+		s.EnterPresence(ctx, "dead", "test-app:lobby", "session", []byte("{}"))
+
+		reverted, err := s.Revert(ctx, "dead")
+		if err != nil {
+			t.Fatalf("failed to revert: %s", err)
+		}
+
+		if len(reverted.Vacated) != 1 || reverted.Vacated[0] != "test-app:lobby" {
+			t.Fatalf("expected only test-app:lobby to be vacated, but got %v", reverted.Vacated)
+		}
+
+		if len(reverted.Left) != 1 || reverted.Left[0].SessionID != "session" {
+			t.Fatalf("expected the session to leave, but got %v", reverted.Left)
+		}
+
+		lobby, _ := s.Occupancy(ctx, "test-app:lobby")
+		if *lobby != (Occupancy{}) {
+			t.Fatalf("expected test-app:lobby to be empty, but got %+v", lobby)
+		}
+
+		chat, _ := s.Occupancy(ctx, "test-app:chat")
+		if chat.Subscribers != 1 {
+			t.Fatalf("expected %d subscriber on test-app:chat, but got %d", 1, chat.Subscribers)
+		}
+
+		// Reverting twice changes nothing.
+		if reverted, _ := s.Revert(ctx, "dead"); len(reverted.Vacated) != 0 || len(reverted.Left) != 0 {
+			t.Fatalf("expected nothing to be reverted again, but got %+v", reverted)
+		}
+	})
+}
+
+func TestAddClientLimit(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		t.Cleanup(func() { s.Revert(ctx, "server") })
+
+		for i := int64(1); i <= 2; i++ {
+			if currentClients, admitted, err := s.AddClient(ctx, "server", "test-app", 2); err != nil || !admitted || currentClients != i {
+				t.Fatalf("expected client %d to be admitted, but got %d, %t (%v)", i, currentClients, admitted, err)
+			}
+		}
+
+		if _, admitted, err := s.AddClient(ctx, "server", "test-app", 2); err != nil || admitted {
+			t.Fatalf("expected the client over the limit to be rejected, but got %t (%v)", admitted, err)
+		}
+
+		s.RemoveClients(ctx, "server", "test-app", 1)
+		if currentClients, admitted, err := s.AddClient(ctx, "server", "test-app", 2); err != nil || !admitted || currentClients != 2 {
+			t.Fatalf("expected a client to be admitted after one left, but got %d, %t (%v)", currentClients, admitted, err)
+		}
+	})
+}
+
+func TestTakeToken(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		for i := 0; i < 3; i++ {
+			if taken, err := s.TakeToken(ctx, "test-app", 1, 3); err != nil || !taken {
+				t.Fatalf("expected token %d to be taken, but got %t (%v)", i, taken, err)
+			}
+		}
+
+		if taken, err := s.TakeToken(ctx, "test-app", 1, 3); err != nil || taken {
+			t.Fatalf("expected the bucket to be empty, but got %t (%v)", taken, err)
+		}
+
+		if taken, err := s.TakeToken(ctx, "other-app", 1, 3); err != nil || !taken {
+			t.Fatalf("expected buckets to be independent, but got %t (%v)", taken, err)
+		}
+
+		// A returned token can be taken again.
+		if err := s.ReturnToken(ctx, "test-app", 1, 3); err != nil {
+			t.Fatalf("failed to return token: %s", err)
+		}
+
+		if taken, err := s.TakeToken(ctx, "test-app", 1, 3); err != nil || !taken {
+			t.Fatalf("expected the returned token to be taken, but got %t (%v)", taken, err)
+		}
+
+		// Buckets don't hold more than the burst.
+		for i := 0; i < 3; i++ {
+			s.ReturnToken(ctx, "other-app", 1, 3)
+		}
+
+		for i := 0; i < 3; i++ {
+			s.TakeToken(ctx, "other-app", 1, 3)
+		}
+
+		if taken, err := s.TakeToken(ctx, "other-app", 1, 3); err != nil || taken {
+			t.Fatalf("expected the bucket to be empty, but got %t (%v)", taken, err)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	testStores(t, func(t *testing.T, s ChannelStore) {
+		for _, entry := range []string{"1", "2", "3"} {
+			if err := s.AppendHistory(ctx, "test-app:lobby", []byte(entry), 2, time.Minute); err != nil {
+				t.Fatalf("failed to append history: %s", err)
+			}
+		}
+
+		history, err := s.History(ctx, "test-app:lobby")
+		if err != nil || len(history) != 2 || string(history[0]) != "2" || string(history[1]) != "3" {
+			t.Fatalf("expected history [2 3], but got %q (%v)", history, err)
+		}
+	})
+}
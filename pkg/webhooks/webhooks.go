@@ -0,0 +1,572 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// Webhook events.
+const (
+	EventChannelOccupied = "channel.occupied"
+	EventChannelVacant   = "channel.vacant"
+	EventPresenceEnter   = "presence.enter"
+	EventPresenceLeave   = "presence.leave"
+	EventChannelMessage  = "channel.message"
+)
+
+// Events lists every webhook event.
+var Events = []string{
+	EventChannelOccupied,
+	EventChannelVacant,
+	EventPresenceEnter,
+	EventPresenceLeave,
+	EventChannelMessage,
+}
+
+const (
+	// NATS queue group used so every event is handled by a single server.
+	queueGroup = "webhooks"
+
+	// Maximum events sent in a single delivery.
+	maxBatchSize = 100
+
+	// How long events are buffered before being delivered.
+	batchInterval = time.Second
+
+	// Maximum deliveries in flight at once.
+	maxConcurrentDeliveries = 32
+
+	// Attempts made to deliver a batch before dead-lettering it.
+	maxAttempts = 5
+
+	// Time allowed for the endpoint to respond to a delivery.
+	deliveryTimeout = 10 * time.Second
+
+	// Maximum dead-lettered deliveries kept per app.
+	maxDeadLetters = 1000
+
+	// How long the webhooks of an app are cached before being loaded again.
+	cacheTTL = 30 * time.Second
+
+	// Time allowed to database and redis operations.
+	operationTimeout = 5 * time.Second
+)
+
+// Event is a single event in a delivery.
+type Event struct {
+	Name      string      `json:"name"`
+	Channel   string      `json:"channel"`
+	Timestamp int64       `json:"timestamp"` // Unix milliseconds.
+	SessionID string      `json:"session_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// Delivery is the body of the requests made to webhook endpoints.
+type Delivery struct {
+	Events []*Event `json:"events"`
+}
+
+// DeadLetter is a delivery that failed every attempt.
+type DeadLetter struct {
+	WebhookID string `json:"webhook_id"`
+	URL       string `json:"url"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	Body      string `json:"body"`
+	FailedAt  int64  `json:"failed_at"` // Unix milliseconds.
+}
+
+type appEvent struct {
+	appID string
+	event *Event
+}
+
+type batch struct {
+	webhook models.Webhook
+	events  []*Event
+}
+
+type cacheEntry struct {
+	webhooks  []models.Webhook
+	expiresAt time.Time
+}
+
+// Dispatcher delivers channel lifecycle, presence and message events to the webhooks of apps.
+type Dispatcher struct {
+	db         *gorm.DB
+	rdb        *redis.Client
+	httpClient *http.Client
+	events     chan *appEvent
+
+	// Pending batches by webhook ID.
+	batches map[string]*batch
+
+	// Base delay between delivery attempts, doubled after every attempt.
+	retryBackoff time.Duration
+
+	// Limits the deliveries in flight.
+	deliveries chan struct{}
+
+	// Deliveries in flight, which are waited for when stopping.
+	sends sync.WaitGroup
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+
+	// Subscriptions to the messages of apps, set once running.
+	messages *broker.AppChannels
+}
+
+// NewDispatcher returns an initialized Dispatcher.
+func NewDispatcher(db *gorm.DB, rdb *redis.Client) *Dispatcher {
+	return &Dispatcher{
+		db:           db,
+		rdb:          rdb,
+		httpClient:   NewHTTPClient(),
+		events:       make(chan *appEvent, 1024),
+		batches:      make(map[string]*batch),
+		retryBackoff: time.Second,
+		deliveries:   make(chan struct{}, maxConcurrentDeliveries),
+		cache:        make(map[string]*cacheEntry),
+	}
+}
+
+// Run subscribes to the events of every server and delivers them in batches until ctx is done, then delivers what's
+// pending, waits for the deliveries in flight and unsubscribes. Deliveries stop retrying once ctx is done, dead-lettering
+// what can't be delivered.
+func (d *Dispatcher) Run(ctx context.Context, b broker.Broker) {
+	subscriptions := make([]broker.Subscription, 0, 3)
+	defer func() {
+		for _, subscription := range subscriptions {
+			subscription.Unsubscribe()
+		}
+	}()
+
+	subscribed := func(subscription broker.Subscription, err error) {
+		if err != nil {
+			logrus.Error(fmt.Sprintf("failed to subscribe to webhook events: %s", err))
+			return
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	subscribed(broker.QueueSubscribeJSON(b, broker.SubjectSituationChange, queueGroup, func(data *websocket.NatsSituationChangeData) {
+		name := EventChannelOccupied
+		if data.Situation == "vacant" {
+			name = EventChannelVacant
+		}
+
+		d.enqueue(data.Channel, &Event{Name: name})
+	}))
+
+	subscribed(broker.QueueSubscribeJSON(b, broker.SubjectPresenceChange, queueGroup, func(data *websocket.NatsPresenceChangeData) {
+		name := EventPresenceEnter
+		if data.Action == protocol.PresenceActionLeave {
+			name = EventPresenceLeave
+		}
+
+		d.enqueue(data.Channel, &Event{Name: name, SessionID: data.SessionID, Data: data.Data})
+	}))
+
+	// Messages are only subscribed to for the apps with channel.message webhooks.
+	messages := broker.NewAppChannels(func(subject string) (broker.Subscription, error) {
+		return broker.QueueSubscribeJSON(b, subject, queueGroup, func(data *websocket.NatsChannelPublishData) {
+			d.enqueue(data.Channel, &Event{Name: EventChannelMessage, Data: map[string]interface{}{
+				"event": data.Event,
+				"data":  data.Data,
+			}})
+		})
+	})
+	defer messages.Close()
+
+	d.mu.Lock()
+	d.messages = messages
+	d.mu.Unlock()
+	d.refreshMessages(messages)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	// Webhooks changed through other servers are picked up as their caches expire.
+	refreshTicker := time.NewTicker(cacheTTL)
+	defer refreshTicker.Stop()
+
+	for {
+		select {
+		case e := <-d.events:
+			d.add(ctx, e)
+
+		case <-ticker.C:
+			d.flush(ctx)
+
+		case <-refreshTicker.C:
+			d.refreshMessages(messages)
+
+		case <-ctx.Done():
+			d.flush(ctx)
+			d.sends.Wait()
+			return
+		}
+	}
+}
+
+// Queues an event which happened on a channel (<app-id>:<channel-name>).
+func (d *Dispatcher) enqueue(appChannel string, event *Event) {
+	// Channel parts: <app-id>:<channel-name>
+	channelParts := strings.Split(appChannel, ":")
+	if len(channelParts) != 2 {
+		return
+	}
+
+	event.Channel = channelParts[1]
+	event.Timestamp = time.Now().UnixMilli()
+
+	select {
+	case d.events <- &appEvent{appID: channelParts[0], event: event}:
+	default:
+		logrus.Error(fmt.Sprintf("dropping webhook event %s on channel %s, the queue is full", event.Name, appChannel))
+	}
+}
+
+// Adds the event to the pending batch of every webhook of the app interested in it.
+func (d *Dispatcher) add(ctx context.Context, e *appEvent) {
+	webhooks, err := d.appWebhooks(e.appID)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to load webhooks of app %s: %s", e.appID, err))
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !slices.Contains(strings.Split(webhook.Events, ","), e.event.Name) {
+			continue
+		}
+
+		if !common.MatchChannelPattern(webhook.Pattern, e.event.Channel) {
+			continue
+		}
+
+		b, ok := d.batches[webhook.ID]
+		if !ok {
+			b = &batch{webhook: webhook}
+			d.batches[webhook.ID] = b
+		}
+
+		b.events = append(b.events, e.event)
+		if len(b.events) >= maxBatchSize {
+			delete(d.batches, webhook.ID)
+			d.send(ctx, b)
+		}
+	}
+}
+
+// Delivers every pending batch.
+func (d *Dispatcher) flush(ctx context.Context) {
+	for id, b := range d.batches {
+		delete(d.batches, id)
+		d.send(ctx, b)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, b *batch) {
+	d.deliveries <- struct{}{}
+	d.sends.Add(1)
+	go func() {
+		defer d.sends.Done()
+		defer func() { <-d.deliveries }()
+		d.deliver(ctx, b.webhook, b.events)
+	}()
+}
+
+// Delivers the events to the webhook, retrying with exponential backoff until ctx is done and dead-lettering the
+// delivery if every attempt fails.
+func (d *Dispatcher) deliver(ctx context.Context, webhook models.Webhook, events []*Event) {
+	body, err := json.Marshal(&Delivery{Events: events})
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to encode delivery for webhook %s: %s", webhook.ID, err))
+		return
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		retry, err := d.post(webhook, body)
+		if err == nil {
+			return
+		}
+
+		lastErr = err
+
+		if !retry || attempt == maxAttempts || !d.backOff(ctx, attempt) {
+			break
+		}
+	}
+
+	logrus.Error(fmt.Sprintf("failed to deliver to webhook %s: %s", webhook.ID, lastErr))
+	d.deadLetter(webhook, body, lastErr)
+}
+
+// Waits before the next attempt, returning false without waiting if ctx is done first.
+func (d *Dispatcher) backOff(ctx context.Context, attempt int) bool {
+	backoff := d.retryBackoff * time.Duration(1<<(attempt-1))
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+
+	timer := time.NewTimer(backoff + jitter)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Makes a single delivery attempt, returning whether it's worth retrying if it fails.
+func (d *Dispatcher) post(webhook models.Webhook, body []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Mycelium-Webhook-Id", webhook.ID)
+	request.Header.Set("X-Mycelium-Timestamp", timestamp)
+	request.Header.Set("X-Mycelium-Signature", Sign(webhook.Secret, timestamp, body))
+
+	response, err := d.httpClient.Do(request)
+	if err != nil {
+		// The endpoint won't become public by retrying.
+		return !errors.Is(err, ErrPrivateAddress), err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors won't go away by retrying, except for rate limiting.
+	retry = response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, errors.New("unexpected status " + response.Status)
+}
+
+func (d *Dispatcher) deadLetter(webhook models.Webhook, body []byte, lastErr error) {
+	entry, err := json.Marshal(&DeadLetter{
+		WebhookID: webhook.ID,
+		URL:       webhook.URL,
+		Attempts:  maxAttempts,
+		LastError: lastErr.Error(),
+		Body:      string(body),
+		FailedAt:  time.Now().UnixMilli(),
+	})
+
+	if err != nil {
+		return
+	}
+
+	// Without redis (single server) dead letters are only logged.
+	if d.rdb == nil {
+		logrus.Error(fmt.Sprintf("delivery for webhook %s failed every attempt: %s", webhook.ID, entry))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+
+	key := DeadLettersKey(webhook.AppID)
+	_, pipeErr := d.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, entry)
+		pipe.LTrim(ctx, key, 0, maxDeadLetters-1)
+		return nil
+	})
+
+	if pipeErr != nil {
+		logrus.Error(fmt.Sprintf("failed to dead-letter delivery for webhook %s", webhook.ID))
+	}
+}
+
+// Invalidate drops the cached webhooks of the app so they're loaded again on the next event, and subscribes to the
+// messages of the app or unsubscribes from them depending on whether it still has channel.message webhooks.
+func (d *Dispatcher) Invalidate(appID string) {
+	d.mu.Lock()
+	delete(d.cache, appID)
+	messages := d.messages
+	d.mu.Unlock()
+
+	if messages == nil {
+		return
+	}
+
+	err := messages.RefreshApp(appID, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		var count int64
+		result := d.messageWebhooks(ctx).Where("app_id = ?", appID).Count(&count)
+		return count > 0, result.Error
+	})
+
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the messages of app %s: %s", appID, err))
+	}
+}
+
+// Subscribes to the messages of the apps with channel.message webhooks only.
+func (d *Dispatcher) refreshMessages(messages *broker.AppChannels) {
+	err := messages.Refresh(func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		var appIDs []string
+		result := d.messageWebhooks(ctx).Distinct().Pluck("app_id", &appIDs)
+		return appIDs, result.Error
+	})
+
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the messages of apps with webhooks: %s", err))
+	}
+}
+
+// Returns a query of the webhooks with the channel.message event.
+func (d *Dispatcher) messageWebhooks(ctx context.Context) *gorm.DB {
+	return d.db.WithContext(ctx).Model(&models.Webhook{}).Where("events LIKE ?", "%"+EventChannelMessage+"%")
+}
+
+func (d *Dispatcher) appWebhooks(appID string) ([]models.Webhook, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[appID]
+	d.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.webhooks, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+
+	var webhooks []models.Webhook
+	if result := d.db.WithContext(ctx).Find(&webhooks, "app_id = ?", appID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	d.mu.Lock()
+	d.cache[appID] = &cacheEntry{webhooks: webhooks, expiresAt: time.Now().Add(cacheTTL)}
+	d.mu.Unlock()
+
+	return webhooks, nil
+}
+
+// ErrPrivateAddress is returned when a request would be made to the network of the server.
+var ErrPrivateAddress = errors.New("requests can't be made to loopback, private or link-local addresses")
+
+// Addresses outside the loopback, private and link-local ranges that aren't public either.
+var reservedNetworks = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// publicIP reports whether requests can be made to the IP, which has to be a public unicast address so webhooks and
+// integrations can't reach the network of the server.
+func publicIP(ip net.IP) bool {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidateURL returns an error unless the URL is an absolute http or https URL whose host only resolves to public
+// addresses. Deliveries check the addresses again when connecting, in case the host resolves to others by then.
+func ValidateURL(ctx context.Context, rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+		return errors.New("invalid url, must be an absolute http or https url")
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, parsedURL.Hostname())
+	if err != nil {
+		return errors.New("invalid url, its host can't be resolved")
+	}
+
+	for _, address := range addresses {
+		if !publicIP(address.IP) {
+			return errors.New("invalid url, " + ErrPrivateAddress.Error())
+		}
+	}
+
+	return nil
+}
+
+// NewHTTPClient returns the client requests to the endpoints of apps are made with, which refuses to connect to
+// addresses that aren't public whatever their host resolves to. Requests don't go through proxies, which would connect
+// on their behalf.
+func NewHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: deliveryTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !publicIP(net.ParseIP(host)) {
+				return ErrPrivateAddress
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: deliveryTimeout, Transport: transport}
+}
+
+// DeadLettersKey returns the redis key of the list with the dead-lettered deliveries of the app, newest first.
+func DeadLettersKey(appID string) string {
+	return "webhooks-dead-letters:" + appID
+}
+
+// Sign returns the signature sent in the X-Mycelium-Signature header: the hex encoded HMAC-SHA256 of
+// "<timestamp>.<body>" using the secret of the webhook.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,195 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestDispatcher() *Dispatcher {
+	// Nothing listens on this address, dead-lettering fails and is only logged.
+	d := NewDispatcher(nil, redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}))
+	d.retryBackoff = time.Millisecond
+
+	// The endpoints of the tests listen on loopback addresses.
+	d.httpClient = &http.Client{Timeout: deliveryTimeout}
+	return d
+}
+
+func TestDeliverRefusesPrivateAddresses(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(nil, nil)
+	retry, err := d.post(models.Webhook{ID: "webhook", URL: server.URL}, []byte("{}"))
+	if !errors.Is(err, ErrPrivateAddress) || retry {
+		t.Fatalf("expected %v without retrying, but got %v (retry %v)", ErrPrivateAddress, err, retry)
+	}
+
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("expected no requests, but got %d", requests)
+	}
+
+	for _, rawURL := range []string{"http://127.0.0.1", "http://10.0.0.1/hook", "http://169.254.169.254/latest", "http://[::1]:8080", "ftp://example.com"} {
+		if err := ValidateURL(context.Background(), rawURL); err == nil {
+			t.Fatalf("expected %s to be rejected", rawURL)
+		}
+	}
+
+	if err := ValidateURL(context.Background(), "https://93.184.216.34/hook"); err != nil {
+		t.Fatalf("expected a public address to be accepted, but got %v", err)
+	}
+}
+
+func TestDeliverRetriesAndSigns(t *testing.T) {
+	var requests int32
+	webhook := models.Webhook{ID: "webhook", AppID: "app", Secret: "secret"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		signature := Sign(webhook.Secret, r.Header.Get("X-Mycelium-Timestamp"), body)
+		if r.Header.Get("X-Mycelium-Signature") != signature {
+			t.Errorf("expected signature %q, but got %q", signature, r.Header.Get("X-Mycelium-Signature"))
+		}
+
+		var delivery Delivery
+		if err := json.Unmarshal(body, &delivery); err != nil || len(delivery.Events) != 2 {
+			t.Errorf("expected a delivery with 2 events, but got %s", body)
+		}
+
+		// Fail the first two attempts.
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	webhook.URL = server.URL
+	d := newTestDispatcher()
+	d.deliver(context.Background(), webhook, []*Event{
+		{Name: EventChannelOccupied, Channel: "lobby"},
+		{Name: EventPresenceEnter, Channel: "lobby", SessionID: "session"},
+	})
+
+	if requests != 3 {
+		t.Fatalf("expected %d attempts, but got %d", 3, requests)
+	}
+}
+
+func TestDeliverDoesNotRetryClientErrors(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher()
+	d.deliver(context.Background(), models.Webhook{ID: "webhook", AppID: "app", Secret: "secret", URL: server.URL}, []*Event{
+		{Name: EventChannelVacant, Channel: "lobby"},
+	})
+
+	if requests != 1 {
+		t.Fatalf("expected %d attempt, but got %d", 1, requests)
+	}
+}
+
+func TestDeliverGivesUpAfterMaxAttempts(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher()
+	d.deliver(context.Background(), models.Webhook{ID: "webhook", AppID: "app", Secret: "secret", URL: server.URL}, []*Event{
+		{Name: EventChannelVacant, Channel: "lobby"},
+	})
+
+	if requests != maxAttempts {
+		t.Fatalf("expected %d attempts, but got %d", maxAttempts, requests)
+	}
+}
+
+func TestBatchesByWebhook(t *testing.T) {
+	d := newTestDispatcher()
+	d.cache["app"] = &cacheEntry{
+		webhooks: []models.Webhook{
+			{ID: "occupancy", AppID: "app", Events: "channel.occupied,channel.vacant", Pattern: "*"},
+			{ID: "chat-presence", AppID: "app", Events: "presence.enter", Pattern: "chat-*"},
+		},
+		expiresAt: time.Now().Add(time.Hour),
+	}
+
+	d.add(context.Background(), &appEvent{appID: "app", event: &Event{Name: EventChannelOccupied, Channel: "chat-1"}})
+	d.add(context.Background(), &appEvent{appID: "app", event: &Event{Name: EventPresenceEnter, Channel: "chat-1"}})
+	d.add(context.Background(), &appEvent{appID: "app", event: &Event{Name: EventPresenceEnter, Channel: "lobby"}})
+	d.add(context.Background(), &appEvent{appID: "app", event: &Event{Name: EventChannelMessage, Channel: "chat-1"}})
+
+	if len(d.batches["occupancy"].events) != 1 {
+		t.Fatalf("expected %d event for webhook occupancy, but got %d", 1, len(d.batches["occupancy"].events))
+	}
+
+	if len(d.batches["chat-presence"].events) != 1 {
+		t.Fatalf("expected %d event for webhook chat-presence, but got %d", 1, len(d.batches["chat-presence"].events))
+	}
+}
+
+func TestDeliverStopsRetryingOnceStopped(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d := newTestDispatcher()
+	d.retryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cache["app"] = &cacheEntry{
+		webhooks:  []models.Webhook{{ID: "webhook", AppID: "app", Secret: "secret", URL: server.URL, Events: "channel.vacant", Pattern: "*"}},
+		expiresAt: time.Now().Add(time.Hour),
+	}
+	d.add(ctx, &appEvent{appID: "app", event: &Event{Name: EventChannelVacant, Channel: "lobby"}})
+	d.flush(ctx)
+
+	// The delivery is attempted once more and dead-lettered instead of backing off for an hour.
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.sends.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the delivery to stop retrying")
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected %d attempt, but got %d", 1, requests)
+	}
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes of the connections rejected by admission control.
+const (
+	closeCodeServerFull = 4031
+	closeCodeAppFull    = 4032
+	closeCodeIPFull     = 4033
+)
+
+// admission counts the connections of the server and of every IP on it, the connections of every app are counted
+// by the channel store across every server (see Client.track).
+type admission struct {
+	mu            sync.Mutex
+	connections   int
+	ipConnections map[string]int
+}
+
+func newAdmission() *admission {
+	return &admission{ipConnections: make(map[string]int)}
+}
+
+// Admit admits a connection from the IP unless the server or the IP are at their limit, returning a function that
+// releases it once the connection is closed or the close message to reject it with.
+func (h *Hub) Admit(ip string) (release func(), closeMessage []byte) {
+	a := h.admission
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if h.Options.MaxConnections > 0 && a.connections >= h.Options.MaxConnections {
+		return nil, websocket.FormatCloseMessage(closeCodeServerFull, "too many connections to the server")
+	}
+
+	if h.Options.MaxConnectionsPerIP > 0 && a.ipConnections[ip] >= h.Options.MaxConnectionsPerIP {
+		return nil, websocket.FormatCloseMessage(closeCodeIPFull, "too many connections from your IP")
+	}
+
+	a.connections++
+	a.ipConnections[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+
+			a.connections--
+			if a.ipConnections[ip]--; a.ipConnections[ip] <= 0 {
+				delete(a.ipConnections, ip)
+			}
+		})
+	}, nil
+}
@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,14 +10,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gmencz/mycelium/pkg/broker"
 	"github.com/gmencz/mycelium/pkg/common"
 	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/origins"
 	"github.com/gmencz/mycelium/pkg/protocol"
-	"github.com/go-redis/redis/v8"
+	"github.com/gmencz/mycelium/pkg/ratelimit"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
 	"gorm.io/gorm"
@@ -24,36 +29,52 @@ import (
 
 type Client struct {
 	hub                        *Hub
+	ctx                        context.Context
+	cancel                     context.CancelFunc
 	sessionID                  string
-	Ws                         *websocket.Conn
+	transport                  Transport
 	apiKeyID                   string
 	AppID                      string
 	capabilities               map[string]string
+	channelRules               *rules.Store
+	channelSchemas             *schemas.Store
 	channels                   []string
+	patterns                   []string
+	presence                   []string
+	presenceData               map[string][]byte // Data of the client on the channels it's present on.
+	publishing                 []string
 	SituationListeningPrefixes []string
-	messagesSentLastSecond     int
+	OccupancyListeningPrefixes []string
+	messages                   *ratelimit.Bucket
+	rejectedMessages           int
+	maxAppConnections          int64
+	publishesUnsubscribed      bool         // Publishing on a channel doesn't require subscribing to it, e.g. over MQTT.
+	subscribesPatterns         bool         // Subscribing to channel patterns, e.g. over MQTT.
+	listeningMu                sync.RWMutex // Guards the listening prefixes, which the hub reads.
+	contributionsMu            sync.Mutex   // Guards channels, publishing and presence, which the hub reads to restore them.
 	mu                         sync.Mutex
 }
 
-const (
-	// Time allowed to read the next pong message from the client.
-	pongWait = 60 * time.Second
-
-	// Send pings to the client with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer (1MB).
-	maxMessageSize = 1048576
+// NewClient tries to authenticate the connection and returns a new client if successful.
+func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, hub *Hub) (c *Client, closeMessage []byte) {
+	return NewTransportClient(request, newWSTransport(ws, &hub.Options), db, channelRules, channelSchemas, allowedOrigins, hub)
+}
 
-	// Maximum channels a client can subscribe to
-	maxChannels = 500
+// NewTransportClient tries to authenticate the request of a connection over the transport and returns a new client
+// if successful.
+func NewTransportClient(request *http.Request, transport Transport, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, hub *Hub) (c *Client, closeMessage []byte) {
+	c, closeMessage = newClient(request, db, channelRules, channelSchemas, allowedOrigins, hub)
+	if closeMessage != nil {
+		return nil, closeMessage
+	}
 
-	// Maximum messages a client can send per second
-	maxMessagesPerSecond = 10
-)
+	c.transport = transport
+	return c, nil
+}
 
-// NewClient tries to authenticate the connection and returns a new client if successful.
-func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, hub *Hub) (c *Client, closeMessage []byte) {
+// newClient tries to authenticate the request of a connection and returns a new client without a transport if
+// successful.
+func newClient(request *http.Request, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, hub *Hub) (c *Client, closeMessage []byte) {
 	key := request.URL.Query().Get("key")
 	token := request.URL.Query().Get("token")
 
@@ -68,6 +89,9 @@ func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, hub *Hub)
 	var capabilities map[string]string
 	var apiKey models.ApiKey
 
+	authCtx, cancelAuth := context.WithTimeout(request.Context(), hub.Options.OperationTimeout)
+	defer cancelAuth()
+
 	if key != "" {
 		// Key format: <api-key-id:api-key-secret>. This authentication method should only be used in trusted environments like in
 		// server side WebSockets.
@@ -79,7 +103,7 @@ func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, hub *Hub)
 		apiKeyID := keyParts[0]
 		apiKeySecret := keyParts[1]
 
-		if result := db.First(&apiKey, "id = ?", apiKeyID); result.Error != nil {
+		if result := db.WithContext(authCtx).First(&apiKey, "id = ?", apiKeyID); result.Error != nil {
 			return nil, websocket.FormatCloseMessage(4001, "invalid key")
 		}
 
@@ -103,13 +127,18 @@ func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, hub *Hub)
 				return nil, errors.New("invalid token, missing kid header")
 			}
 
-			if result := db.First(&apiKey, "id = ?", kid); result.Error != nil {
+			if result := db.WithContext(authCtx).First(&apiKey, "id = ?", kid); result.Error != nil {
 				return nil, errors.New("invalid token kid header")
 			}
 
 			return []byte(apiKey.Secret), nil
 		})
 
+		// The token is nil when it's malformed.
+		if parsedToken == nil {
+			return nil, websocket.FormatCloseMessage(4001, err.Error())
+		}
+
 		if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok && parsedToken.Valid {
 			jwtCapabilities, ok := claims["x-mycelium-capabilities"].(map[string]string)
 			if jwtCapabilities != nil && !ok {
@@ -128,107 +157,103 @@ func NewClient(request *http.Request, ws *websocket.Conn, db *gorm.DB, hub *Hub)
 		}
 	}
 
+	appOrigins, err := allowedOrigins.ForApp(authCtx, apiKey.AppID)
+	if err != nil {
+		return nil, websocket.FormatCloseMessage(4500, "internal server error")
+	}
+
+	if !origins.Allowed(appOrigins, request.Header.Get("Origin")) {
+		return nil, websocket.FormatCloseMessage(4003, "origin not allowed")
+	}
+
+	var app models.App
+	if result := db.WithContext(authCtx).Select("max_connections").First(&app, "id = ?", apiKey.AppID); result.Error != nil {
+		return nil, websocket.FormatCloseMessage(4500, "internal server error")
+	}
+
+	maxAppConnections := hub.Options.MaxConnectionsPerApp
+	if app.MaxConnections > 0 {
+		maxAppConnections = app.MaxConnections
+	}
+
+	// Lives as long as the connection.
+	ctx, cancel := context.WithCancel(request.Context())
+
 	return &Client{
-		sessionID:              uuid.NewString(),
-		Ws:                     ws,
-		apiKeyID:               apiKey.ID,
-		AppID:                  apiKey.AppID,
-		capabilities:           capabilities,
-		hub:                    hub,
-		channels:               make([]string, 0),
-		messagesSentLastSecond: 0,
+		ctx:               ctx,
+		cancel:            cancel,
+		sessionID:         uuid.NewString(),
+		apiKeyID:          apiKey.ID,
+		AppID:             apiKey.AppID,
+		capabilities:      capabilities,
+		channelRules:      channelRules,
+		channelSchemas:    channelSchemas,
+		hub:               hub,
+		channels:          make([]string, 0),
+		messages:          ratelimit.NewBucket(float64(hub.Options.MaxMessagesPerSecond), float64(hub.Options.MessageBurst)),
+		maxAppConnections: maxAppConnections,
 	}, nil
 }
 
-// Tracks the client in redis, this is used to calculate pricing and analytics.
-func (c *Client) track(rdb *redis.Client) (closeMessage []byte) {
-	currentClientsKey := "current-clients:" + c.AppID
-	currentClientsResult := rdb.Incr(ctx, currentClientsKey)
-	if currentClientsResult.Err() != nil {
-		return websocket.FormatCloseMessage(4500, "internal server error")
-	}
-	currentClients := currentClientsResult.Val()
+// Tracks the client in the channel store unless the app is at its connection limit, this is also used to calculate
+// pricing and analytics.
+func (c *Client) track(cs store.ChannelStore) (closeMessage []byte) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
 
-	// Peak clients for this month.
-	year, month, _ := time.Now().UTC().Date()
-	peakClientsKey := fmt.Sprintf("peak-clients:%s:%d-%d", c.AppID, month, year)
-	peakClientsExists := rdb.Exists(ctx, peakClientsKey)
-	if peakClientsExists.Err() != nil {
+	_, admitted, err := cs.AddClient(ctx, c.hub.ServerID, c.AppID, c.maxAppConnections)
+	if err != nil {
 		return websocket.FormatCloseMessage(4500, "internal server error")
 	}
 
-	// If it doesn't exist
-	if peakClientsExists.Val() <= 0 {
-		if setPeakClientsResult := rdb.Set(ctx, peakClientsKey, currentClients, 0); setPeakClientsResult.Err() != nil {
-			return websocket.FormatCloseMessage(4500, "internal server error")
-		}
-	} else {
-		peakClientsResult := rdb.Get(ctx, peakClientsKey)
-		if peakClientsResult.Err() != nil {
-			return websocket.FormatCloseMessage(4500, "internal server error")
-		}
-
-		peakClients, peakClientsErr := peakClientsResult.Int64()
-		if peakClientsErr != nil {
-			return websocket.FormatCloseMessage(4500, "internal server error")
-		}
-
-		if currentClients > peakClients {
-			if setPeakClientsResult := rdb.Set(ctx, peakClientsKey, currentClients, 0); setPeakClientsResult.Err() != nil {
-				return websocket.FormatCloseMessage(4500, "internal server error")
-			}
-		}
+	if !admitted {
+		return websocket.FormatCloseMessage(closeCodeAppFull, "too many connections to the app")
 	}
 
 	return nil
 }
 
-func (c *Client) StartSession(rdb *redis.Client) {
-	c.hub.register <- c
-
-	closeMessage := c.track(rdb)
+// StartSession tracks the client and registers it in the hub, returning false if the connection was closed instead.
+// The hub untracks clients when they're unregistered so a client that isn't tracked is never registered.
+func (c *Client) StartSession(cs store.ChannelStore) bool {
+	closeMessage := c.track(cs)
 	if closeMessage != nil {
-		CloseWithMessage(c.Ws, closeMessage)
-		return
+		c.CloseWithMessage(closeMessage)
+		return false
 	}
 
-	c.Ws.SetReadLimit(maxMessageSize)
-	c.Ws.SetReadDeadline(time.Now().Add(pongWait))
-	c.Ws.SetPongHandler(func(string) error { c.Ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	sendToHub(c.hub, c.hub.register, c)
 	c.WriteJSON(protocol.NewHelloMessage(&protocol.HelloMessageData{SessionID: c.sessionID}))
+	return true
 }
 
-func (c *Client) Ping() {
-	ticker := time.NewTicker(pingPeriod)
+// Keepalive keeps the connection alive until it's closed or the transport fails to.
+func (c *Client) Keepalive() {
+	ticker := time.NewTicker(c.hub.Options.pingPeriod())
 
 	defer func() {
-		c.hub.unregister <- c
+		sendToHub(c.hub, c.hub.unregister, c)
 		ticker.Stop()
-		c.Ws.Close()
+		c.transport.Abort()
 	}()
 
-	for range ticker.C {
-		c.Write(websocket.PingMessage, nil)
-	}
-}
-
-func (c *Client) hasCapability(capability string, channel string, capabilities map[string]string) bool {
-	starCapabilities, hasStarCapabilities := capabilities["*"]
-	if hasStarCapabilities {
-		s := strings.Split(starCapabilities, ",")
-		return (slices.Contains(s, "*") || slices.Contains(s, capability))
-	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
 
-	channelCapabilities, hasChannelCapabilities := capabilities[channel]
-	if hasChannelCapabilities {
-		s := strings.Split(channelCapabilities, ",")
-		return (slices.Contains(s, "*") || slices.Contains(s, capability))
+		case <-ticker.C:
+			if err := c.keepalive(); err != nil {
+				return
+			}
+		}
 	}
-
-	return false
 }
 
-func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.EncodedConn) {
+func (c *Client) subscribe(data interface{}, cs store.ChannelStore, b broker.Broker) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
+
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		c.WriteJSON(&protocol.ErrorMessage{
@@ -249,6 +274,11 @@ func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.Encoded
 		return
 	}
 
+	if c.subscribesPatterns && isPattern(d.Channel) {
+		c.subscribePattern(&d)
+		return
+	}
+
 	appChannel := c.AppID + ":" + d.Channel
 	if !common.ValidateString(d.Channel) {
 		c.WriteJSON(&protocol.ErrorMessage{
@@ -271,17 +301,17 @@ func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.Encoded
 		return
 	}
 
-	if len(c.channels) > maxChannels {
+	if len(c.channels)+len(c.patterns) > c.hub.Options.MaxChannels {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
-			Reason:         fmt.Sprintf("you can't subscribe to more than %v channels", maxChannels),
+			Reason:         fmt.Sprintf("you can't subscribe to more than %v channels", c.hub.Options.MaxChannels),
 		})
 
 		return
 	}
 
-	if !c.hasCapability(string(protocol.MessageTypeSubscribe), d.Channel, c.capabilities) {
+	if !HasCapability(string(protocol.MessageTypeSubscribe), d.Channel, c.capabilities) {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
@@ -291,8 +321,8 @@ func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.Encoded
 		return
 	}
 
-	i := rdb.Incr(ctx, "subscribers:"+appChannel)
-	if i.Err() != nil {
+	occupied, err := cs.AddSubscriber(ctx, c.hub.ServerID, appChannel)
+	if err != nil {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
@@ -302,9 +332,8 @@ func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.Encoded
 		return
 	}
 
-	subscribers := i.Val()
-	if subscribers == 1 {
-		situationChangeErr := nc.Publish("situation_change", &NatsSituationChangeData{
+	if occupied {
+		situationChangeErr := broker.PublishJSON(b, broker.SubjectSituationChange, &NatsSituationChangeData{
 			Channel:   appChannel,
 			Situation: "occupied",
 		})
@@ -320,12 +349,61 @@ func (c *Client) subscribe(data interface{}, rdb *redis.Client, nc *nats.Encoded
 		}
 	}
 
+	// Subscribers that are allowed to publish count as publishers of the channel.
+	if HasCapability(string(protocol.MessageTypePublish), d.Channel, c.capabilities) {
+		if err := cs.AddPublisher(ctx, c.hub.ServerID, appChannel); err == nil {
+			c.contributionsMu.Lock()
+			c.publishing = append(c.publishing, appChannel)
+			c.contributionsMu.Unlock()
+		} else {
+			logrus.Error(fmt.Sprintf("failed to track publisher of channel %s", appChannel))
+		}
+	}
+
+	c.contributionsMu.Lock()
 	c.channels = append(c.channels, appChannel)
-	c.hub.subscribe <- &hubSubscription{client: c, channel: appChannel}
-	c.WriteJSON(protocol.NewSubscribeSuccessMessage(&protocol.SubscribeSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+	c.contributionsMu.Unlock()
+
+	c.hub.occupancy.mark(appChannel)
+	if d.Delta {
+		c.hub.deltas.add(appChannel, c)
+	}
+
+	sendToHub(c.hub, c.hub.subscribe, &hubSubscription{client: c, channel: appChannel})
+	c.WriteJSON(protocol.NewSubscribeSuccessMessage(&protocol.SubscribeSuccessMessageData{SequenceNumber: d.SequenceNumber, Delta: d.Delta}))
+
+	if d.History {
+		c.replayHistory(ctx, d.Channel, appChannel, cs)
+	}
+}
+
+// Sends the persisted history of the channel to the client, oldest message first.
+func (c *Client) replayHistory(ctx context.Context, channel string, appChannel string, cs store.ChannelStore) {
+	rule, ruleErr := c.channelRules.ForChannel(ctx, c.AppID, channel)
+	if ruleErr != nil || rule == nil || !rule.PersistHistory {
+		return
+	}
+
+	history, historyErr := cs.History(ctx, appChannel)
+	if historyErr != nil {
+		logrus.Error(fmt.Sprintf("failed to read history of channel %s", appChannel))
+		return
+	}
+
+	for _, entry := range history {
+		var data protocol.PublishMessageData
+		if err := json.Unmarshal(entry, &data); err != nil {
+			continue
+		}
+
+		c.WriteJSON(protocol.NewPublishMessage(&data))
+	}
 }
 
-func (c *Client) unsubscribe(data interface{}, rdb *redis.Client, nc *nats.EncodedConn) {
+func (c *Client) unsubscribe(data interface{}, cs store.ChannelStore, b broker.Broker) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
+
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		c.WriteJSON(&protocol.ErrorMessage{
@@ -346,6 +424,11 @@ func (c *Client) unsubscribe(data interface{}, rdb *redis.Client, nc *nats.Encod
 		return
 	}
 
+	if c.subscribesPatterns && isPattern(d.Channel) {
+		c.unsubscribePattern(&d)
+		return
+	}
+
 	appChannel := c.AppID + ":" + d.Channel
 	if !common.ValidateString(d.Channel) {
 		c.WriteJSON(&protocol.ErrorMessage{
@@ -368,31 +451,31 @@ func (c *Client) unsubscribe(data interface{}, rdb *redis.Client, nc *nats.Encod
 		return
 	}
 
-	key := "subscribers:" + appChannel
-	i := rdb.Decr(ctx, key)
-	if i.Err() != nil {
-		c.WriteJSON(&protocol.ErrorMessage{
-			Type:           protocol.MessageTypeError,
-			SequenceNumber: d.SequenceNumber,
-			Reason:         "internal server error unsubscribing; 1",
-		})
-
-		return
-	}
-
-	subscribersLeft := i.Val()
-	if subscribersLeft <= 0 {
-		if del := rdb.Del(ctx, key); del.Err() != nil {
+	if slices.Contains(c.presence, appChannel) {
+		if err := c.leavePresence(ctx, appChannel, cs, b); err != nil {
 			c.WriteJSON(&protocol.ErrorMessage{
 				Type:           protocol.MessageTypeError,
 				SequenceNumber: d.SequenceNumber,
-				Reason:         "internal server error unsubscribing; 2",
+				Reason:         "internal server error leaving presence",
 			})
 
 			return
 		}
+	}
+
+	vacated, err := cs.RemoveSubscribers(ctx, c.hub.ServerID, appChannel, 1)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error unsubscribing",
+		})
+
+		return
+	}
 
-		situationChangeErr := nc.Publish("situation_change", &NatsSituationChangeData{
+	if vacated {
+		situationChangeErr := broker.PublishJSON(b, broker.SubjectSituationChange, &NatsSituationChangeData{
 			Channel:   appChannel,
 			Situation: "vacant",
 		})
@@ -408,15 +491,33 @@ func (c *Client) unsubscribe(data interface{}, rdb *redis.Client, nc *nats.Encod
 		}
 	}
 
+	if slices.Contains(c.publishing, appChannel) {
+		if err := cs.RemovePublishers(ctx, c.hub.ServerID, appChannel, 1); err != nil {
+			logrus.Error(fmt.Sprintf("failed to untrack publisher of channel %s", appChannel))
+		}
+
+		c.contributionsMu.Lock()
+		c.publishing = common.Filter(c.publishing, func(channel string) bool {
+			return channel != appChannel
+		})
+		c.contributionsMu.Unlock()
+	}
+
+	c.contributionsMu.Lock()
 	c.channels = common.Filter(c.channels, func(channel string) bool {
 		return channel != appChannel
 	})
+	c.contributionsMu.Unlock()
 
-	c.hub.unsubscribe <- &hubUnsubscription{client: c, channel: appChannel}
+	c.hub.occupancy.mark(appChannel)
+	sendToHub(c.hub, c.hub.unsubscribe, &hubUnsubscription{client: c, channel: appChannel})
 	c.WriteJSON(protocol.NewUnsubscribeSuccessMessage(&protocol.UnsubscribeSuccessMessageData{SequenceNumber: d.SequenceNumber}))
 }
 
-func (c *Client) publish(data interface{}, nc *nats.EncodedConn, rdb *redis.Client) {
+func (c *Client) publish(data interface{}, b broker.Broker, cs store.ChannelStore) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
+
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		c.WriteJSON(&protocol.ErrorMessage{
@@ -439,7 +540,7 @@ func (c *Client) publish(data interface{}, nc *nats.EncodedConn, rdb *redis.Clie
 
 	appChannel := c.AppID + ":" + d.Channel
 	isSubscribed := slices.Contains(c.channels, appChannel)
-	if !isSubscribed {
+	if !isSubscribed && !c.publishesUnsubscribed {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
@@ -449,7 +550,7 @@ func (c *Client) publish(data interface{}, nc *nats.EncodedConn, rdb *redis.Clie
 		return
 	}
 
-	if !c.hasCapability(string(protocol.MessageTypePublish), d.Channel, c.capabilities) {
+	if !HasCapability(string(protocol.MessageTypePublish), d.Channel, c.capabilities) {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
@@ -459,19 +560,51 @@ func (c *Client) publish(data interface{}, nc *nats.EncodedConn, rdb *redis.Clie
 		return
 	}
 
-	var publisherID string
-	if !d.IncludePublisher {
-		publisherID = c.sessionID
+	rule, ruleErr := c.channelRules.ForChannel(ctx, c.AppID, d.Channel)
+	if ruleErr != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error publishing message",
+		})
+
+		return
 	}
 
-	publishErr := nc.Publish("channel_publish", &natsChannelPublishData{
-		Channel:     appChannel,
-		Event:       d.Event,
-		Data:        d.Data,
-		PublisherID: publisherID,
-	})
+	if rule != nil && !rule.ClientPublish {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("clients can't publish messages on the channel %s", d.Channel),
+		})
+
+		return
+	}
+
+	message := &protocol.PublishMessageData{Channel: d.Channel, Event: d.Event, Data: d.Data}
+	reason, checkErr := CheckPublish(ctx, rule, c.channelSchemas, c.AppID, message)
+	if checkErr != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error publishing message",
+		})
+
+		return
+	}
+
+	if reason != "" {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         reason,
+		})
 
-	if publishErr != nil {
+		return
+	}
+
+	allowed, allowErr := AllowPublish(ctx, cs, c.hub.Options.PublishLimits, c.AppID, appChannel)
+	if allowErr != nil {
 		c.WriteJSON(&protocol.ErrorMessage{
 			Type:           protocol.MessageTypeError,
 			SequenceNumber: d.SequenceNumber,
@@ -481,35 +614,88 @@ func (c *Client) publish(data interface{}, nc *nats.EncodedConn, rdb *redis.Clie
 		return
 	}
 
-	// Published messages in a month (for pricing and analytics).
-	year, month, _ := time.Now().UTC().Date()
-	publishedMessagesKey := fmt.Sprintf("published-messages:%s:%d-%d", c.AppID, month, year)
-	incr := rdb.Incr(ctx, publishedMessagesKey)
-	if incr.Err() != nil {
-		logrus.Error(fmt.Sprintf("failed to track published message at key %s", publishedMessagesKey))
+	if !allowed {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("too many messages published on the channel %s or by the app", d.Channel),
+			Code:           protocol.ErrorCodeRateLimited,
+		})
+
+		return
+	}
+
+	includePublisher := rule != nil && rule.EchoPublisher
+	if d.IncludePublisher != nil {
+		includePublisher = *d.IncludePublisher
+	}
+
+	var publisherID string
+	if !includePublisher {
+		publisherID = c.sessionID
+	}
+
+	if publishErr := Publish(ctx, cs, b, rule, c.AppID, message, publisherID); publishErr != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error publishing message",
+		})
+
+		return
 	}
 
 	c.WriteJSON(protocol.NewPublishSuccessMessage(&protocol.PublishSuccessMessageData{SequenceNumber: d.SequenceNumber}))
 }
 
+// Returns copies of what the client added to the channel store: the channels it's subscribed to, the ones it counts
+// as a publisher of and its data on the channels it's present on.
+func (c *Client) contributions() (channels []string, publishing []string, presence map[string][]byte) {
+	c.contributionsMu.Lock()
+	defer c.contributionsMu.Unlock()
+
+	presence = make(map[string][]byte, len(c.presence))
+	for _, channel := range c.presence {
+		presence[channel] = c.presenceData[channel]
+	}
+
+	return append([]string(nil), c.channels...), append([]string(nil), c.publishing...), presence
+}
+
+// Returns the context of an operation of the client on the channel store, the database or the broker.
+func (c *Client) operationContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.ctx, c.hub.Options.OperationTimeout)
+}
+
 func (c *Client) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.Send(data)
+}
+
+// Send sends the message to the client.
+func (c *Client) Send(message []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.Ws.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.Ws.WriteJSON(v)
+	return c.transport.Send(message)
 }
 
-func (c *Client) Write(messageType int, data []byte) error {
+func (c *Client) keepalive() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.Ws.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.Ws.WriteMessage(messageType, data)
+	return c.transport.Keepalive()
 }
 
+// CloseWithMessage closes the connection with the code and the reason of the close message.
 func (c *Client) CloseWithMessage(data []byte) {
-	c.Write(websocket.CloseMessage, data)
-	time.Sleep(closeGracePeriod)
-	c.Ws.Close()
+	code, reason := closeCode(data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transport.Close(code, reason)
 }
 
 func (c *Client) situationListen(data interface{}) {
@@ -554,7 +740,9 @@ func (c *Client) situationListen(data interface{}) {
 		return
 	}
 
+	c.listeningMu.Lock()
 	c.SituationListeningPrefixes = append(c.SituationListeningPrefixes, d.ChannelPrefix)
+	c.listeningMu.Unlock()
 	c.WriteJSON(protocol.NewSituationListenSuccessMessage(&protocol.SituationListenSuccessMessageData{SequenceNumber: d.SequenceNumber}))
 }
 
@@ -600,61 +788,129 @@ func (c *Client) situationUnlisten(data interface{}) {
 		return
 	}
 
+	c.listeningMu.Lock()
 	c.SituationListeningPrefixes = common.Filter(c.SituationListeningPrefixes, func(prefix string) bool {
 		return prefix != d.ChannelPrefix
 	})
+	c.listeningMu.Unlock()
 
 	c.WriteJSON(protocol.NewSituationUnlistenSuccessMessage(&protocol.SituationUnlistenSuccessMessageData{SequenceNumber: d.SequenceNumber}))
 }
 
-func (c *Client) ReadMessages(rdb *redis.Client, nc *nats.EncodedConn) {
-	messagesSentLastSecondTicker := time.NewTicker(time.Second)
-	go func() {
-		for range messagesSentLastSecondTicker.C {
-			c.messagesSentLastSecond = 0
-		}
-	}()
+// Reports whether the client listens to the situation of the channel.
+func (c *Client) listensToSituation(channelName string) bool {
+	c.listeningMu.RLock()
+	defer c.listeningMu.RUnlock()
+	return hasPrefix(c.SituationListeningPrefixes, channelName)
+}
 
+// Reports whether the client listens to the occupancy of the channel.
+func (c *Client) listensToOccupancy(channelName string) bool {
+	c.listeningMu.RLock()
+	defer c.listeningMu.RUnlock()
+	return hasPrefix(c.OccupancyListeningPrefixes, channelName)
+}
+
+func hasPrefix(prefixes []string, channelName string) bool {
+	return common.Some(prefixes, func(prefix string) bool {
+		return strings.HasPrefix(channelName, prefix)
+	})
+}
+
+// ReadMessages handles the messages sent by the client until the connection is closed.
+func (c *Client) ReadMessages(cs store.ChannelStore, b broker.Broker) {
 	defer func() {
-		c.hub.unregister <- c
-		messagesSentLastSecondTicker.Stop()
-		c.Ws.Close()
+		c.cancel()
+		sendToHub(c.hub, c.hub.unregister, c)
+		c.transport.Abort()
 	}()
 
 	for {
-		_, bytes, err := c.Ws.ReadMessage()
+		message, err := c.transport.Receive()
 		if err != nil {
-			break
+			return
 		}
 
-		if c.messagesSentLastSecond >= (maxMessagesPerSecond - 1) {
-			c.CloseWithMessage(websocket.FormatCloseMessage(4029, "too many messages"))
+		if !c.receive(message, cs, b) {
 			break
 		}
+	}
 
-		c.messagesSentLastSecond++
-		var message protocol.Message
-		unmarshalErr := json.Unmarshal(bytes, &message)
-		if unmarshalErr != nil {
-			c.CloseWithMessage(websocket.FormatCloseMessage(4010, "invalid message"))
-			break
+	// Clients are given time to close the connection themselves, what they send until then is ignored.
+	for {
+		if _, err := c.transport.Receive(); err != nil {
+			return
 		}
+	}
+}
 
-		switch message.Type {
-		case protocol.MessageTypeSubscribe:
-			c.subscribe(message.Data, rdb, nc)
+// receive handles a message sent by the client, returning false if the connection was closed because of it.
+func (c *Client) receive(bytes []byte, cs store.ChannelStore, b broker.Broker) bool {
+	var message protocol.Message
+	unmarshalErr := json.Unmarshal(bytes, &message)
+	if unmarshalErr != nil {
+		c.CloseWithMessage(websocket.FormatCloseMessage(4010, "invalid message"))
+		return false
+	}
 
-		case protocol.MessageTypeUnsubscribe:
-			c.unsubscribe(message.Data, rdb, nc)
+	if !c.messages.Allow(time.Now()) {
+		// Clients that keep sending messages after being told to slow down are disconnected.
+		if c.rejectedMessages++; c.rejectedMessages > c.hub.Options.MessageBurst {
+			c.CloseWithMessage(websocket.FormatCloseMessage(4029, "too many messages"))
+			return false
+		}
 
-		case protocol.MessageTypePublish:
-			c.publish(message.Data, nc, rdb)
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: sequenceNumber(message.Data),
+			Reason:         "too many messages",
+			Code:           protocol.ErrorCodeRateLimited,
+		})
 
-		case protocol.MessageTypeSituationListen:
-			c.situationListen(message.Data)
+		return true
+	}
 
-		case protocol.MessageTypeSituationUnlisten:
-			c.situationUnlisten(message.Data)
-		}
+	c.rejectedMessages = 0
+
+	switch message.Type {
+	case protocol.MessageTypeSubscribe:
+		c.subscribe(message.Data, cs, b)
+
+	case protocol.MessageTypeUnsubscribe:
+		c.unsubscribe(message.Data, cs, b)
+
+	case protocol.MessageTypePublish:
+		c.publish(message.Data, b, cs)
+
+	case protocol.MessageTypeSituationListen:
+		c.situationListen(message.Data)
+
+	case protocol.MessageTypeSituationUnlisten:
+		c.situationUnlisten(message.Data)
+
+	case protocol.MessageTypePresenceEnter:
+		c.presenceEnter(message.Data, cs, b)
+
+	case protocol.MessageTypePresenceLeave:
+		c.presenceLeave(message.Data, cs, b)
+
+	case protocol.MessageTypeOccupancyListen:
+		c.occupancyListen(message.Data)
+
+	case protocol.MessageTypeOccupancyUnlisten:
+		c.occupancyUnlisten(message.Data)
+	}
+
+	return true
+}
+
+// Returns the sequence number of the data of a message, or 0 if it doesn't have one.
+func sequenceNumber(data interface{}) int64 {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return 0
 	}
+
+	s, _ := fields["s"].(float64)
+	return int64(s)
 }
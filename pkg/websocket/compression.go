@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gmencz/mycelium/pkg/metrics"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	messagesSent       = metrics.NewCounter("mycelium_websocket_messages_sent_total", "Messages sent to clients.")
+	compressedMessages = metrics.NewCounter("mycelium_websocket_compressed_messages_sent_total", "Messages sent to clients compressed with permessage-deflate.")
+	compressedIn       = metrics.NewCounter("mycelium_websocket_compression_in_bytes_total", "Size of the messages sent compressed before compressing them.")
+	compressedOut      = metrics.NewCounter("mycelium_websocket_compression_out_bytes_total", "Bytes written to the connections by the messages sent compressed, frame headers included.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("mycelium_websocket_compression_ratio", "Size of the messages sent compressed after compressing them relative to before, lower is better.", func() float64 {
+		in := compressedIn.Value()
+		if in == 0 {
+			return 1
+		}
+
+		return float64(compressedOut.Value()) / float64(in)
+	})
+}
+
+// countingConn is the connection of a client, it counts the bytes written to it to measure how well the messages
+// are compressed.
+type countingConn struct {
+	net.Conn
+	written uint64
+
+	// Whether the client negotiated permessage-deflate.
+	compress bool
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+// hijacker hands the connection to the upgrader wrapped in a countingConn.
+type hijacker struct {
+	http.ResponseWriter
+	compress bool
+}
+
+func (h *hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &countingConn{Conn: conn, compress: h.compress}, rw, nil
+}
+
+// Upgrade upgrades the request to a websocket connection, negotiating permessage-deflate unless compression is
+// disabled by the options.
+func Upgrade(w http.ResponseWriter, r *http.Request, options *Options) (*websocket.Conn, error) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: options.CompressionLevel != 0,
+		CheckOrigin: func(*http.Request) bool {
+			// The origins allowed depend on the app, they're checked by NewClient once it's authenticated.
+			return true
+		},
+	}
+
+	ws, err := upgrader.Upgrade(&hijacker{ResponseWriter: w, compress: upgrader.EnableCompression && offersDeflate(r)}, r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if upgrader.EnableCompression {
+		ws.SetCompressionLevel(options.CompressionLevel)
+	}
+
+	return ws, nil
+}
+
+// offersDeflate reports whether the client offered permessage-deflate, the upgrader accepts it if so.
+func offersDeflate(r *http.Request) bool {
+	for _, value := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
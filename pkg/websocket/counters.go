@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+// Every server records what it adds to the shared counters and presence sets of the channel store under its ID, and
+// holds a lease it keeps renewing while it's alive. If a server dies without cleaning up (e.g. it's OOM-killed), its
+// lease expires and a reaper on another server reverts its contributions.
+const (
+	// How often servers renew their lease. Must be less than store.LeaseTTL.
+	leaseRenewInterval = 10 * time.Second
+
+	// How often servers look for expired leases.
+	reapInterval = 15 * time.Second
+)
+
+// Keeps renewing the lease of this server. If the lease lapsed (e.g. because of a long pause or an outage of the
+// store) and another server reverted the contributions of this one, the hub adds them again.
+func (h *Hub) keepLease(ctx context.Context, cs store.ChannelStore) {
+	// The first lease of the server is never owned.
+	renewed := false
+	renew := func() {
+		operationCtx, cancel := context.WithTimeout(ctx, h.Options.OperationTimeout)
+		defer cancel()
+
+		owned, err := cs.RenewLease(operationCtx, h.ServerID)
+		if err != nil {
+			logrus.Error(fmt.Sprintf("failed to renew lease of server %s", h.ServerID))
+			return
+		}
+
+		if !owned && renewed {
+			logrus.Error(fmt.Sprintf("the lease of server %s lapsed, adding its contributions again", h.ServerID))
+			sendToHub(h, h.restore, struct{}{})
+		}
+
+		renewed = true
+	}
+
+	renew()
+
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			renew()
+		}
+	}
+}
+
+// Looks for servers whose lease expired and reverts their contributions.
+func (h *Hub) reap(ctx context.Context, cs store.ChannelStore, b broker.Broker) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			h.reapExpired(ctx, cs, b)
+		}
+	}
+}
+
+// Reverts the contributions of the servers whose lease expired, claiming them so no other server reverts them too.
+func (h *Hub) reapExpired(ctx context.Context, cs store.ChannelStore, b broker.Broker) {
+	operationCtx, cancel := context.WithTimeout(ctx, h.Options.OperationTimeout)
+	servers, err := cs.ClaimExpiredServers(operationCtx, h.ServerID)
+	cancel()
+	if err != nil {
+		logrus.Error("failed to claim expired servers")
+		return
+	}
+
+	for _, serverID := range servers {
+		logrus.Info("reverting the contributions of dead server ", serverID)
+		h.revert(cs, b, serverID)
+	}
+}
+
+// Release reverts every contribution of this server and gives up its lease, it's used on shutdown.
+func (h *Hub) Release(cs store.ChannelStore, b broker.Broker) {
+	h.revert(cs, b, h.ServerID)
+}
+
+// Adds the contributions of the registered clients to the shared counters and presence sets again after they were
+// reverted, emitting the situation and presence changes that result from it. Clients added after the contributions
+// were reverted may be counted twice, which is better than not counting the others at all.
+func (h *Hub) restoreContributions(cs store.ChannelStore, b broker.Broker) {
+	for c := range h.Clients {
+		channels, publishing, presence := c.contributions()
+
+		ctx, cancel := h.operationContext()
+		if _, _, err := cs.AddClient(ctx, h.ServerID, c.AppID, 0); err != nil {
+			logrus.Error(fmt.Sprintf("failed to add client of app %s again", c.AppID))
+		}
+
+		for _, channel := range channels {
+			occupied, err := cs.AddSubscriber(ctx, h.ServerID, channel)
+			if err != nil {
+				logrus.Error(fmt.Sprintf("failed to add subscriber of channel %s again", channel))
+				continue
+			}
+
+			if occupied {
+				broker.PublishJSON(b, broker.SubjectSituationChange, &NatsSituationChangeData{
+					Channel:   channel,
+					Situation: "occupied",
+				})
+			}
+
+			h.occupancy.mark(channel)
+		}
+
+		for _, channel := range publishing {
+			if err := cs.AddPublisher(ctx, h.ServerID, channel); err != nil {
+				logrus.Error(fmt.Sprintf("failed to add publisher of channel %s again", channel))
+			}
+		}
+
+		for channel, data := range presence {
+			if err := cs.EnterPresence(ctx, h.ServerID, channel, c.sessionID, data); err != nil {
+				logrus.Error(fmt.Sprintf("failed to add presence member of channel %s again", channel))
+				continue
+			}
+
+			broker.PublishJSON(b, broker.SubjectPresenceChange, &NatsPresenceChangeData{
+				Channel:   channel,
+				SessionID: c.sessionID,
+				Action:    protocol.PresenceActionEnter,
+				Data:      json.RawMessage(data),
+			})
+
+			h.occupancy.mark(channel)
+		}
+
+		cancel()
+	}
+}
+
+// Reverts the contributions of the server to the shared counters and presence sets, emitting the situation and
+// presence changes that result from it.
+func (h *Hub) revert(cs store.ChannelStore, b broker.Broker, serverID string) {
+	ctx, cancel := h.operationContext()
+	defer cancel()
+
+	reverted, err := cs.Revert(ctx, serverID)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to revert contributions of server %s", serverID))
+		return
+	}
+
+	for _, channel := range reverted.Vacated {
+		broker.PublishJSON(b, broker.SubjectSituationChange, &NatsSituationChangeData{
+			Channel:   channel,
+			Situation: "vacant",
+		})
+	}
+
+	for _, member := range reverted.Left {
+		broker.PublishJSON(b, broker.SubjectPresenceChange, &NatsPresenceChangeData{
+			Channel:   member.AppChannel,
+			SessionID: member.SessionID,
+			Action:    protocol.PresenceActionLeave,
+		})
+	}
+
+	for _, channel := range reverted.Changed {
+		h.occupancy.mark(channel)
+	}
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/store"
+)
+
+func expectSituation(t *testing.T, changes <-chan NatsSituationChangeData, channel string, situation string) {
+	t.Helper()
+
+	select {
+	case change := <-changes:
+		if change.Channel != channel || change.Situation != situation {
+			t.Fatalf("expected %s to be %s, but got %+v", channel, situation, change)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %s to be %s, but got nothing", channel, situation)
+	}
+}
+
+func subscribeSituations(t *testing.T, b broker.Broker) <-chan NatsSituationChangeData {
+	t.Helper()
+
+	changes := make(chan NatsSituationChangeData, 16)
+	_, err := b.Subscribe(broker.SubjectSituationChange, func(data []byte) {
+		var change NatsSituationChangeData
+		if err := json.Unmarshal(data, &change); err == nil {
+			changes <- change
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	return changes
+}
+
+func TestReapExpiredVacatesTheChannelsOfDeadServers(t *testing.T) {
+	ctx := context.Background()
+	cs := store.NewMemoryStore()
+	b := broker.NewMemoryBroker()
+	t.Cleanup(b.Close)
+	changes := subscribeSituations(t, b)
+
+	cs.RenewLease(ctx, "dead")
+	cs.AddSubscriber(ctx, "dead", "app:lobby")
+	cs.ExpireLease("dead")
+
+	h := NewHub(Options{OperationTimeout: 5 * time.Second})
+	h.reapExpired(ctx, cs, b)
+	expectSituation(t, changes, "app:lobby", "vacant")
+
+	if occupancy, err := cs.Occupancy(ctx, "app:lobby"); err != nil || occupancy.Subscribers != 0 {
+		t.Fatalf("expected no subscribers left, but got %+v (%v)", occupancy, err)
+	}
+
+	// The dead server's contributions are only reverted once.
+	h.reapExpired(ctx, cs, b)
+	select {
+	case change := <-changes:
+		t.Fatalf("expected no situation change, but got %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRestoreContributionsAfterTheLeaseLapsed(t *testing.T) {
+	ctx := context.Background()
+	cs := store.NewMemoryStore()
+	b := broker.NewMemoryBroker()
+	t.Cleanup(b.Close)
+	changes := subscribeSituations(t, b)
+
+	h := NewHub(Options{OperationTimeout: 5 * time.Second})
+	c := &Client{hub: h, AppID: "app", sessionID: "session", channels: []string{"app:lobby"}, publishing: []string{"app:lobby"}}
+	h.Clients[c] = true
+
+	cs.RenewLease(ctx, h.ServerID)
+	cs.AddClient(ctx, h.ServerID, "app", 0)
+	cs.AddSubscriber(ctx, h.ServerID, "app:lobby")
+	cs.AddPublisher(ctx, h.ServerID, "app:lobby")
+
+	// Another server reaps this one while it's paused.
+	cs.ExpireLease(h.ServerID)
+	NewHub(Options{OperationTimeout: 5 * time.Second}).reapExpired(ctx, cs, b)
+	expectSituation(t, changes, "app:lobby", "vacant")
+
+	if owned, err := cs.RenewLease(ctx, h.ServerID); err != nil || owned {
+		t.Fatalf("expected the lease not to be owned, but got %t (%v)", owned, err)
+	}
+
+	h.restoreContributions(cs, b)
+	expectSituation(t, changes, "app:lobby", "occupied")
+
+	occupancy, err := cs.Occupancy(ctx, "app:lobby")
+	if err != nil || occupancy.Subscribers != 1 || occupancy.Publishers != 1 {
+		t.Fatalf("expected a subscriber and a publisher, but got %+v (%v)", occupancy, err)
+	}
+}
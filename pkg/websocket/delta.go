@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gmencz/mycelium/pkg/jsonpatch"
+	"github.com/gmencz/mycelium/pkg/protocol"
+)
+
+// deltas keeps the previous message of the channels with subscribers receiving deltas, so the messages published on
+// them are sent as patches against it.
+type deltas struct {
+	mu       sync.Mutex
+	channels map[string]*channelDeltas
+
+	// Every this many messages of a channel the whole data is sent instead of a patch.
+	keyframeInterval uint64
+}
+
+type channelDeltas struct {
+	// Sequence of the last message published on the channel since it got subscribers receiving deltas and its data.
+	sequence uint64
+	previous interface{}
+
+	// Sequence of the last message sent to every subscriber receiving deltas, 0 before the first one.
+	subscribers map[*Client]uint64
+}
+
+func newDeltas(keyframeInterval int) *deltas {
+	return &deltas{
+		channels:         make(map[string]*channelDeltas),
+		keyframeInterval: uint64(keyframeInterval),
+	}
+}
+
+// add starts sending the messages of the channel to the client as deltas.
+func (d *deltas) add(appChannel string, c *Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channel, ok := d.channels[appChannel]
+	if !ok {
+		channel = &channelDeltas{subscribers: make(map[*Client]uint64)}
+		d.channels[appChannel] = channel
+	}
+
+	channel.subscribers[c] = 0
+}
+
+// remove stops sending the messages of the channel to the client as deltas, the previous message of the channel is
+// forgotten when no subscribers receiving deltas are left.
+func (d *deltas) remove(appChannel string, c *Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channel, ok := d.channels[appChannel]
+	if !ok {
+		return
+	}
+
+	delete(channel.subscribers, c)
+	if len(channel.subscribers) == 0 {
+		delete(d.channels, appChannel)
+	}
+}
+
+// messages returns the messages to send for a message published on the channel: the message itself and a delta for
+// the subscribers who got the previous message. The delta is nil when the message is a keyframe or the patch isn't
+// smaller than the data. It records the message as the previous one of the channel.
+func (d *deltas) messages(appChannel string, data *protocol.PublishMessageData) (message *protocol.Message, delta *protocol.Message, sequence uint64) {
+	message = protocol.NewPublishMessage(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channel, ok := d.channels[appChannel]
+	if !ok {
+		return message, nil, 0
+	}
+
+	previous := channel.previous
+	channel.previous = data.Data
+	channel.sequence++
+	if channel.sequence == 1 || channel.sequence%d.keyframeInterval == 0 {
+		return message, nil, channel.sequence
+	}
+
+	patch := jsonpatch.Diff(previous, data.Data)
+	patchJSON, patchErr := json.Marshal(patch)
+	dataJSON, dataErr := json.Marshal(data.Data)
+	if patchErr != nil || dataErr != nil || len(patchJSON) >= len(dataJSON) {
+		return message, nil, channel.sequence
+	}
+
+	delta = protocol.NewPublishDeltaMessage(&protocol.PublishDeltaMessageData{Channel: data.Channel, Event: data.Event, Patch: patch})
+	return message, delta, channel.sequence
+}
+
+// forClient returns the message to send to the client out of the ones returned by messages, the delta is only sent
+// to subscribers receiving deltas who got the previous message.
+func (d *deltas) forClient(appChannel string, c *Client, message *protocol.Message, delta *protocol.Message, sequence uint64) *protocol.Message {
+	if sequence == 0 {
+		return message
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	channel, ok := d.channels[appChannel]
+	if !ok {
+		return message
+	}
+
+	last, ok := channel.subscribers[c]
+	if !ok {
+		return message
+	}
+
+	channel.subscribers[c] = sequence
+	if delta == nil || last != sequence-1 {
+		return message
+	}
+
+	return delta
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// ReconnectHint tells the clients of a server that's shutting down when to reconnect (to another server).
+type ReconnectHint struct {
+	// Time clients should wait before reconnecting.
+	Delay time.Duration
+
+	// Clients add a random part of it to the delay, so they don't all reconnect at once.
+	Jitter time.Duration
+}
+
+// Drain asks every client to reconnect and closes their connections, writing to at most concurrency of them at a
+// time. It returns when every client is gone or, after force closing the connections left, when ctx is done. The
+// hub stops updating the channel store when it returns, so what's left of this server's contributions can be
+// reverted with Release.
+func (h *Hub) Drain(ctx context.Context, hint ReconnectHint, concurrency int) {
+	h.reconnectMessage = protocol.NewReconnectMessage(&protocol.ReconnectMessageData{
+		Delay:  hint.Delay.Milliseconds(),
+		Jitter: hint.Jitter.Milliseconds(),
+	})
+
+	reply := make(chan []*Client)
+	h.drain <- reply
+	clients := <-reply
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	for _, c := range clients {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(c *Client) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			// The client closes the connection after getting the close message, which unregisters it.
+			c.WriteJSON(h.reconnectMessage)
+			c.CloseWithMessage(websocket.FormatCloseMessage(4009, "please reconnect"))
+		}(c)
+	}
+
+	wg.Wait()
+
+	select {
+	case <-h.drained:
+	case <-ctx.Done():
+		for _, c := range clients {
+			c.transport.Abort()
+		}
+	}
+
+	done := make(chan struct{})
+	h.stop <- done
+	<-done
+}
+
+// Asks a client that registered while draining to reconnect.
+func (h *Hub) rejectDraining(c *Client) {
+	c.WriteJSON(h.reconnectMessage)
+	c.CloseWithMessage(websocket.FormatCloseMessage(4009, "please reconnect"))
+}
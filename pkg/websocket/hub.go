@@ -2,19 +2,24 @@ package websocket
 
 import (
 	"context"
+	"fmt"
 	"strings"
+	"sync"
 
+	"github.com/gmencz/mycelium/pkg/broker"
 	"github.com/gmencz/mycelium/pkg/common"
 	"github.com/gmencz/mycelium/pkg/protocol"
-	"github.com/go-redis/redis/v8"
-	"github.com/nats-io/nats.go"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
-var ctx = context.Background()
-
 // Hub maintains all the state related to active clients.
 type Hub struct {
+	// Guards Clients, ChannelsClients and PatternsClients, which are changed by the hub and read by the subscriptions
+	// to the broker. They're only written to by the hub, which reads them without the lock.
+	mu sync.RWMutex
+
 	// Registered clients.
 	Clients map[*Client]bool
 
@@ -32,6 +37,56 @@ type Hub struct {
 
 	// The channels and clients subscribed to them.
 	ChannelsClients map[string][]*Client
+
+	// Subscriptions to the subjects of the channels with clients subscribed to them.
+	channelSubscriptions map[string]broker.Subscription
+
+	// The channel patterns (<app-id>:<prefix>*) and clients subscribed to them.
+	PatternsClients map[string][]*Client
+
+	// Subscriptions to the subjects of every channel of the apps with clients subscribed to patterns.
+	appSubscriptions map[string]broker.Subscription
+
+	// The channels whose occupancy changed.
+	occupancy *occupancyTracker
+
+	// Connections admitted by the server.
+	admission *admission
+
+	// Previous messages of the channels with subscribers receiving deltas.
+	deltas *deltas
+
+	// Sessions of the long-polling clients.
+	polls *pollSessions
+
+	// Unique ID of this server, used to track what it contributes to the shared counters.
+	ServerID string
+
+	// Options of the connections.
+	Options Options
+
+	// Starts draining, replying with the clients to close.
+	drain chan chan []*Client
+
+	// Closed when there are no clients left while draining.
+	drained  chan struct{}
+	draining bool
+
+	// Sent to the clients while draining.
+	reconnectMessage *protocol.Message
+
+	// Adds the contributions of the clients to the channel store again, after they were reverted.
+	restore chan struct{}
+
+	// Stops updating the channel store, replying when it's stopped.
+	stop    chan chan struct{}
+	stopped bool
+
+	// Closed when the hub starts handling clients.
+	running chan struct{}
+
+	// Closed when the hub stops running.
+	done chan struct{}
 }
 
 type hubSubscription struct {
@@ -44,7 +99,7 @@ type hubUnsubscription struct {
 	channel string
 }
 
-type natsChannelPublishData struct {
+type NatsChannelPublishData struct {
 	Channel     string      `json:"c"`
 	Event       string      `json:"e"`
 	Data        interface{} `json:"d"`
@@ -56,117 +111,378 @@ type NatsSituationChangeData struct {
 	Situation string `json:"s"`
 }
 
+type NatsPresenceChangeData struct {
+	Channel   string      `json:"c"`
+	SessionID string      `json:"sid"`
+	Action    string      `json:"a"`
+	Data      interface{} `json:"d,omitempty"`
+}
+
 // NewHub returns an initialized Hub.
-func NewHub() *Hub {
+func NewHub(options Options) *Hub {
 	return &Hub{
-		register:        make(chan *Client),
-		unregister:      make(chan *Client),
-		Clients:         make(map[*Client]bool),
-		subscribe:       make(chan *hubSubscription),
-		unsubscribe:     make(chan *hubUnsubscription),
-		ChannelsClients: make(map[string][]*Client),
+		register:             make(chan *Client),
+		unregister:           make(chan *Client),
+		Clients:              make(map[*Client]bool),
+		subscribe:            make(chan *hubSubscription),
+		unsubscribe:          make(chan *hubUnsubscription),
+		ChannelsClients:      make(map[string][]*Client),
+		channelSubscriptions: make(map[string]broker.Subscription),
+		PatternsClients:      make(map[string][]*Client),
+		appSubscriptions:     make(map[string]broker.Subscription),
+		occupancy:            newOccupancyTracker(),
+		admission:            newAdmission(),
+		deltas:               newDeltas(options.DeltaKeyframeInterval),
+		polls:                newPollSessions(),
+		ServerID:             uuid.NewString(),
+		Options:              options,
+		drain:                make(chan chan []*Client),
+		drained:              make(chan struct{}),
+		restore:              make(chan struct{}),
+		stop:                 make(chan chan struct{}),
+		running:              make(chan struct{}),
+		done:                 make(chan struct{}),
 	}
 }
 
-// Run runs the Hub.
-func (h *Hub) Run(rdb *redis.Client, nc *nats.EncodedConn) {
-	nc.Subscribe("situation_change", func(data *NatsSituationChangeData) {
+// Run runs the Hub until ctx is done.
+func (h *Hub) Run(ctx context.Context, cs store.ChannelStore, b broker.Broker) {
+	defer close(h.done)
+
+	broker.SubscribeJSON(b, broker.SubjectSituationChange, func(data *NatsSituationChangeData) {
 		// Channel parts: <app-id>:<channel-name>
 		channelParts := strings.Split(data.Channel, ":")
 		if len(channelParts) != 2 {
 			return
 		}
+		appID := channelParts[0]
 		channelName := channelParts[1]
 
 		message := protocol.NewSituationChangeMessage(&protocol.SituationChangeMessageData{Channel: channelName, Situation: data.Situation})
-		for c := range h.Clients {
-			hasPrefix := common.Some(c.SituationListeningPrefixes, func(prefix string) bool {
-				return strings.HasPrefix(channelName, prefix)
-			})
-
-			if hasPrefix {
+		for _, c := range h.appClients(appID) {
+			if c.listensToSituation(channelName) {
 				c.WriteJSON(message)
 			}
 		}
 	})
 
-	nc.Subscribe("channel_publish", func(data *natsChannelPublishData) {
-		clients, ok := h.ChannelsClients[data.Channel]
-		if !ok {
+	// The last occupancy sent for every channel, so listeners don't get the same occupancy from several servers.
+	lastOccupancy := make(map[string]NatsOccupancyData)
+	broker.SubscribeJSON(b, broker.SubjectOccupancy, func(data *NatsOccupancyData) {
+		if last, ok := lastOccupancy[data.Channel]; ok && last == *data {
 			return
 		}
 
+		if data.Subscribers == 0 && data.PresenceMembers == 0 {
+			delete(lastOccupancy, data.Channel)
+		} else {
+			lastOccupancy[data.Channel] = *data
+		}
+
 		// Channel parts: <app-id>:<channel-name>
 		channelParts := strings.Split(data.Channel, ":")
 		if len(channelParts) != 2 {
 			return
 		}
+		appID := channelParts[0]
 		channelName := channelParts[1]
 
-		message := protocol.NewPublishMessage(&protocol.PublishMessageData{Channel: channelName, Data: data.Data, Event: data.Event})
+		message := protocol.NewOccupancyMessage(&protocol.OccupancyMessageData{
+			Channel:         channelName,
+			Subscribers:     data.Subscribers,
+			Publishers:      data.Publishers,
+			PresenceMembers: data.PresenceMembers,
+		})
 
-		// If there's no publisherID, publish message to every subscriber of the channel.
-		if data.PublisherID == "" {
-			for _, c := range clients {
+		for _, c := range h.appClients(appID) {
+			if c.listensToOccupancy(channelName) {
 				c.WriteJSON(message)
 			}
+		}
+	})
+
+	go h.occupancy.run(ctx, cs, b, h.Options.OperationTimeout)
+	go h.keepLease(ctx, cs)
+	go h.reap(ctx, cs, b)
 
+	broker.SubscribeJSON(b, broker.SubjectPresenceChange, func(data *NatsPresenceChangeData) {
+		clients := h.channelClients(data.Channel)
+		if len(clients) == 0 {
 			return
 		}
 
-		// If we're here, there's a publisherID which means we need to exclude the client with
-		// that id (the client could be on this server or not but we still need to check).
+		// Channel parts: <app-id>:<channel-name>
+		channelParts := strings.Split(data.Channel, ":")
+		if len(channelParts) != 2 {
+			return
+		}
+		channelName := channelParts[1]
+
+		message := protocol.NewPresenceChangeMessage(&protocol.PresenceChangeMessageData{
+			Channel:   channelName,
+			Action:    data.Action,
+			SessionID: data.SessionID,
+			Data:      data.Data,
+		})
+
 		for _, c := range clients {
-			if c.sessionID != data.PublisherID {
-				c.WriteJSON(message)
-			}
+			c.WriteJSON(message)
 		}
 	})
 
+	close(h.running)
+
 	for {
 		select {
+		case <-ctx.Done():
+			return
+
 		case client := <-h.register:
+			h.mu.Lock()
 			h.Clients[client] = true
+			h.mu.Unlock()
 			logrus.Info("new client registered, updated number of clients: ", len(h.Clients))
 
+			if h.draining {
+				go h.rejectDraining(client)
+			}
+
+		case reply := <-h.drain:
+			h.draining = true
+			clients := make([]*Client, 0, len(h.Clients))
+			for c := range h.Clients {
+				clients = append(clients, c)
+			}
+
+			reply <- clients
+			h.checkDrained()
+
+		case done := <-h.stop:
+			h.stopped = true
+			close(done)
+
+		case <-h.restore:
+			if !h.stopped {
+				h.restoreContributions(cs, b)
+			}
+
 		case c := <-h.unregister:
+			// Both the reader and the pinger of a client unregister it when they stop.
+			if !h.Clients[c] {
+				continue
+			}
+
+			h.mu.Lock()
 			delete(h.Clients, c)
+			h.mu.Unlock()
+			h.checkDrained()
+
+			// What the client added to the channel store is reverted with the rest of this server's contributions.
+			if h.stopped {
+				continue
+			}
+
+			ctx, cancel := h.operationContext()
+
+			for _, channel := range c.presence {
+				cs.LeavePresence(ctx, h.ServerID, channel, c.sessionID)
+				broker.PublishJSON(b, broker.SubjectPresenceChange, &NatsPresenceChangeData{
+					Channel:   channel,
+					SessionID: c.sessionID,
+					Action:    protocol.PresenceActionLeave,
+				})
+			}
+			c.contributionsMu.Lock()
+			c.presence = nil
+			c.presenceData = nil
+			c.contributionsMu.Unlock()
+
+			for _, channel := range c.publishing {
+				cs.RemovePublishers(ctx, h.ServerID, channel, 1)
+			}
+			c.contributionsMu.Lock()
+			c.publishing = nil
+			c.contributionsMu.Unlock()
 
 			for _, channel := range c.channels {
-				key := "subscribers:" + channel
-				channelExists := rdb.Exists(ctx, key)
-				if channelExists.Val() > 0 {
-					i := rdb.Decr(ctx, key)
-					subscribersLeft := i.Val()
-					if subscribersLeft <= 0 {
-						rdb.Del(ctx, key)
-						nc.Publish("situation_change", &NatsSituationChangeData{
-							Channel:   channel,
-							Situation: "vacant",
-						})
-					}
+				if vacated, _ := cs.RemoveSubscribers(ctx, h.ServerID, channel, 1); vacated {
+					broker.PublishJSON(b, broker.SubjectSituationChange, &NatsSituationChangeData{
+						Channel:   channel,
+						Situation: "vacant",
+					})
 				}
 
+				h.mu.Lock()
 				h.ChannelsClients[channel] = common.Filter(h.ChannelsClients[channel], func(cl *Client) bool {
 					return cl.sessionID != c.sessionID
 				})
+				h.mu.Unlock()
+				h.deltas.remove(channel, c)
+				h.unlisten(channel)
+
+				h.occupancy.mark(channel)
 			}
 
-			currentClientsKey := "current-clients:" + c.AppID
-			currentClientsDecr := rdb.Decr(ctx, currentClientsKey)
-			if currentClientsDecr.Val() <= 0 {
-				rdb.Del(ctx, currentClientsKey)
+			for _, pattern := range c.patterns {
+				h.removePatternClient(pattern, c)
 			}
 
+			cs.RemoveClients(ctx, h.ServerID, c.AppID, 1)
+			cancel()
+
 			logrus.Info("client unregistered, updated number of clients: ", len(h.Clients))
 
 		case subscription := <-h.subscribe:
+			if isPattern(subscription.channel) {
+				h.addPatternClient(b, subscription.channel, subscription.client)
+				continue
+			}
+
+			h.mu.Lock()
 			h.ChannelsClients[subscription.channel] = append(h.ChannelsClients[subscription.channel], subscription.client)
+			h.mu.Unlock()
+			h.listen(b, subscription.channel)
 
 		case unsubscription := <-h.unsubscribe:
+			if isPattern(unsubscription.channel) {
+				h.removePatternClient(unsubscription.channel, unsubscription.client)
+				continue
+			}
+
+			h.mu.Lock()
 			h.ChannelsClients[unsubscription.channel] = common.Filter(h.ChannelsClients[unsubscription.channel], func(client *Client) bool {
 				return client.sessionID != unsubscription.client.sessionID
 			})
+			h.mu.Unlock()
+			h.deltas.remove(unsubscription.channel, unsubscription.client)
+			h.unlisten(unsubscription.channel)
+		}
+	}
+}
+
+// Running returns a channel that's closed once the hub handles clients.
+func (h *Hub) Running() <-chan struct{} {
+	return h.running
+}
+
+// Returns the context of an operation of the hub on the channel store. Operations of the hub, like cleaning up after
+// clients, have to finish even when the server is shutting down.
+func (h *Hub) operationContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), h.Options.OperationTimeout)
+}
+
+// Sends v on a channel of the hub unless it stopped running.
+func sendToHub[T any](h *Hub, ch chan T, v T) {
+	select {
+	case ch <- v:
+	case <-h.done:
+	}
+}
+
+// Closes drained when there are no clients left while draining.
+func (h *Hub) checkDrained() {
+	if !h.draining || len(h.Clients) > 0 {
+		return
+	}
+
+	select {
+	case <-h.drained:
+	default:
+		close(h.drained)
+	}
+}
+
+// Returns the clients of the app, the subscriptions to the broker send them messages without holding the lock.
+func (h *Hub) appClients(appID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var clients []*Client
+	for c := range h.Clients {
+		if c.AppID == appID {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+// Returns the clients subscribed to the channel (<app-id>:<channel-name>). The hub only appends to the slices of
+// clients or replaces them, so the slice can be used without holding the lock.
+func (h *Hub) channelClients(appChannel string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ChannelsClients[appChannel]
+}
+
+// Sends a message published on a channel to the subscribers of the channel on this server.
+func (h *Hub) deliver(data *NatsChannelPublishData) {
+	clients := h.channelClients(data.Channel)
+	if len(clients) == 0 {
+		return
+	}
+
+	// Channel parts: <app-id>:<channel-name>
+	channelParts := strings.Split(data.Channel, ":")
+	if len(channelParts) != 2 {
+		return
+	}
+	channelName := channelParts[1]
+
+	message, delta, sequence := h.deltas.messages(data.Channel, &protocol.PublishMessageData{Channel: channelName, Data: data.Data, Event: data.Event})
+
+	// If there's no publisherID, publish message to every subscriber of the channel.
+	if data.PublisherID == "" {
+		for _, c := range clients {
+			c.WriteJSON(h.deltas.forClient(data.Channel, c, message, delta, sequence))
+		}
+
+		return
+	}
+
+	// If we're here, there's a publisherID which means we need to exclude the client with
+	// that id (the client could be on this server or not but we still need to check).
+	for _, c := range clients {
+		if c.sessionID != data.PublisherID {
+			c.WriteJSON(h.deltas.forClient(data.Channel, c, message, delta, sequence))
 		}
 	}
 }
+
+// Subscribes to the subject of the channel (<app-id>:<channel-name>) when it gets its first subscriber on this server.
+func (h *Hub) listen(b broker.Broker, appChannel string) {
+	if _, ok := h.channelSubscriptions[appChannel]; ok {
+		return
+	}
+
+	// Channel parts: <app-id>:<channel-name>
+	channelParts := strings.Split(appChannel, ":")
+	if len(channelParts) != 2 {
+		return
+	}
+
+	subscription, err := broker.SubscribeJSON(b, broker.ChannelSubject(channelParts[0], channelParts[1]), h.deliver)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the subject of channel %s", appChannel))
+		return
+	}
+
+	h.channelSubscriptions[appChannel] = subscription
+}
+
+// Unsubscribes from the subject of the channel (<app-id>:<channel-name>) when it has no subscribers left on this
+// server.
+func (h *Hub) unlisten(appChannel string) {
+	if len(h.ChannelsClients[appChannel]) > 0 {
+		return
+	}
+
+	h.mu.Lock()
+	delete(h.ChannelsClients, appChannel)
+	h.mu.Unlock()
+
+	if subscription, ok := h.channelSubscriptions[appChannel]; ok {
+		subscription.Unsubscribe()
+		delete(h.channelSubscriptions, appChannel)
+	}
+}
@@ -0,0 +1,113 @@
+package websocket
+
+import "sync"
+
+// MemoryTransport is a Transport within the process, it's meant for tests that play the client without a network.
+type MemoryTransport struct {
+	// Messages sent to the client, in order.
+	sent chan []byte
+
+	// Messages sent by the client waiting to be received.
+	received chan []byte
+
+	mu          sync.Mutex
+	closeCode   int
+	closeReason string
+	closed      bool
+	done        chan struct{}
+}
+
+// NewMemoryTransport returns a MemoryTransport buffering up to size messages in either direction, sending more
+// messages to a client that doesn't read them fails.
+func NewMemoryTransport(size int) *MemoryTransport {
+	return &MemoryTransport{
+		sent:     make(chan []byte, size),
+		received: make(chan []byte, size),
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *MemoryTransport) Send(message []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errStreamClosed
+	}
+
+	select {
+	case t.sent <- message:
+		return nil
+	default:
+		return errStreamClosed
+	}
+}
+
+func (t *MemoryTransport) Receive() ([]byte, error) {
+	select {
+	case message := <-t.received:
+		return message, nil
+
+	case <-t.done:
+		return nil, errStreamClosed
+	}
+}
+
+func (t *MemoryTransport) Close(code int, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closeCode, t.closeReason = code, reason
+		t.closeLocked()
+	}
+
+	return nil
+}
+
+func (t *MemoryTransport) Keepalive() error {
+	return nil
+}
+
+func (t *MemoryTransport) Abort() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+	return nil
+}
+
+func (t *MemoryTransport) closeLocked() {
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// Messages returns the messages sent to the client.
+func (t *MemoryTransport) Messages() <-chan []byte {
+	return t.sent
+}
+
+// Deliver sends the message as the client, it returns false if the connection is closed.
+func (t *MemoryTransport) Deliver(message []byte) bool {
+	select {
+	case t.received <- message:
+		return true
+
+	case <-t.done:
+		return false
+	}
+}
+
+// Done returns a channel that's closed when the connection is closed.
+func (t *MemoryTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+// CloseCode returns the code and the reason the connection was closed with, 0 if it was closed without telling the
+// client or it's still open.
+func (t *MemoryTransport) CloseCode() (int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeCode, t.closeReason
+}
@@ -0,0 +1,687 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/mqtt"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"gorm.io/gorm"
+)
+
+// Event of the messages published by MQTT clients, MQTT 5 clients can set another one with an "event" user
+// property.
+const mqttEvent = "message"
+
+// Reason codes of MQTT 5 used by the server.
+const (
+	mqttNoSubscription     = 0x11
+	mqttUnspecifiedError   = 0x80
+	mqttMalformedPacket    = 0x81
+	mqttProtocolError      = 0x82
+	mqttBadCredentials     = 0x86
+	mqttNotAuthorized      = 0x87
+	mqttServerUnavailable  = 0x88
+	mqttServerBusy         = 0x89
+	mqttServerShuttingDown = 0x8b
+	mqttTopicFilterInvalid = 0x8f
+	mqttTopicNameInvalid   = 0x90
+	mqttPacketTooLarge     = 0x95
+	mqttMessageRateTooHigh = 0x96
+	mqttQuotaExceeded      = 0x97
+	mqttQoSNotSupported    = 0x9b
+)
+
+// Return codes of MQTT 3.1.1.
+const (
+	mqttUnacceptableVersion3 = 0x01
+	mqttServerUnavailable3   = 0x03
+	mqttBadCredentials3      = 0x04
+	mqttNotAuthorized3       = 0x05
+	mqttSubscriptionFailed3  = 0x80
+)
+
+var errMQTTDisconnect = errors.New("mqtt client disconnected")
+
+// Topics are mapped onto channels by joining their levels with "-", so the topic "sensors/kitchen" is the channel
+// "sensors-kitchen" and the other way around. Topics whose levels aren't valid channel names without "-" can't be
+// used.
+func mqttChannel(topic string) (string, bool) {
+	levels := strings.Split(topic, "/")
+	for _, level := range levels {
+		if strings.Contains(level, "-") || !common.ValidateString(level) {
+			return "", false
+		}
+	}
+
+	channel := strings.Join(levels, "-")
+	return channel, common.ValidateString(channel)
+}
+
+func mqttTopic(channel string) string {
+	return strings.ReplaceAll(channel, "-", "/")
+}
+
+// Returns the channel or the channel pattern covering the topics matching the filter, the pattern may cover more
+// topics so deliveries are matched against the filter again.
+func mqttChannelPattern(filter string) (string, bool) {
+	if !mqtt.ValidFilter(filter) {
+		return "", false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			prefix, ok := "", true
+			if i > 0 {
+				prefix, ok = mqttChannel(strings.Join(levels[:i], "/"))
+			}
+
+			return prefix + "*", ok
+		}
+	}
+
+	return mqttChannel(filter)
+}
+
+// A reply the MQTT client is waiting for, to the packet made of one or more protocol messages.
+type mqttAck struct {
+	packetType byte
+	packetID   uint16
+
+	// Reason codes of the topic filters of SUBSCRIBE packets, one per filter, and the ones still waiting for a reply.
+	codes   []byte
+	waiting int
+}
+
+// A protocol message sent on behalf of the MQTT client, waiting for its reply.
+type mqttRequest struct {
+	ack *mqttAck
+
+	// Index of the filter the message subscribes to, and the filter and the channel it subscribes to.
+	index   int
+	filter  string
+	channel string
+
+	// Filters of the same channel subscribed to while the message waits for its reply, which answers them too.
+	attached []*mqttRequest
+}
+
+// mqttTransport turns the packets of an MQTT client into messages of the realtime protocol and the other way around.
+// Messages are only delivered with QoS 0, and neither sessions, retained messages nor wills are kept.
+type mqttTransport struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	version byte
+	options *Options
+
+	// Read deadline of the connection, pushed back on every packet.
+	keepAlive time.Duration
+
+	mu        sync.Mutex
+	connected bool
+	closed    bool
+
+	// Protocol messages waiting to be received.
+	pending [][]byte
+	seq     int64
+
+	// Channels or channel patterns of the topic filters subscribed to, and how many filters use them.
+	filters  map[string]string
+	channels map[string]int
+
+	requests map[int64]*mqttRequest
+
+	// Sequence numbers of the messages subscribing to channels or channel patterns, while they wait for their reply.
+	subscribing map[string]int64
+}
+
+// ServeMQTT speaks MQTT 3.1.1 or 5 with the client on the connection until it's closed. The client authenticates
+// with a key or a token as the password of its CONNECT packet, its username is ignored. Topics are mapped onto
+// channels and topic filters onto channel patterns, so MQTT clients and clients of the realtime protocol share the
+// same channels.
+func ServeMQTT(conn net.Conn, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, cs store.ChannelStore, b broker.Broker, hub *Hub) {
+	t := &mqttTransport{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		options:     &hub.Options,
+		filters:     make(map[string]string),
+		channels:    make(map[string]int),
+		requests:    make(map[int64]*mqttRequest),
+		subscribing: make(map[string]int64),
+	}
+
+	connect, err := t.readConnect()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if connect.Version != mqtt.Version311 && connect.Version != mqtt.Version5 {
+		// Clients of older versions understand CONNACK packets of MQTT 3.1.1.
+		t.version = mqtt.Version311
+		t.writePacket(mqtt.EncodeConnack(t.version, mqttUnacceptableVersion3, nil))
+		conn.Close()
+		return
+	}
+
+	t.version = connect.Version
+	t.keepAlive = time.Duration(connect.KeepAlive) * time.Second * 3 / 2
+
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	release, closeMessage := hub.Admit(ip)
+	if closeMessage != nil {
+		t.Close(closeCode(closeMessage))
+		return
+	}
+
+	defer release()
+
+	credentials := url.Values{}
+	if strings.Contains(connect.Password, ":") {
+		credentials.Set("key", connect.Password)
+	} else {
+		credentials.Set("token", connect.Password)
+	}
+
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/mqtt?"+credentials.Encode(), nil)
+	if err != nil {
+		t.Close(4500, "internal server error")
+		return
+	}
+
+	c, closeMessage := NewTransportClient(request, t, db, channelRules, channelSchemas, allowedOrigins, hub)
+	if closeMessage != nil {
+		t.Close(closeCode(closeMessage))
+		return
+	}
+
+	c.publishesUnsubscribed = true
+	c.subscribesPatterns = true
+	if !c.StartSession(cs) {
+		return
+	}
+
+	c.ReadMessages(cs, b)
+}
+
+// Reads the CONNECT packet that starts the connection, within the time clients have to answer pings.
+func (t *mqttTransport) readConnect() (*mqtt.Connect, error) {
+	t.conn.SetReadDeadline(time.Now().Add(t.options.PongWait))
+
+	p, err := mqtt.ReadPacket(t.reader, int(t.options.MaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Type != mqtt.TypeConnect {
+		return nil, mqtt.ErrMalformed
+	}
+
+	return mqtt.DecodeConnect(p.Body)
+}
+
+// Receive reads packets until one turns into protocol messages, answering the ones that don't.
+func (t *mqttTransport) Receive() ([]byte, error) {
+	for {
+		t.mu.Lock()
+		if len(t.pending) > 0 {
+			message := t.pending[0]
+			t.pending = t.pending[1:]
+			t.mu.Unlock()
+			return message, nil
+		}
+		t.mu.Unlock()
+
+		if t.keepAlive > 0 {
+			t.conn.SetReadDeadline(time.Now().Add(t.keepAlive))
+		} else {
+			t.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := mqtt.ReadPacket(t.reader, int(t.options.MaxMessageSize))
+		if err != nil {
+			if errors.Is(err, mqtt.ErrTooLarge) {
+				return nil, t.disconnect(mqttPacketTooLarge, "packet too large")
+			}
+
+			if errors.Is(err, mqtt.ErrMalformed) {
+				return nil, t.disconnect(mqttMalformedPacket, "malformed packet")
+			}
+
+			return nil, err
+		}
+
+		if err := t.handle(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Handles a packet of the client, queuing the protocol messages it turns into.
+func (t *mqttTransport) handle(p *mqtt.Packet) error {
+	switch p.Type {
+	case mqtt.TypePingreq:
+		return t.writePacket(&mqtt.Packet{Type: mqtt.TypePingresp})
+
+	case mqtt.TypeDisconnect:
+		return errMQTTDisconnect
+
+	case mqtt.TypePublish:
+		publish, err := mqtt.DecodePublish(t.version, p)
+		if err != nil {
+			return t.disconnect(mqttMalformedPacket, "malformed packet")
+		}
+
+		return t.publish(publish)
+
+	case mqtt.TypeSubscribe:
+		subscribe, err := mqtt.DecodeSubscribe(t.version, p)
+		if err != nil {
+			return t.disconnect(mqttMalformedPacket, "malformed packet")
+		}
+
+		return t.subscribe(subscribe)
+
+	case mqtt.TypeUnsubscribe:
+		unsubscribe, err := mqtt.DecodeUnsubscribe(t.version, p)
+		if err != nil {
+			return t.disconnect(mqttMalformedPacket, "malformed packet")
+		}
+
+		return t.unsubscribe(unsubscribe)
+	}
+
+	return t.disconnect(mqttProtocolError, "unexpected packet")
+}
+
+func (t *mqttTransport) publish(publish *mqtt.Publish) error {
+	if publish.QoS > 1 {
+		return t.disconnect(mqttQoSNotSupported, "QoS 2 is not supported")
+	}
+
+	channel, ok := mqttChannel(publish.Topic)
+	if !mqtt.ValidTopic(publish.Topic) || !ok {
+		return t.disconnect(mqttTopicNameInvalid, "invalid topic name")
+	}
+
+	// JSON payloads are published as their data, others as a string. JSON strings are published as a string too,
+	// with their quotes, since strings are delivered as the payload itself.
+	var data interface{} = string(publish.Payload)
+	if json.Valid(publish.Payload) && !bytes.HasPrefix(bytes.TrimSpace(publish.Payload), []byte(`"`)) {
+		data = json.RawMessage(publish.Payload)
+	}
+
+	event := mqttEvent
+	if userEvent, ok := publish.Properties.User("event"); ok && userEvent != "" {
+		event = userEvent
+	}
+
+	// Like MQTT brokers, clients get the messages they publish on the topics they're subscribed to.
+	includePublisher := true
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	if publish.QoS == 1 {
+		t.requests[t.seq] = &mqttRequest{ack: &mqttAck{packetType: mqtt.TypePuback, packetID: publish.PacketID}}
+	}
+
+	return t.queue(protocol.MessageTypePublish, &protocol.PublishMessageDataData{
+		SequenceNumber:   t.seq,
+		IncludePublisher: &includePublisher,
+		Channel:          channel,
+		Event:            event,
+		Data:             data,
+	})
+}
+
+// Subscribes to the channels or the channel patterns of the filters that aren't subscribed to yet, the SUBACK is sent
+// once every subscription is replied to.
+func (t *mqttTransport) subscribe(subscribe *mqtt.Subscribe) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ack := &mqttAck{packetType: mqtt.TypeSuback, packetID: subscribe.PacketID, codes: make([]byte, len(subscribe.Subscriptions))}
+	for i, subscription := range subscribe.Subscriptions {
+		channel, ok := mqttChannelPattern(subscription.Filter)
+		if !ok {
+			ack.codes[i] = t.reasonCode(mqttTopicFilterInvalid, mqttSubscriptionFailed3)
+			continue
+		}
+
+		// Subscribing to a filter again replaces the subscription, which only has QoS 0 here anyway.
+		if _, ok := t.filters[subscription.Filter]; ok {
+			continue
+		}
+
+		if t.channels[channel] > 0 {
+			t.filters[subscription.Filter] = channel
+			t.channels[channel]++
+			continue
+		}
+
+		request := &mqttRequest{ack: ack, index: i, filter: subscription.Filter, channel: channel}
+		ack.waiting++
+
+		if seq, ok := t.subscribing[channel]; ok {
+			t.requests[seq].attached = append(t.requests[seq].attached, request)
+			continue
+		}
+
+		t.seq++
+		t.requests[t.seq] = request
+		t.subscribing[channel] = t.seq
+
+		if err := t.queue(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: t.seq, Channel: channel}); err != nil {
+			return err
+		}
+	}
+
+	if ack.waiting == 0 {
+		return t.writeAck(ack)
+	}
+
+	return nil
+}
+
+// Stops delivering the messages of the filters right away and unsubscribes from the channels or the channel patterns
+// no other filter uses.
+func (t *mqttTransport) unsubscribe(unsubscribe *mqtt.Unsubscribe) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	codes := make([]byte, len(unsubscribe.Filters))
+	for i, filter := range unsubscribe.Filters {
+		channel, ok := t.filters[filter]
+		if !ok {
+			codes[i] = mqttNoSubscription
+			continue
+		}
+
+		delete(t.filters, filter)
+		if t.channels[channel]--; t.channels[channel] > 0 {
+			continue
+		}
+
+		delete(t.channels, channel)
+
+		// Nobody waits for the reply.
+		t.seq++
+		if err := t.queue(protocol.MessageTypeUnsubscribe, &protocol.UnsubscribeMessageData{SequenceNumber: t.seq, Channel: channel}); err != nil {
+			return err
+		}
+	}
+
+	return t.writePacketLocked(mqtt.EncodeUnsuback(t.version, unsubscribe.PacketID, codes))
+}
+
+// Queues a protocol message to be received.
+func (t *mqttTransport) queue(messageType string, data interface{}) error {
+	message, err := json.Marshal(&protocol.Message{Type: messageType, Data: data})
+	if err != nil {
+		return err
+	}
+
+	t.pending = append(t.pending, message)
+	return nil
+}
+
+// Send turns the messages of the realtime protocol MQTT has a packet for into packets, the others are dropped.
+func (t *mqttTransport) Send(message []byte) error {
+	var envelope struct {
+		Type           string          `json:"t"`
+		Data           json.RawMessage `json:"d"`
+		SequenceNumber int64           `json:"s"`
+		Code           string          `json:"c"`
+	}
+
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return err
+	}
+
+	var reply struct {
+		SequenceNumber int64 `json:"s"`
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errStreamClosed
+	}
+
+	switch envelope.Type {
+	case protocol.MessageTypeHello:
+		t.connected = true
+		return t.writePacketLocked(mqtt.EncodeConnack(t.version, 0, mqtt.Properties{
+			{ID: mqtt.PropertyMaximumQoS, Value: byte(1)},
+			{ID: mqtt.PropertyRetainAvailable, Value: byte(0)},
+			{ID: mqtt.PropertySharedSubscriptionAvailable, Value: byte(0)},
+			{ID: mqtt.PropertySubscriptionIDAvailable, Value: byte(0)},
+			{ID: mqtt.PropertyMaximumPacketSize, Value: uint32(t.options.MaxMessageSize)},
+		}))
+
+	case protocol.MessageTypeSubscribeSuccess, protocol.MessageTypePublishSuccess:
+		if err := json.Unmarshal(envelope.Data, &reply); err != nil {
+			return err
+		}
+
+		return t.resolve(reply.SequenceNumber, 0)
+
+	case protocol.MessageTypeError:
+		code := byte(mqttUnspecifiedError)
+		if envelope.Code == protocol.ErrorCodeRateLimited {
+			code = mqttQuotaExceeded
+		}
+
+		return t.resolve(envelope.SequenceNumber, code)
+
+	case protocol.MessageTypePublish:
+		var data protocol.PublishMessageData
+		if err := json.Unmarshal(envelope.Data, &data); err != nil {
+			return err
+		}
+
+		return t.deliver(&data)
+	}
+
+	return nil
+}
+
+// Resolves the request the reply with the sequence number is for, writing its ack once it has every reply.
+func (t *mqttTransport) resolve(seq int64, code byte) error {
+	request, ok := t.requests[seq]
+	if !ok {
+		return nil
+	}
+
+	delete(t.requests, seq)
+	if request.ack.packetType == mqtt.TypePuback {
+		return t.writePacketLocked(mqtt.EncodeAck(t.version, mqtt.TypePuback, request.ack.packetID, code, nil))
+	}
+
+	delete(t.subscribing, request.channel)
+	for _, r := range append([]*mqttRequest{request}, request.attached...) {
+		if code != 0 {
+			r.ack.codes[r.index] = t.reasonCode(code, mqttSubscriptionFailed3)
+		} else if _, ok := t.filters[r.filter]; !ok {
+			t.filters[r.filter] = r.channel
+			t.channels[r.channel]++
+		}
+
+		if r.ack.waiting--; r.ack.waiting > 0 {
+			continue
+		}
+
+		if err := t.writeAck(r.ack); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *mqttTransport) writeAck(ack *mqttAck) error {
+	return t.writePacketLocked(mqtt.EncodeSuback(t.version, ack.packetID, ack.codes))
+}
+
+// Delivers the message to the client if its topic matches any of the filters subscribed to, the data of the message
+// is the payload when it's a string and its JSON otherwise.
+func (t *mqttTransport) deliver(data *protocol.PublishMessageData) error {
+	topic := mqttTopic(data.Channel)
+
+	matches := false
+	for filter := range t.filters {
+		if mqtt.Match(filter, topic) {
+			matches = true
+			break
+		}
+	}
+
+	if !matches {
+		return nil
+	}
+
+	payload, ok := data.Data.(string)
+	if !ok {
+		encoded, err := json.Marshal(data.Data)
+		if err != nil {
+			return err
+		}
+
+		payload = string(encoded)
+	}
+
+	publish := &mqtt.Publish{Topic: topic, Payload: []byte(payload)}
+	if data.Event != "" {
+		publish.Properties = mqtt.Properties{{ID: mqtt.PropertyUserProperty, Value: mqtt.UserProperty{Key: "event", Value: data.Event}}}
+	}
+
+	if err := t.writePacketLocked(publish.Encode(t.version)); err != nil {
+		return err
+	}
+
+	messagesSent.Inc()
+	return nil
+}
+
+// Close rejects the connection with a CONNACK if it's not accepted yet, or tells MQTT 5 clients why it's closed with
+// a DISCONNECT, then closes it.
+func (t *mqttTransport) Close(code int, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	var err error
+	if !t.connected {
+		err = t.writePacketLocked(mqtt.EncodeConnack(t.version, t.connackCode(code), mqtt.Properties{{ID: mqtt.PropertyReasonString, Value: reason}}))
+	} else if p := mqtt.EncodeDisconnect(t.version, t.disconnectCode(code), reason); p != nil {
+		err = t.writePacketLocked(p)
+	}
+
+	t.closed = true
+	t.conn.Close()
+	return err
+}
+
+// Maps the close codes of the protocol onto the reason codes of CONNACK packets.
+func (t *mqttTransport) connackCode(code int) byte {
+	switch code {
+	case 4001, 4005:
+		return t.reasonCode(mqttBadCredentials, mqttBadCredentials3)
+
+	case 4003:
+		return t.reasonCode(mqttNotAuthorized, mqttNotAuthorized3)
+
+	case 4009:
+		return t.reasonCode(mqttServerUnavailable, mqttServerUnavailable3)
+
+	case closeCodeServerFull, closeCodeAppFull, closeCodeIPFull:
+		return t.reasonCode(mqttServerBusy, mqttServerUnavailable3)
+	}
+
+	return t.reasonCode(mqttUnspecifiedError, mqttServerUnavailable3)
+}
+
+// Maps the close codes of the protocol onto the reason codes of DISCONNECT packets.
+func (t *mqttTransport) disconnectCode(code int) byte {
+	switch code {
+	case 4009:
+		return mqttServerShuttingDown
+
+	case 4029:
+		return mqttMessageRateTooHigh
+
+	case 4010:
+		return mqttMalformedPacket
+	}
+
+	return mqttUnspecifiedError
+}
+
+// Returns the reason code of MQTT 5 or the return code of MQTT 3.1.1, depending on the version of the client.
+func (t *mqttTransport) reasonCode(code5 byte, code3 byte) byte {
+	if t.version == mqtt.Version5 {
+		return code5
+	}
+
+	return code3
+}
+
+// Closes the connection because of the client, telling MQTT 5 clients why. The error is returned to stop reading.
+func (t *mqttTransport) disconnect(code byte, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		if p := mqtt.EncodeDisconnect(t.version, code, reason); p != nil {
+			t.writePacketLocked(p)
+		}
+
+		t.closed = true
+		t.conn.Close()
+	}
+
+	return errors.New(reason)
+}
+
+// Keepalive does nothing, MQTT clients ping the server.
+func (t *mqttTransport) Keepalive() error {
+	return nil
+}
+
+func (t *mqttTransport) Abort() error {
+	return t.conn.Close()
+}
+
+func (t *mqttTransport) writePacket(p *mqtt.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writePacketLocked(p)
+}
+
+func (t *mqttTransport) writePacketLocked(p *mqtt.Packet) error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.options.WriteWait))
+	_, err := p.WriteTo(t.conn)
+	return err
+}
@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// How often the occupancy of the channels that changed is sent to listeners.
+const occupancyInterval = time.Second
+
+type NatsOccupancyData struct {
+	Channel         string `json:"c"`
+	Subscribers     int64  `json:"sc"`
+	Publishers      int64  `json:"pc"`
+	PresenceMembers int64  `json:"pmc"`
+}
+
+// occupancyTracker collects the channels whose occupancy changed because of the clients of this server, so their
+// occupancy is sent at most once per interval no matter how busy they are.
+type occupancyTracker struct {
+	mu      sync.Mutex
+	changed map[string]bool
+}
+
+func newOccupancyTracker() *occupancyTracker {
+	return &occupancyTracker{changed: make(map[string]bool)}
+}
+
+// Marks the occupancy of the channel (<app-id>:<channel-name>) as changed.
+func (t *occupancyTracker) mark(appChannel string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changed[appChannel] = true
+}
+
+func (t *occupancyTracker) run(ctx context.Context, cs store.ChannelStore, b broker.Broker, operationTimeout time.Duration) {
+	ticker := time.NewTicker(occupancyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			operationCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+			t.publish(operationCtx, cs, b)
+			cancel()
+		}
+	}
+}
+
+// Publishes the occupancy of the channels that changed since the last time.
+func (t *occupancyTracker) publish(ctx context.Context, cs store.ChannelStore, b broker.Broker) {
+	t.mu.Lock()
+	changed := t.changed
+	t.changed = make(map[string]bool)
+	t.mu.Unlock()
+
+	for appChannel := range changed {
+		occupancy, err := cs.Occupancy(ctx, appChannel)
+		if err != nil {
+			logrus.Error(fmt.Sprintf("failed to get occupancy of channel %s", appChannel))
+			continue
+		}
+
+		broker.PublishJSON(b, broker.SubjectOccupancy, &NatsOccupancyData{
+			Channel:         appChannel,
+			Subscribers:     occupancy.Subscribers,
+			Publishers:      occupancy.Publishers,
+			PresenceMembers: occupancy.PresenceMembers,
+		})
+	}
+}
+
+func (c *Client) occupancyListen(data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypeOccupancyListen),
+		})
+
+		return
+	}
+
+	d := protocol.OccupancyListenMessageData{}
+	if err := json.Unmarshal(jsonData, &d); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypeOccupancyListen),
+		})
+
+		return
+	}
+
+	if d.ChannelPrefix == "" {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("invalid data for mesage of type '%v', channel prefix can't be empty", protocol.MessageTypeOccupancyListen),
+		})
+
+		return
+	}
+
+	if slices.Contains(c.OccupancyListeningPrefixes, d.ChannelPrefix) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "you're already listening to the occupancy of channels with this prefix",
+		})
+
+		return
+	}
+
+	c.listeningMu.Lock()
+	c.OccupancyListeningPrefixes = append(c.OccupancyListeningPrefixes, d.ChannelPrefix)
+	c.listeningMu.Unlock()
+	c.WriteJSON(protocol.NewOccupancyListenSuccessMessage(&protocol.OccupancyListenSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
+
+func (c *Client) occupancyUnlisten(data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypeOccupancyUnlisten),
+		})
+
+		return
+	}
+
+	d := protocol.OccupancyUnlistenMessageData{}
+	if err := json.Unmarshal(jsonData, &d); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypeOccupancyUnlisten),
+		})
+
+		return
+	}
+
+	if d.ChannelPrefix == "" {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("invalid data for mesage of type '%v', channel prefix can't be empty", protocol.MessageTypeOccupancyUnlisten),
+		})
+
+		return
+	}
+
+	if !slices.Contains(c.OccupancyListeningPrefixes, d.ChannelPrefix) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "you're not listening to the occupancy of channels with this prefix",
+		})
+
+		return
+	}
+
+	c.listeningMu.Lock()
+	c.OccupancyListeningPrefixes = common.Filter(c.OccupancyListeningPrefixes, func(prefix string) bool {
+		return prefix != d.ChannelPrefix
+	})
+	c.listeningMu.Unlock()
+
+	c.WriteJSON(protocol.NewOccupancyUnlistenSuccessMessage(&protocol.OccupancyUnlistenSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
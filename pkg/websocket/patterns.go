@@ -0,0 +1,199 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// isPattern reports whether the channel of a subscription is a channel pattern, a prefix followed by "*".
+func isPattern(channel string) bool {
+	return strings.HasSuffix(channel, "*")
+}
+
+// hasPatternCapability reports whether the capabilities have the capability on any channel matching the pattern.
+func hasPatternCapability(capability string, pattern string, capabilities map[string]string) bool {
+	if HasCapability(capability, "*", capabilities) {
+		return true
+	}
+
+	for channel := range capabilities {
+		if common.MatchChannelPattern(pattern, channel) && HasCapability(capability, channel, capabilities) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Subscribes the client to every channel matching the pattern. Unlike subscribers of a channel, subscribers of a
+// pattern don't count towards the occupancy of the channels and only get the messages of the channels they're
+// allowed to subscribe to.
+func (c *Client) subscribePattern(d *protocol.SubscribeMessageData) {
+	if !common.ValidateChannelPattern(d.Channel) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("invalid 'channel' for mesage of type '%v'", protocol.MessageTypeSubscribe),
+		})
+
+		return
+	}
+
+	if !hasPatternCapability(string(protocol.MessageTypeSubscribe), d.Channel, c.capabilities) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're not allowed to subscribe to the channels %s", d.Channel),
+		})
+
+		return
+	}
+
+	appPattern := c.AppID + ":" + d.Channel
+	if slices.Contains(c.patterns, appPattern) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're already subscribed to the channels %s", d.Channel),
+		})
+
+		return
+	}
+
+	if len(c.channels)+len(c.patterns) > c.hub.Options.MaxChannels {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you can't subscribe to more than %v channels", c.hub.Options.MaxChannels),
+		})
+
+		return
+	}
+
+	c.patterns = append(c.patterns, appPattern)
+	sendToHub(c.hub, c.hub.subscribe, &hubSubscription{client: c, channel: appPattern})
+	c.WriteJSON(protocol.NewSubscribeSuccessMessage(&protocol.SubscribeSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
+
+func (c *Client) unsubscribePattern(d *protocol.UnsubscribeMessageData) {
+	appPattern := c.AppID + ":" + d.Channel
+	if !slices.Contains(c.patterns, appPattern) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're not subscribed to the channels %s", d.Channel),
+		})
+
+		return
+	}
+
+	c.patterns = common.Filter(c.patterns, func(pattern string) bool {
+		return pattern != appPattern
+	})
+
+	sendToHub(c.hub, c.hub.unsubscribe, &hubUnsubscription{client: c, channel: appPattern})
+	c.WriteJSON(protocol.NewUnsubscribeSuccessMessage(&protocol.UnsubscribeSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
+
+// Adds a subscriber to the pattern (<app-id>:<prefix>*), subscribing to the subjects of every channel of the app
+// when it's the first pattern of the app on this server.
+func (h *Hub) addPatternClient(b broker.Broker, appPattern string, c *Client) {
+	h.mu.Lock()
+	h.PatternsClients[appPattern] = append(h.PatternsClients[appPattern], c)
+	h.mu.Unlock()
+
+	appID := strings.Split(appPattern, ":")[0]
+	if _, ok := h.appSubscriptions[appID]; ok {
+		return
+	}
+
+	subscription, err := broker.SubscribeJSON(b, broker.ChannelSubject(appID, "*"), h.deliverPatterns)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("failed to subscribe to the subjects of the channels of app %s", appID))
+		return
+	}
+
+	h.appSubscriptions[appID] = subscription
+}
+
+// Removes a subscriber from the pattern (<app-id>:<prefix>*), unsubscribing from the subjects of every channel of
+// the app when the app has no patterns left on this server.
+func (h *Hub) removePatternClient(appPattern string, c *Client) {
+	h.mu.Lock()
+	h.PatternsClients[appPattern] = common.Filter(h.PatternsClients[appPattern], func(cl *Client) bool {
+		return cl.sessionID != c.sessionID
+	})
+
+	if len(h.PatternsClients[appPattern]) > 0 {
+		h.mu.Unlock()
+		return
+	}
+
+	delete(h.PatternsClients, appPattern)
+	h.mu.Unlock()
+
+	appID := strings.Split(appPattern, ":")[0]
+	for pattern := range h.PatternsClients {
+		if strings.HasPrefix(pattern, appID+":") {
+			return
+		}
+	}
+
+	if subscription, ok := h.appSubscriptions[appID]; ok {
+		subscription.Unsubscribe()
+		delete(h.appSubscriptions, appID)
+	}
+}
+
+// Sends a message published on a channel to the subscribers of the patterns it matches on this server, once to
+// every subscriber. Subscribers of the channel itself already got it.
+func (h *Hub) deliverPatterns(data *NatsChannelPublishData) {
+	// Channel parts: <app-id>:<channel-name>
+	channelParts := strings.Split(data.Channel, ":")
+	if len(channelParts) != 2 {
+		return
+	}
+	appID, channelName := channelParts[0], channelParts[1]
+
+	message := protocol.NewPublishMessage(&protocol.PublishMessageData{Channel: channelName, Data: data.Data, Event: data.Event})
+	for _, c := range h.patternClients(appID, data) {
+		c.WriteJSON(message)
+	}
+}
+
+// Returns the clients the message published on the channel has to be sent to as subscribers of patterns, they're
+// sent it without holding the lock.
+func (h *Hub) patternClients(appID string, data *NatsChannelPublishData) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	channelName := strings.TrimPrefix(data.Channel, appID+":")
+	delivered := make(map[*Client]bool)
+	for _, c := range h.ChannelsClients[data.Channel] {
+		delivered[c] = true
+	}
+
+	var clients []*Client
+	for appPattern, patternClients := range h.PatternsClients {
+		if !strings.HasPrefix(appPattern, appID+":") || !common.MatchChannelPattern(strings.TrimPrefix(appPattern, appID+":"), channelName) {
+			continue
+		}
+
+		for _, c := range patternClients {
+			if delivered[c] || c.sessionID == data.PublisherID || !HasCapability(string(protocol.MessageTypeSubscribe), channelName, c.capabilities) {
+				continue
+			}
+
+			delivered[c] = true
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
@@ -0,0 +1,331 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// Messages queued for a long-polling client before it's disconnected for not polling often enough.
+	maxQueuedMessages = 1024
+
+	closeCodeTooManyQueued = 4011
+)
+
+// pollTransport queues the messages of a long-polling client until it polls them. Close messages are queued as
+// messages of type close with the code and the reason.
+type pollTransport struct {
+	mu       sync.Mutex
+	messages []json.RawMessage
+
+	// Signalled when messages are queued.
+	ready chan struct{}
+
+	// Messages sent by the client waiting to be handled.
+	inbox chan []byte
+
+	// When the client last polled and how many of its polls are waiting for messages.
+	polled  time.Time
+	waiting int
+
+	closed bool
+	done   chan struct{}
+
+	// The messages of a request are delivered before the ones of the next one.
+	delivering sync.Mutex
+}
+
+// newPollTransport returns a transport buffering up to burst messages sent by the client.
+func newPollTransport(burst int) *pollTransport {
+	return &pollTransport{
+		ready:  make(chan struct{}, 1),
+		inbox:  make(chan []byte, burst),
+		polled: time.Now(),
+		done:   make(chan struct{}),
+	}
+}
+
+func (t *pollTransport) Send(message []byte) error {
+	// The hub sends the same message to many clients, it's never modified.
+	return t.queue(message, false)
+}
+
+func (t *pollTransport) Receive() ([]byte, error) {
+	select {
+	case message := <-t.inbox:
+		return message, nil
+
+	case <-t.done:
+		return nil, errStreamClosed
+	}
+}
+
+// Close queues a close message with the code and the reason and closes the session, the messages left can still be
+// polled.
+func (t *pollTransport) Close(code int, reason string) error {
+	closeData, _ := json.Marshal(map[string]interface{}{"t": "close", "d": map[string]interface{}{"code": code, "reason": reason}})
+	return t.queue(closeData, true)
+}
+
+// Keepalive does nothing, clients keep their session alive by polling it.
+func (t *pollTransport) Keepalive() error {
+	return nil
+}
+
+// queue queues the message for the next poll, closing the session afterwards if closeAfter is true.
+func (t *pollTransport) queue(message []byte, closeAfter bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errStreamClosed
+	}
+
+	if len(t.messages) == maxQueuedMessages {
+		// What was queued is dropped so the client finds out why it was disconnected on its next poll.
+		closeData, _ := json.Marshal(map[string]interface{}{"t": "close", "d": map[string]interface{}{"code": closeCodeTooManyQueued, "reason": "too many messages waiting to be polled"}})
+		t.messages = []json.RawMessage{closeData}
+		t.closeLocked()
+		return errStreamClosed
+	}
+
+	t.messages = append(t.messages, message)
+	if closeAfter {
+		t.closeLocked()
+	} else {
+		messagesSent.Inc()
+	}
+
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (t *pollTransport) Abort() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+	return nil
+}
+
+func (t *pollTransport) closeLocked() {
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// poll returns the messages queued, waiting up to timeout for some if there are none. It returns false if the
+// session is closed and every message was polled.
+func (t *pollTransport) poll(ctx context.Context, timeout time.Duration) ([]json.RawMessage, bool) {
+	t.mu.Lock()
+	t.waiting++
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		t.waiting--
+		t.polled = time.Now()
+		t.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		messages, closed := t.messages, t.closed
+		t.messages = nil
+		t.mu.Unlock()
+
+		if len(messages) > 0 {
+			return messages, true
+		}
+
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-t.ready:
+		case <-t.done:
+		case <-ctx.Done():
+			return []json.RawMessage{}, true
+		case <-timer.C:
+			return []json.RawMessage{}, true
+		}
+	}
+}
+
+// idle reports whether the client hasn't polled for longer than timeout.
+func (t *pollTransport) idle(timeout time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.waiting == 0 && time.Since(t.polled) > timeout
+}
+
+func (t *pollTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// drained reports whether the session is closed and every message was polled.
+func (t *pollTransport) drained() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed && len(t.messages) == 0
+}
+
+// pollSessions are the sessions of the long-polling clients by their ID. The ID of a session is a secret of its
+// client, unlike the session ID sent to other clients.
+type pollSessions struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+func newPollSessions() *pollSessions {
+	return &pollSessions{clients: make(map[string]*Client)}
+}
+
+func (s *pollSessions) add(id string, c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[id] = c
+}
+
+func (s *pollSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, id)
+}
+
+// PollClient returns the long-polling client of the session with the ID, nil if there's no such session.
+func (h *Hub) PollClient(id string) *Client {
+	h.polls.mu.Lock()
+	defer h.polls.mu.Unlock()
+	return h.polls.clients[id]
+}
+
+// PollSessionInstance returns the instance of the server that started the long-polling session with the ID, empty if
+// it's unknown. Sessions only live on the server that started them.
+func PollSessionInstance(id string) string {
+	instance, _, ok := strings.Cut(id, ".")
+	if !ok {
+		return ""
+	}
+
+	return instance
+}
+
+// NewPollClient tries to authenticate the request the same way as the connections to /realtime and returns a new
+// long-polling client if successful.
+func NewPollClient(request *http.Request, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, hub *Hub) (c *Client, closeMessage []byte) {
+	c, closeMessage = newClient(request, db, channelRules, channelSchemas, allowedOrigins, hub)
+	if closeMessage != nil {
+		return nil, closeMessage
+	}
+
+	// The session outlives the request that starts it.
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	c.transport = newPollTransport(hub.Options.MessageBurst)
+	return c, nil
+}
+
+// StartPolling starts the session of the client and returns its ID, release is called when the session ends. If the
+// session can't start the client can still poll why until the session expires.
+func (c *Client) StartPolling(cs store.ChannelStore, b broker.Broker, release func()) string {
+	id := uuid.NewString()
+	if c.hub.Options.Instance != "" {
+		id = c.hub.Options.Instance + "." + id
+	}
+	c.hub.polls.add(id, c)
+
+	if c.StartSession(cs) {
+		go c.ReadMessages(cs, b)
+	}
+
+	go c.expire(id, release)
+	return id
+}
+
+// expire ends the session once it's closed or the client stops polling it, then forgets it once the messages left
+// are polled or the client stops polling it.
+func (c *Client) expire(id string, release func()) {
+	t := c.transport.(*pollTransport)
+	timeout := c.hub.Options.PongWait
+
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for !t.isClosed() && !t.idle(timeout) {
+		select {
+		case <-t.done:
+		case <-ticker.C:
+		}
+	}
+
+	c.cancel()
+	sendToHub(c.hub, c.hub.unregister, c)
+	t.Abort()
+	release()
+
+	for !t.drained() && !t.idle(timeout) {
+		<-ticker.C
+	}
+
+	c.hub.polls.remove(id)
+}
+
+// Poll returns the messages sent to the long-polling client since its last poll, waiting for some if there are
+// none. It returns false if the session is over.
+func (c *Client) Poll(ctx context.Context) ([]json.RawMessage, bool) {
+	return c.transport.(*pollTransport).poll(ctx, c.hub.Options.PollTimeout)
+}
+
+// Deliver hands the messages sent by the long-polling client to its session in order, returning false if the
+// session is over. It waits while the session is handling a burst of messages.
+func (c *Client) Deliver(ctx context.Context, messages []json.RawMessage) bool {
+	t := c.transport.(*pollTransport)
+	t.delivering.Lock()
+	defer t.delivering.Unlock()
+
+	if t.isClosed() {
+		return false
+	}
+
+	for _, message := range messages {
+		select {
+		case t.inbox <- message:
+		case <-t.done:
+			return true
+		case <-ctx.Done():
+			return true
+		}
+	}
+
+	return true
+}
+
+// EndPolling ends the session of the long-polling client, the messages left aren't polled.
+func (c *Client) EndPolling(id string) {
+	c.transport.Abort()
+	c.hub.polls.remove(id)
+}
@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/common"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/store"
+	"golang.org/x/exp/slices"
+)
+
+func (c *Client) presenceEnter(data interface{}, cs store.ChannelStore, b broker.Broker) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypePresenceEnter),
+		})
+
+		return
+	}
+
+	d := protocol.PresenceEnterMessageData{}
+	if err := json.Unmarshal(jsonData, &d); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypePresenceEnter),
+		})
+
+		return
+	}
+
+	appChannel := c.AppID + ":" + d.Channel
+	if !slices.Contains(c.channels, appChannel) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're not subscribed to the channel %s", d.Channel),
+		})
+
+		return
+	}
+
+	if slices.Contains(c.presence, appChannel) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're already present on the channel %s", d.Channel),
+		})
+
+		return
+	}
+
+	memberData, err := json.Marshal(d.Data)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("invalid 'data' for mesage of type '%v'", protocol.MessageTypePresenceEnter),
+		})
+
+		return
+	}
+
+	if err := cs.EnterPresence(ctx, c.hub.ServerID, appChannel, c.sessionID, memberData); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error entering presence",
+		})
+
+		return
+	}
+
+	presenceChangeErr := broker.PublishJSON(b, broker.SubjectPresenceChange, &NatsPresenceChangeData{
+		Channel:   appChannel,
+		SessionID: c.sessionID,
+		Action:    protocol.PresenceActionEnter,
+		Data:      d.Data,
+	})
+
+	if presenceChangeErr != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error notifying of presence change",
+		})
+
+		return
+	}
+
+	c.contributionsMu.Lock()
+	c.presence = append(c.presence, appChannel)
+	if c.presenceData == nil {
+		c.presenceData = make(map[string][]byte)
+	}
+	c.presenceData[appChannel] = memberData
+	c.contributionsMu.Unlock()
+
+	c.hub.occupancy.mark(appChannel)
+	c.WriteJSON(protocol.NewPresenceEnterSuccessMessage(&protocol.PresenceEnterSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
+
+func (c *Client) presenceLeave(data interface{}, cs store.ChannelStore, b broker.Broker) {
+	ctx, cancel := c.operationContext()
+	defer cancel()
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypePresenceLeave),
+		})
+
+		return
+	}
+
+	d := protocol.PresenceLeaveMessageData{}
+	if err := json.Unmarshal(jsonData, &d); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:   protocol.MessageTypeError,
+			Reason: fmt.Sprintf("invalid data for mesage of type '%v'", protocol.MessageTypePresenceLeave),
+		})
+
+		return
+	}
+
+	appChannel := c.AppID + ":" + d.Channel
+	if !slices.Contains(c.presence, appChannel) {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         fmt.Sprintf("you're not present on the channel %s", d.Channel),
+		})
+
+		return
+	}
+
+	if err := c.leavePresence(ctx, appChannel, cs, b); err != nil {
+		c.WriteJSON(&protocol.ErrorMessage{
+			Type:           protocol.MessageTypeError,
+			SequenceNumber: d.SequenceNumber,
+			Reason:         "internal server error leaving presence",
+		})
+
+		return
+	}
+
+	c.WriteJSON(protocol.NewPresenceLeaveSuccessMessage(&protocol.PresenceLeaveSuccessMessageData{SequenceNumber: d.SequenceNumber}))
+}
+
+// Removes the client from the presence set of the channel and notifies every server about it.
+func (c *Client) leavePresence(ctx context.Context, appChannel string, cs store.ChannelStore, b broker.Broker) error {
+	if err := cs.LeavePresence(ctx, c.hub.ServerID, appChannel, c.sessionID); err != nil {
+		return err
+	}
+
+	c.contributionsMu.Lock()
+	c.presence = common.Filter(c.presence, func(channel string) bool {
+		return channel != appChannel
+	})
+	delete(c.presenceData, appChannel)
+	c.contributionsMu.Unlock()
+
+	c.hub.occupancy.mark(appChannel)
+
+	return broker.PublishJSON(b, broker.SubjectPresenceChange, &NatsPresenceChangeData{
+		Channel:   appChannel,
+		SessionID: c.sessionID,
+		Action:    protocol.PresenceActionLeave,
+	})
+}
+
+// SessionID returns the session ID of the client.
+func (c *Client) SessionID() string {
+	return c.sessionID
+}
+
+// Presence returns the channels (<app-id>:<channel-name>) the client is present on.
+func (c *Client) Presence() []string {
+	return c.presence
+}
+
+// Publishing returns the channels (<app-id>:<channel-name>) the client counts as a publisher of.
+func (c *Client) Publishing() []string {
+	return c.publishing
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// Maximum messages kept in the history of channels with persisted history.
+const maxHistoryMessages = 100
+
+// HasCapability reports whether the capabilities allow the capability (e.g. "subscribe") on the channel.
+func HasCapability(capability string, channel string, capabilities map[string]string) bool {
+	starCapabilities, hasStarCapabilities := capabilities["*"]
+	if hasStarCapabilities {
+		s := strings.Split(starCapabilities, ",")
+		return (slices.Contains(s, "*") || slices.Contains(s, capability))
+	}
+
+	channelCapabilities, hasChannelCapabilities := capabilities[channel]
+	if hasChannelCapabilities {
+		s := strings.Split(channelCapabilities, ",")
+		return (slices.Contains(s, "*") || slices.Contains(s, capability))
+	}
+
+	return false
+}
+
+// CheckPublish checks a message against the rule of its channel and the schema of its event, it returns the reason
+// why the message can't be published or an empty string if it can. It's shared by WebSocket clients and the REST API.
+func CheckPublish(ctx context.Context, rule *models.ChannelRule, channelSchemas *schemas.Store, appID string, data *protocol.PublishMessageData) (reason string, err error) {
+	if rule != nil {
+		if !rules.AllowsEvent(rule, data.Event) {
+			return fmt.Sprintf("the event %s is not allowed on the channel %s", data.Event, data.Channel), nil
+		}
+
+		if rule.MaxPayloadSize > 0 {
+			payload, _ := json.Marshal(data.Data)
+			if len(payload) > rule.MaxPayloadSize {
+				return fmt.Sprintf("the payload can't be bigger than %v bytes on the channel %s", rule.MaxPayloadSize, data.Channel), nil
+			}
+		}
+	}
+
+	valid, schemaReason, err := channelSchemas.Validate(ctx, appID, data.Channel, data.Event, data.Data)
+	if err != nil {
+		return "", err
+	}
+
+	if !valid {
+		return fmt.Sprintf("the payload doesn't match the schema of the event %s on the channel %s: %s", data.Event, data.Channel, schemaReason), nil
+	}
+
+	return "", nil
+}
+
+// Publish sends a message to the subscribers of its channel on every server, excluding the client with the session
+// publisherID if it's not empty. The message is persisted if the rule of the channel says so and tracked for pricing
+// and analytics.
+func Publish(ctx context.Context, cs store.ChannelStore, b broker.Broker, rule *models.ChannelRule, appID string, data *protocol.PublishMessageData, publisherID string) error {
+	appChannel := appID + ":" + data.Channel
+
+	publishErr := broker.PublishJSON(b, broker.ChannelSubject(appID, data.Channel), &NatsChannelPublishData{
+		Channel:     appChannel,
+		Event:       data.Event,
+		Data:        data.Data,
+		PublisherID: publisherID,
+	})
+
+	if publishErr != nil {
+		return publishErr
+	}
+
+	if rule != nil && rule.PersistHistory {
+		persistHistory(ctx, cs, rule, appChannel, data)
+	}
+
+	// Published messages in a month (for pricing and analytics).
+	if err := cs.CountPublishedMessage(ctx, appID); err != nil {
+		logrus.Error(fmt.Sprintf("failed to track published message of app %s", appID))
+	}
+
+	return nil
+}
+
+// Appends the message to the persisted history of the channel, keeping at most maxHistoryMessages.
+func persistHistory(ctx context.Context, cs store.ChannelStore, rule *models.ChannelRule, appChannel string, data *protocol.PublishMessageData) {
+	entry, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	if err := cs.AppendHistory(ctx, appChannel, entry, maxHistoryMessages, time.Duration(rule.HistoryTTL)*time.Second); err != nil {
+		logrus.Error(fmt.Sprintf("failed to persist history of channel %s", appChannel))
+	}
+}
+
+// PublishLimits are the messages that can be published per second on a channel and by an app across every server, 0
+// means no limit. Bursts of up to a second of messages are allowed.
+type PublishLimits struct {
+	ChannelMessagesPerSecond int
+	AppMessagesPerSecond     int
+}
+
+// AllowPublish takes a token from the buckets of the channel and of the app, returning false if the message can't be
+// published because either of them is empty. The token of the channel is returned when the app has none left.
+func AllowPublish(ctx context.Context, cs store.ChannelStore, limits PublishLimits, appID string, appChannel string) (bool, error) {
+	channelBucket, channelPerSecond := "channel:"+appChannel, int64(limits.ChannelMessagesPerSecond)
+	if channelPerSecond > 0 {
+		if allowed, err := cs.TakeToken(ctx, channelBucket, channelPerSecond, channelPerSecond); err != nil || !allowed {
+			return false, err
+		}
+	}
+
+	if limits.AppMessagesPerSecond > 0 {
+		perSecond := int64(limits.AppMessagesPerSecond)
+		if allowed, err := cs.TakeToken(ctx, "app:"+appID, perSecond, perSecond); err != nil || !allowed {
+			if channelPerSecond > 0 {
+				if returnErr := cs.ReturnToken(ctx, channelBucket, channelPerSecond, channelPerSecond); returnErr != nil {
+					logrus.Error(fmt.Sprintf("failed to return the token of channel %s", appChannel))
+				}
+			}
+
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,28 @@
+package websocket_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/websocket"
+)
+
+func TestAllowPublishReturnsTheChannelToken(t *testing.T) {
+	ctx := context.Background()
+	cs := store.NewMemoryStore()
+	limits := websocket.PublishLimits{ChannelMessagesPerSecond: 1, AppMessagesPerSecond: 1}
+
+	if allowed, err := websocket.AllowPublish(ctx, cs, limits, "app", "app:lobby"); err != nil || !allowed {
+		t.Fatalf("expected the message to be allowed, but got %t (%v)", allowed, err)
+	}
+
+	// The app has no tokens left, so the channel keeps its own.
+	if allowed, err := websocket.AllowPublish(ctx, cs, limits, "app", "app:chat"); err != nil || allowed {
+		t.Fatalf("expected the message not to be allowed, but got %t (%v)", allowed, err)
+	}
+
+	if taken, err := cs.TakeToken(ctx, "channel:app:chat", 1, 1); err != nil || !taken {
+		t.Fatalf("expected the channel to have its token, but got %t (%v)", taken, err)
+	}
+}
@@ -0,0 +1,232 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+type connKey struct{}
+
+// WithConn returns a copy of ctx with the connection, it's meant for the ConnContext of the HTTP server so SSE
+// streams can lift its write timeout.
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+var errStreamClosed = errors.New("stream closed")
+
+// sseTransport delivers the messages of a client as Server-Sent Events, the type of every message is the name of
+// its event and its data the data of the event.
+type sseTransport struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	// Connection of the stream over HTTP/1, its write deadline is pushed back on every write. It's nil over HTTP/2,
+	// where the write timeout of the server can't be lifted.
+	conn      net.Conn
+	writeWait time.Duration
+
+	closed bool
+	done   chan struct{}
+}
+
+// Send sends the message as an event named after its type.
+func (t *sseTransport) Send(message []byte) error {
+	var envelope struct {
+		Type string          `json:"t"`
+		Data json.RawMessage `json:"d"`
+	}
+
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return err
+	}
+
+	// Error messages don't have data, the whole message is the data of their event.
+	data := message
+	if len(envelope.Data) > 0 && envelope.Type != protocol.MessageTypeError {
+		data = envelope.Data
+	}
+
+	if err := t.send(fmt.Sprintf("event: %s\ndata: %s\n\n", envelope.Type, data), false); err != nil {
+		return err
+	}
+
+	messagesSent.Inc()
+	return nil
+}
+
+// Receive waits for the stream to close, SSE clients can't send messages.
+func (t *sseTransport) Receive() ([]byte, error) {
+	<-t.done
+	return nil, errStreamClosed
+}
+
+// Close sends a close event with the code and the reason and closes the stream, unlike websocket clients SSE clients
+// can't close it when asked to.
+func (t *sseTransport) Close(code int, reason string) error {
+	closeData, _ := json.Marshal(map[string]interface{}{"code": code, "reason": reason})
+	return t.send(fmt.Sprintf("event: close\ndata: %s\n\n", closeData), true)
+}
+
+func (t *sseTransport) Keepalive() error {
+	return t.send(": ping\n\n", false)
+}
+
+// send writes the event to the stream and flushes it, closing the stream afterwards if closeAfter is true or the
+// write failed.
+func (t *sseTransport) send(event string, closeAfter bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errStreamClosed
+	}
+
+	if t.conn != nil {
+		t.conn.SetWriteDeadline(time.Now().Add(t.writeWait))
+	}
+
+	_, err := io.WriteString(t.w, event)
+	if err == nil {
+		t.flusher.Flush()
+	}
+
+	if err != nil || closeAfter {
+		t.closeLocked()
+	}
+
+	return err
+}
+
+func (t *sseTransport) Abort() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+	return nil
+}
+
+func (t *sseTransport) closeLocked() {
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// HTTPError returns the status code and the reason of the response rejecting a request with the close message of
+// a rejected connection.
+func HTTPError(closeMessage []byte) (int, string) {
+	code, reason := closeCode(closeMessage)
+	switch code {
+	case 4001, 4005:
+		return http.StatusUnauthorized, reason
+
+	case 4003:
+		return http.StatusForbidden, reason
+
+	case 4009, closeCodeServerFull, closeCodeAppFull, closeCodeIPFull:
+		return http.StatusServiceUnavailable, reason
+	}
+
+	return http.StatusInternalServerError, reason
+}
+
+// NewSSEClient tries to authenticate the request the same way as the connections to /realtime and returns a new
+// client streaming to w if successful.
+func NewSSEClient(request *http.Request, w http.ResponseWriter, db *gorm.DB, channelRules *rules.Store, channelSchemas *schemas.Store, allowedOrigins *origins.Store, hub *Hub) (c *Client, closeMessage []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, websocket.FormatCloseMessage(4500, "streaming not supported")
+	}
+
+	c, closeMessage = newClient(request, db, channelRules, channelSchemas, allowedOrigins, hub)
+	if closeMessage != nil {
+		return nil, closeMessage
+	}
+
+	t := &sseTransport{w: w, flusher: flusher, writeWait: hub.Options.WriteWait, done: make(chan struct{})}
+	if conn, ok := request.Context().Value(connKey{}).(net.Conn); ok && request.ProtoMajor == 1 {
+		t.conn = conn
+	}
+
+	c.transport = t
+	return c, nil
+}
+
+// Stream subscribes the client to the channels and listens to the situation of the channels with the prefixes,
+// then streams the events until the client goes away or the stream is closed. Over HTTP/2 streams end after the
+// stream timeout and clients reconnect.
+func (c *Client) Stream(cs store.ChannelStore, b broker.Broker, channels []string, situationPrefixes []string) {
+	t := c.transport.(*sseTransport)
+
+	defer func() {
+		c.cancel()
+		sendToHub(c.hub, c.hub.unregister, c)
+		c.transport.Abort()
+	}()
+
+	header := t.w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+
+	var timeout <-chan time.Time
+	if t.conn == nil && c.hub.Options.StreamTimeout > 0 {
+		timer := time.NewTimer(c.hub.Options.StreamTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// How long EventSource waits before reconnecting, in milliseconds.
+	if err := t.send(fmt.Sprintf("retry: %d\n\n", c.hub.Options.WriteWait.Milliseconds()), false); err != nil {
+		return
+	}
+
+	if !c.StartSession(cs) {
+		return
+	}
+
+	for i, channel := range channels {
+		c.subscribe(&protocol.SubscribeMessageData{SequenceNumber: int64(i + 1), Channel: strings.TrimSpace(channel)}, cs, b)
+	}
+
+	for i, prefix := range situationPrefixes {
+		c.situationListen(&protocol.SituationListenMessageData{SequenceNumber: int64(len(channels) + i + 1), ChannelPrefix: strings.TrimSpace(prefix)})
+	}
+
+	ticker := time.NewTicker(c.hub.Options.pingPeriod())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-t.done:
+			return
+
+		case <-timeout:
+			return
+
+		case <-ticker.C:
+			c.keepalive()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries the messages of the realtime protocol between a client and the server, e.g. over a websocket,
+// an SSE stream, long-polling or in memory in tests. Send, Close and Keepalive are never called concurrently.
+type Transport interface {
+	// Send sends a message to the client.
+	Send(message []byte) error
+
+	// Receive waits for the next message from the client, it returns an error once the connection is closed.
+	// Transports whose clients can't send messages wait until then.
+	Receive() ([]byte, error)
+
+	// Close tells the client the connection is closing with the code and the reason. Transports whose clients are
+	// expected to close the connection themselves give them the close grace period to do so, others close it right
+	// away.
+	Close(code int, reason string) error
+
+	// Keepalive keeps the connection alive while it's idle, e.g. by pinging the client.
+	Keepalive() error
+
+	// Abort closes the connection without telling the client, it can be called more than once.
+	Abort() error
+}
+
+// Returns the code and the reason of a close message.
+func closeCode(closeMessage []byte) (int, string) {
+	if len(closeMessage) < 2 {
+		return websocket.CloseNoStatusReceived, ""
+	}
+
+	return int(binary.BigEndian.Uint16(closeMessage)), string(closeMessage[2:])
+}
+
+// wsTransport carries the messages of a client over its websocket.
+type wsTransport struct {
+	ws      *websocket.Conn
+	options *Options
+
+	// Closes the connection once the client had time to close it after the close message.
+	closeOnce sync.Once
+}
+
+func newWSTransport(ws *websocket.Conn, options *Options) *wsTransport {
+	ws.SetReadLimit(options.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(options.PongWait))
+	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(options.PongWait)); return nil })
+
+	return &wsTransport{ws: ws, options: options}
+}
+
+// Send writes the message compressing it if it's over the threshold and the client negotiated compression.
+func (t *wsTransport) Send(message []byte) error {
+	t.ws.SetWriteDeadline(time.Now().Add(t.options.WriteWait))
+
+	conn, _ := t.ws.UnderlyingConn().(*countingConn)
+	compress := conn != nil && conn.compress && len(message) >= t.options.CompressionThreshold
+
+	var before uint64
+	if compress {
+		before = conn.bytesWritten()
+	}
+
+	t.ws.EnableWriteCompression(compress)
+	if err := t.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+		return err
+	}
+
+	messagesSent.Inc()
+	if compress {
+		compressedMessages.Inc()
+		compressedIn.Add(uint64(len(message)))
+		compressedOut.Add(conn.bytesWritten() - before)
+	}
+
+	return nil
+}
+
+func (t *wsTransport) Receive() ([]byte, error) {
+	_, message, err := t.ws.ReadMessage()
+	return message, err
+}
+
+func (t *wsTransport) Close(code int, reason string) error {
+	t.ws.SetWriteDeadline(time.Now().Add(t.options.WriteWait))
+	err := t.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+
+	t.closeOnce.Do(func() {
+		time.AfterFunc(t.options.CloseGracePeriod, func() { t.ws.Close() })
+	})
+
+	return err
+}
+
+func (t *wsTransport) Keepalive() error {
+	t.ws.SetWriteDeadline(time.Now().Add(t.options.WriteWait))
+	return t.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t *wsTransport) Abort() error {
+	return t.ws.Close()
+}
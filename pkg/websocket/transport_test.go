@@ -0,0 +1,160 @@
+package websocket_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gmencz/mycelium/pkg/broker"
+	"github.com/gmencz/mycelium/pkg/models"
+	"github.com/gmencz/mycelium/pkg/origins"
+	"github.com/gmencz/mycelium/pkg/protocol"
+	"github.com/gmencz/mycelium/pkg/rules"
+	"github.com/gmencz/mycelium/pkg/schemas"
+	"github.com/gmencz/mycelium/pkg/store"
+	"github.com/gmencz/mycelium/pkg/websocket"
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type memoryClient struct {
+	t         *testing.T
+	transport *websocket.MemoryTransport
+}
+
+func (c *memoryClient) send(messageType string, data interface{}) {
+	c.t.Helper()
+
+	message, err := json.Marshal(&protocol.Message{Type: messageType, Data: data})
+	if err != nil {
+		c.t.Fatalf("failed to encode message %s: %s", messageType, err)
+	}
+
+	if !c.transport.Deliver(message) {
+		c.t.Fatalf("failed to send message %s, the connection is closed", messageType)
+	}
+}
+
+func (c *memoryClient) expect(messageType string) json.RawMessage {
+	c.t.Helper()
+
+	select {
+	case data := <-c.transport.Messages():
+		var message struct {
+			Type string          `json:"t"`
+			Data json.RawMessage `json:"d"`
+		}
+
+		if err := json.Unmarshal(data, &message); err != nil || message.Type != messageType {
+			c.t.Fatalf("expected message %s, but got %s", messageType, data)
+		}
+
+		return message.Data
+
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("expected message %s, but got nothing", messageType)
+	}
+
+	return nil
+}
+
+func TestMemoryTransport(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+uuid.NewString()+"?mode=memory&cache=shared"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&models.App{}, &models.ApiKey{}, &models.ChannelRule{}, &models.ChannelSchema{}, &models.AllowedOrigin{}); err != nil {
+		t.Fatalf("failed to migrate database: %s", err)
+	}
+
+	app := models.App{ID: uuid.NewString(), Name: "test"}
+	key := models.ApiKey{ID: uuid.NewString(), Secret: uuid.NewString(), Capabilities: `{"*":"*"}`, AppID: app.ID}
+	if err := db.Create(&app).Error; err != nil {
+		t.Fatalf("failed to seed app: %s", err)
+	}
+
+	if err := db.Create(&key).Error; err != nil {
+		t.Fatalf("failed to seed key: %s", err)
+	}
+
+	hub := websocket.NewHub(websocket.Options{
+		PongWait:              time.Minute,
+		WriteWait:             time.Second,
+		CloseGracePeriod:      100 * time.Millisecond,
+		OperationTimeout:      5 * time.Second,
+		MaxMessageSize:        4096,
+		MaxChannels:           10,
+		MaxMessagesPerSecond:  100,
+		MessageBurst:          100,
+		DeltaKeyframeInterval: 20,
+	})
+
+	cs := store.NewMemoryStore()
+	b := broker.NewMemoryBroker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx, cs, b)
+
+	connect := func() *memoryClient {
+		t.Helper()
+
+		request := httptest.NewRequest("GET", "/?key="+url.QueryEscape(key.ID+":"+key.Secret), nil)
+		transport := websocket.NewMemoryTransport(16)
+		client, closeMessage := websocket.NewTransportClient(request, transport, db, rules.NewStore(db), schemas.NewStore(db), origins.NewStore(db), hub)
+		if closeMessage != nil {
+			t.Fatalf("expected the client to authenticate, but got %q", closeMessage)
+		}
+
+		if !client.StartSession(cs) {
+			t.Fatalf("expected the session to start")
+		}
+
+		go client.ReadMessages(cs, b)
+
+		c := &memoryClient{t: t, transport: transport}
+		c.expect(protocol.MessageTypeHello)
+		return c
+	}
+
+	subscriber := connect()
+	subscriber.send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: 1, Channel: "lobby"})
+	subscriber.expect(protocol.MessageTypeSubscribeSuccess)
+
+	publisher := connect()
+	publisher.send(protocol.MessageTypeSubscribe, &protocol.SubscribeMessageData{SequenceNumber: 1, Channel: "lobby"})
+	publisher.expect(protocol.MessageTypeSubscribeSuccess)
+
+	includePublisher := false
+	publisher.send(protocol.MessageTypePublish, &protocol.PublishMessageDataData{SequenceNumber: 2, IncludePublisher: &includePublisher, Channel: "lobby", Event: "greeting", Data: "hello"})
+	publisher.expect(protocol.MessageTypePublishSuccess)
+
+	var data protocol.PublishMessageData
+	if err := json.Unmarshal(subscriber.expect(protocol.MessageTypePublish), &data); err != nil || data.Event != "greeting" || data.Data != "hello" {
+		t.Fatalf("expected greeting on lobby, but got %+v (%v)", data, err)
+	}
+
+	// Invalid messages close the connection whatever the transport.
+	publisher.transport.Deliver([]byte("invalid"))
+	select {
+	case <-publisher.transport.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection to close")
+	}
+
+	if code, reason := publisher.transport.CloseCode(); code != 4010 {
+		t.Fatalf("expected close code %d, but got %d (%s)", 4010, code, reason)
+	}
+}
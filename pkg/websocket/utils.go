@@ -6,17 +6,70 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-const (
+// Options of the connections of a Hub.
+type Options struct {
+	// Time allowed to read the next pong message from the client.
+	PongWait time.Duration
+
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	WriteWait time.Duration
 
 	// Time to wait before force closing the connection.
-	closeGracePeriod = 10 * time.Second
-)
+	CloseGracePeriod time.Duration
+
+	// Time allowed to every operation of a client on the channel store, the database or the broker.
+	OperationTimeout time.Duration
+
+	// Maximum message size allowed from peer.
+	MaxMessageSize int64
+
+	// Maximum channels a client can subscribe to.
+	MaxChannels int
+
+	// Messages a client can send per second on average and at once.
+	MaxMessagesPerSecond int
+	MessageBurst         int
+
+	// Limits of the messages published on every channel and by every app.
+	PublishLimits PublishLimits
+
+	// Maximum connections to the server, 0 means no limit.
+	MaxConnections int
+
+	// Maximum connections to an app across every server unless the app sets its own, 0 means no limit.
+	MaxConnectionsPerApp int64
+
+	// Maximum connections to the server from an IP, 0 means no limit.
+	MaxConnectionsPerIP int
+
+	// Level of the permessage-deflate compression negotiated with clients, 0 disables it.
+	CompressionLevel int
+
+	// Messages smaller than this many bytes are sent uncompressed.
+	CompressionThreshold int
+
+	// Every this many messages of a channel subscribers receiving deltas get the whole data.
+	DeltaKeyframeInterval int
+
+	// How long SSE streams over HTTP/2 last before clients have to reconnect, 0 means no limit. Streams over HTTP/1
+	// aren't limited.
+	StreamTimeout time.Duration
+
+	// How long polls of long-polling clients wait for messages before returning none.
+	PollTimeout time.Duration
+
+	// ID of the instance of the server behind its load balancer, the IDs of long-polling sessions start with it.
+	Instance string
+}
+
+// Send pings to the client with this period. Must be less than PongWait.
+func (o *Options) pingPeriod() time.Duration {
+	return (o.PongWait * 9) / 10
+}
 
-func CloseWithMessage(ws *websocket.Conn, data []byte) {
-	ws.SetWriteDeadline(time.Now().Add(writeWait))
+func CloseWithMessage(ws *websocket.Conn, data []byte, options *Options) {
+	ws.SetWriteDeadline(time.Now().Add(options.WriteWait))
 	ws.WriteMessage(websocket.CloseMessage, data)
-	time.Sleep(closeGracePeriod)
+	time.Sleep(options.CloseGracePeriod)
 	ws.Close()
 }
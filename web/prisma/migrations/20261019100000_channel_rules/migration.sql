@@ -0,0 +1,22 @@
+-- CreateTable
+CREATE TABLE "channel_rules" (
+    "id" TEXT NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_at" TIMESTAMP(3) NOT NULL,
+    "pattern" TEXT NOT NULL,
+    "persist_history" BOOLEAN NOT NULL DEFAULT false,
+    "history_ttl" BIGINT NOT NULL DEFAULT 0,
+    "max_payload_size" INTEGER NOT NULL DEFAULT 0,
+    "allowed_events" TEXT NOT NULL DEFAULT '',
+    "client_publish" BOOLEAN NOT NULL DEFAULT true,
+    "echo_publisher" BOOLEAN NOT NULL DEFAULT false,
+    "app_id" TEXT NOT NULL,
+
+    CONSTRAINT "channel_rules_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "channel_rules_app_id_pattern_key" ON "channel_rules"("app_id", "pattern");
+
+-- AddForeignKey
+ALTER TABLE "channel_rules" ADD CONSTRAINT "fk_apps_channel_rules" FOREIGN KEY ("app_id") REFERENCES "apps"("id") ON DELETE CASCADE ON UPDATE CASCADE;
@@ -0,0 +1,18 @@
+-- CreateTable
+CREATE TABLE "channel_schemas" (
+    "id" TEXT NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_at" TIMESTAMP(3) NOT NULL,
+    "pattern" TEXT NOT NULL,
+    "event" TEXT NOT NULL DEFAULT '',
+    "schema" JSONB NOT NULL,
+    "app_id" TEXT NOT NULL,
+
+    CONSTRAINT "channel_schemas_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "channel_schemas_app_id_pattern_event_key" ON "channel_schemas"("app_id", "pattern", "event");
+
+-- AddForeignKey
+ALTER TABLE "channel_schemas" ADD CONSTRAINT "fk_apps_channel_schemas" FOREIGN KEY ("app_id") REFERENCES "apps"("id") ON DELETE CASCADE ON UPDATE CASCADE;
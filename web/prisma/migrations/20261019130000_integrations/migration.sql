@@ -0,0 +1,17 @@
+-- CreateTable
+CREATE TABLE "integrations" (
+    "id" TEXT NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_at" TIMESTAMP(3) NOT NULL,
+    "kind" TEXT NOT NULL,
+    "target" TEXT NOT NULL,
+    "secret" TEXT NOT NULL DEFAULT '',
+    "pattern" TEXT NOT NULL DEFAULT '*',
+    "events" TEXT NOT NULL DEFAULT '',
+    "app_id" TEXT NOT NULL,
+
+    CONSTRAINT "integrations_pkey" PRIMARY KEY ("id")
+);
+
+-- AddForeignKey
+ALTER TABLE "integrations" ADD CONSTRAINT "fk_apps_integrations" FOREIGN KEY ("app_id") REFERENCES "apps"("id") ON DELETE CASCADE ON UPDATE CASCADE;
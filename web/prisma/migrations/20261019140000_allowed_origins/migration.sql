@@ -0,0 +1,16 @@
+-- CreateTable
+CREATE TABLE "allowed_origins" (
+    "id" TEXT NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_at" TIMESTAMP(3) NOT NULL,
+    "origin" TEXT NOT NULL,
+    "app_id" TEXT NOT NULL,
+
+    CONSTRAINT "allowed_origins_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "allowed_origins_app_id_origin_key" ON "allowed_origins"("app_id", "origin");
+
+-- AddForeignKey
+ALTER TABLE "allowed_origins" ADD CONSTRAINT "fk_apps_allowed_origins" FOREIGN KEY ("app_id") REFERENCES "apps"("id") ON DELETE CASCADE ON UPDATE CASCADE;
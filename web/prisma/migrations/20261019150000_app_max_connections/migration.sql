@@ -0,0 +1,2 @@
+-- AlterTable
+ALTER TABLE "apps" ADD COLUMN "max_connections" INTEGER NOT NULL DEFAULT 0;